@@ -0,0 +1,95 @@
+// Package acl decides which clients may query a listener, by their source
+// address.
+package acl
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/erikh/ldnsd/responder"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// List is a set of allowed and denied networks.
+type List struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	drop  bool
+}
+
+// New creates a list. Clients in a denied network are denied, as are clients
+// outside every allowed network if there are any. Denied queries are refused,
+// or dropped without an answer if drop is true.
+func New(allow, deny []*net.IPNet, drop bool) *List {
+	return &List{allow: allow, deny: deny, drop: drop}
+}
+
+// Permits returns true if the client may query.
+func (l *List) Permits(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(l.allow) == 0 {
+		return true
+	}
+
+	for _, network := range l.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handler is a dns.Handler answering the queries the list permits with
+// another handler. The list can be replaced while queries are served.
+type Handler struct {
+	next dns.Handler
+	list atomic.Value
+}
+
+// NewHandler creates a handler checking queries against the list. A nil list
+// permits everyone.
+func NewHandler(next dns.Handler, list *List) *Handler {
+	h := &Handler{next: next}
+	h.Set(list)
+	return h
+}
+
+// Set replaces the list.
+func (h *Handler) Set(list *List) {
+	if list == nil {
+		list = &List{}
+	}
+
+	h.list.Store(list)
+}
+
+// ServeDNS implements dns.Handler.
+func (h *Handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	list := h.list.Load().(*List)
+
+	if list.Permits(responder.ClientIP(w)) {
+		h.next.ServeDNS(w, req)
+		return
+	}
+
+	if list.drop {
+		return
+	}
+
+	m := &dns.Msg{}
+	m.SetRcode(req, dns.RcodeRefused)
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing refusal: %v", err)
+	}
+}
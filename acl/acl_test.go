@@ -0,0 +1,50 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func networks(t *testing.T, cidrs ...string) []*net.IPNet {
+	ret := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, network)
+	}
+
+	return ret
+}
+
+func TestPermits(t *testing.T) {
+	table := map[string]struct {
+		list    *List
+		client  string
+		success bool
+	}{
+		"empty list":           {list: New(nil, nil, false), client: "192.0.2.1", success: true},
+		"allowed":              {list: New(networks(t, "10.0.0.0/8"), nil, false), client: "10.1.2.3", success: true},
+		"not allowed":          {list: New(networks(t, "10.0.0.0/8"), nil, false), client: "192.0.2.1"},
+		"denied":               {list: New(nil, networks(t, "192.0.2.0/24"), false), client: "192.0.2.1"},
+		"not denied":           {list: New(nil, networks(t, "192.0.2.0/24"), false), client: "198.51.100.1", success: true},
+		"denied inside allow":  {list: New(networks(t, "10.0.0.0/8"), networks(t, "10.0.1.0/24"), false), client: "10.0.1.1"},
+		"allowed beside deny":  {list: New(networks(t, "10.0.0.0/8"), networks(t, "10.0.1.0/24"), false), client: "10.0.2.1", success: true},
+		"ipv6 allowed":         {list: New(networks(t, "fd00::/8"), nil, false), client: "fd00::1", success: true},
+		"ipv4 not in ipv6 net": {list: New(networks(t, "fd00::/8"), nil, false), client: "10.0.0.1"},
+	}
+
+	for name, result := range table {
+		if permits := result.list.Permits(net.ParseIP(result.client)); permits != result.success {
+			if result.success {
+				t.Fatalf("Result for %q should be success but was not", name)
+			}
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+
+	if New(nil, nil, false).Permits(nil) {
+		t.Fatal("client without an address was permitted")
+	}
+}
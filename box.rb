@@ -1,4 +1,4 @@
-from "golang:1.14"
+from "golang:1.22"
 
 PROTOC_VERSION = "3.11.4"
 PROTOC_URL     = "https://github.com/protocolbuffers/protobuf/releases/download/v#{PROTOC_VERSION}/protoc-#{PROTOC_VERSION}-linux-x86_64.zip"
@@ -9,8 +9,8 @@ MKCERT_URL = "https://github.com/FiloSottile/mkcert/releases/download/v#{MKCERT_
 GOLANGCI_LINT_VERSION = "1.24.0"
 GOLANGCI_LINT_URL     = "https://github.com/golangci/golangci-lint/releases/download/v#{GOLANGCI_LINT_VERSION}/golangci-lint-#{GOLANGCI_LINT_VERSION}-linux-amd64.tar.gz"
 
-def go_get(name)
-  run "go get -v -u #{name}"
+def go_install(name)
+  run "go install -v #{name}"
 end
 
 def download(name, url)
@@ -47,6 +47,6 @@ end
 run "mkdir /etc/ldnsd && chown 1000:1000 /etc/ldnsd"
 env CAROOT: "/etc/ldnsd"
 
-go_get "github.com/golang/protobuf/protoc-gen-go"
+go_install "github.com/golang/protobuf/protoc-gen-go@v1.5.3"
 
 set_exec entrypoint: ["sh", "/entrypoint.sh"], cmd: ["bash"]
@@ -0,0 +1,300 @@
+// Package cluster replicates the records between ldnsd nodes with Raft. Every
+// mutation is proposed to the leader, which may be this node or another one,
+// and committed to the database of each node in the same order.
+package cluster
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/erikh/go-transport"
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	applyTimeout   = 10 * time.Second
+	snapshotsKept  = 2
+	maxPool        = 3
+	leaderInterval = 100 * time.Millisecond
+)
+
+// ErrNoLeader is returned when a request cannot be served because the cluster
+// has not elected a leader.
+var ErrNoLeader = errors.New("cluster has no leader")
+
+// Peer is a member of the cluster.
+type Peer struct {
+	ID      string
+	Address string
+	Voter   bool
+	Leader  bool
+}
+
+// Config configures a node.
+type Config struct {
+	// ID is the unique name of the node.
+	ID string
+	// Listen is the host:port raft listens on. It is also the address peers
+	// reach this node at.
+	Listen string
+	// Dir holds the raft log and snapshots.
+	Dir string
+	// Peers are the initial members of the cluster, including this node. A node
+	// with no peers waits to be added to an existing cluster.
+	Peers []Peer
+	// Cert authenticates the node to its peers, and its peers to it.
+	Cert *transport.Cert
+}
+
+// Status describes the node and the cluster it is a member of.
+type Status struct {
+	ID           string
+	State        string
+	Leader       string
+	Term         uint64
+	LastIndex    uint64
+	AppliedIndex uint64
+	Peers        []Peer
+}
+
+// request is a proposal forwarded from a follower to the leader.
+type request struct {
+	Command *dnsdb.Command `json:"command,omitempty"`
+	Join    *Peer          `json:"join,omitempty"`
+	Leave   string         `json:"leave,omitempty"`
+}
+
+type response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Node is a member of a cluster. It implements dnsdb.Proposer.
+type Node struct {
+	id     string
+	raft   *raft.Raft
+	store  *store
+	stream *streamLayer
+}
+
+// New starts a node that commits to db. If the node has no raft state yet and
+// peers are configured, the cluster is bootstrapped with them.
+func New(db *dnsdb.DB, c Config) (*Node, error) {
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "while creating cluster directory")
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: logrus.StandardLogger().Writer(),
+	})
+
+	n := &Node{id: c.ID}
+
+	var err error
+	n.store, err = newStore(filepath.Join(c.Dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(c.Dir, snapshotsKept, logger)
+	if err != nil {
+		n.store.Close()
+		return nil, errors.Wrap(err, "while opening snapshots")
+	}
+
+	n.stream, err = newStreamLayer(c.Cert, c.Listen, n.serveForward)
+	if err != nil {
+		n.store.Close()
+		return nil, err
+	}
+
+	trans := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+		Stream:  n.stream,
+		MaxPool: maxPool,
+		Timeout: applyTimeout,
+		Logger:  logger,
+	})
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(c.ID)
+	rc.Logger = logger
+
+	existing, err := raft.HasExistingState(n.store, n.store, snapshots)
+	if err != nil {
+		trans.Close()
+		n.store.Close()
+		return nil, errors.Wrap(err, "while reading raft state")
+	}
+
+	if !existing && len(c.Peers) > 0 {
+		servers := []raft.Server{}
+		for _, p := range c.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.Address)})
+		}
+
+		if err := raft.BootstrapCluster(rc, n.store, n.store, snapshots, trans, raft.Configuration{Servers: servers}); err != nil {
+			trans.Close()
+			n.store.Close()
+			return nil, errors.Wrap(err, "while bootstrapping cluster")
+		}
+	}
+
+	n.raft, err = raft.NewRaft(rc, &fsm{db: db}, n.store, n.store, snapshots, trans)
+	if err != nil {
+		trans.Close()
+		n.store.Close()
+		return nil, errors.Wrap(err, "while starting raft")
+	}
+
+	return n, nil
+}
+
+// Close leaves the node's membership alone, but stops it from taking part in
+// the cluster.
+func (n *Node) Close() error {
+	err := n.raft.Shutdown().Error()
+	n.stream.Close()
+	n.store.Close()
+	return err
+}
+
+// Propose implements dnsdb.Proposer.
+func (n *Node) Propose(c *dnsdb.Command) error {
+	return n.do(&request{Command: c})
+}
+
+// Join adds a voting member to the cluster.
+func (n *Node) Join(id, address string) error {
+	if id == "" || address == "" {
+		return errors.New("id and address are required to join")
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return errors.Wrapf(err, "invalid address %q", address)
+	}
+
+	return n.do(&request{Join: &Peer{ID: id, Address: address}})
+}
+
+// Leave removes a member from the cluster.
+func (n *Node) Leave(id string) error {
+	if id == "" {
+		return errors.New("id is required to leave")
+	}
+
+	return n.do(&request{Leave: id})
+}
+
+// do serves the request if this node is the leader, and forwards it to the
+// leader otherwise. If there is no leader, it waits for one to be elected.
+func (n *Node) do(req *request) error {
+	deadline := time.Now().Add(applyTimeout)
+
+	for {
+		if n.raft.State() == raft.Leader {
+			return n.serve(req)
+		}
+
+		if addr, _ := n.raft.LeaderWithID(); addr != "" {
+			return n.stream.roundTrip(addr, req, applyTimeout)
+		}
+
+		if time.Now().After(deadline) {
+			return ErrNoLeader
+		}
+
+		time.Sleep(leaderInterval)
+	}
+}
+
+func (n *Node) serve(req *request) error {
+	switch {
+	case req.Command != nil:
+		data, err := json.Marshal(req.Command)
+		if err != nil {
+			return errors.Wrap(err, "while encoding command")
+		}
+
+		f := n.raft.Apply(data, applyTimeout)
+		if err := f.Error(); err != nil {
+			return errors.Wrap(err, "while replicating command")
+		}
+
+		if err, ok := f.Response().(error); ok {
+			return err
+		}
+
+		return nil
+	case req.Join != nil:
+		return n.raft.AddVoter(raft.ServerID(req.Join.ID), raft.ServerAddress(req.Join.Address), 0, applyTimeout).Error()
+	case req.Leave != "":
+		return n.raft.RemoveServer(raft.ServerID(req.Leave), 0, applyTimeout).Error()
+	default:
+		return errors.New("empty request")
+	}
+}
+
+// serveForward serves a request forwarded by a follower.
+func (n *Node) serveForward(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(applyTimeout + handshakeTimeout))
+
+	req := &request{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		logrus.Warnf("Invalid request forwarded from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	resp := &response{}
+	if n.raft.State() != raft.Leader {
+		// leadership changed while the request was in flight.
+		resp.Error = raft.ErrNotLeader.Error()
+	} else if err := n.serve(req); err != nil {
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logrus.Warnf("Error responding to %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Status returns the state of the node and the members of the cluster.
+func (n *Node) Status() (*Status, error) {
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, errors.Wrap(err, "while reading cluster configuration")
+	}
+
+	leaderAddr, leaderID := n.raft.LeaderWithID()
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	s := &Status{
+		ID:           n.id,
+		State:        n.raft.State().String(),
+		Leader:       string(leaderID),
+		Term:         term,
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+	}
+
+	for _, server := range f.Configuration().Servers {
+		s.Peers = append(s.Peers, Peer{
+			ID:      string(server.ID),
+			Address: string(server.Address),
+			Voter:   server.Suffrage == raft.Voter,
+			Leader:  server.Address == leaderAddr,
+		})
+	}
+
+	return s, nil
+}
@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+// fsm commits the raft log to the database. The database is durable on its
+// own and remembers the last index it committed, so entries replayed after a
+// restart are skipped.
+type fsm struct {
+	db *dnsdb.DB
+}
+
+// Apply implements raft.FSM. The response is the error from the commit, if
+// any, and is returned to the proposer.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	c := &dnsdb.Command{}
+	if err := json.Unmarshal(l.Data, c); err != nil {
+		return errors.Wrapf(err, "invalid command at index %d", l.Index)
+	}
+
+	return f.db.Commit(l.Index, c)
+}
+
+// Snapshot implements raft.FSM.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	records, index, err := f.db.ClusterSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{Index: index, Records: records}, nil
+}
+
+// Restore implements raft.FSM.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	s := &snapshot{}
+	if err := json.NewDecoder(rc).Decode(s); err != nil {
+		return errors.Wrap(err, "while reading snapshot")
+	}
+
+	return f.db.Restore(s.Index, s.Records)
+}
+
+type snapshot struct {
+	Index   uint64          `json:"index"`
+	Records []*dnsdb.Record `json:"records"`
+}
+
+// Persist implements raft.FSMSnapshot.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "while writing snapshot")
+	}
+
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot.
+func (s *snapshot) Release() {}
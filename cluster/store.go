@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // import sqlite3
+	"github.com/pkg/errors"
+)
+
+// errNotFound is the error raft expects from a stable store for missing keys.
+var errNotFound = errors.New("not found")
+
+type logEntry struct {
+	Index      uint64 `gorm:"primary_key;auto_increment:false"`
+	Term       uint64
+	Type       uint8
+	Data       []byte
+	Extensions []byte
+	AppendedAt time.Time
+}
+
+type stableEntry struct {
+	Key   string `gorm:"primary_key"`
+	Value []byte
+}
+
+// store keeps the raft log and stable state in a sqlite database of its own,
+// next to the snapshots.
+type store struct {
+	db *gorm.DB
+}
+
+func newStore(filename string) (*store, error) {
+	db, err := gorm.Open("sqlite3", filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open raft log")
+	}
+
+	if err := db.AutoMigrate(&logEntry{}, &stableEntry{}).Error; err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "while migrating raft log")
+	}
+
+	return &store{db: db}, nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) index(fn string) (uint64, error) {
+	var idx struct{ Index uint64 }
+	if err := s.db.Model(&logEntry{}).Select("coalesce(" + fn + "(`index`), 0) as `index`").Scan(&idx).Error; err != nil {
+		return 0, errors.Wrap(err, "while reading raft log")
+	}
+
+	return idx.Index, nil
+}
+
+// FirstIndex implements raft.LogStore.
+func (s *store) FirstIndex() (uint64, error) {
+	return s.index("min")
+}
+
+// LastIndex implements raft.LogStore.
+func (s *store) LastIndex() (uint64, error) {
+	return s.index("max")
+}
+
+// GetLog implements raft.LogStore.
+func (s *store) GetLog(index uint64, log *raft.Log) error {
+	e := &logEntry{}
+	err := s.db.First(e, "`index` = ?", index).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return raft.ErrLogNotFound
+	case err != nil:
+		return errors.Wrapf(err, "while reading raft log entry %d", index)
+	}
+
+	*log = raft.Log{
+		Index:      e.Index,
+		Term:       e.Term,
+		Type:       raft.LogType(e.Type),
+		Data:       e.Data,
+		Extensions: e.Extensions,
+		AppendedAt: e.AppendedAt,
+	}
+
+	return nil
+}
+
+// StoreLog implements raft.LogStore.
+func (s *store) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs implements raft.LogStore.
+func (s *store) StoreLogs(logs []*raft.Log) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, log := range logs {
+			e := &logEntry{
+				Index:      log.Index,
+				Term:       log.Term,
+				Type:       uint8(log.Type),
+				Data:       log.Data,
+				Extensions: log.Extensions,
+				AppendedAt: log.AppendedAt,
+			}
+
+			if err := tx.Save(e).Error; err != nil {
+				return errors.Wrapf(err, "while writing raft log entry %d", log.Index)
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeleteRange implements raft.LogStore.
+func (s *store) DeleteRange(min, max uint64) error {
+	if err := s.db.Delete(&logEntry{}, "`index` >= ? AND `index` <= ?", min, max).Error; err != nil {
+		return errors.Wrap(err, "while truncating raft log")
+	}
+
+	return nil
+}
+
+// Set implements raft.StableStore.
+func (s *store) Set(key []byte, val []byte) error {
+	if err := s.db.Save(&stableEntry{Key: string(key), Value: val}).Error; err != nil {
+		return errors.Wrapf(err, "while writing %q", key)
+	}
+
+	return nil
+}
+
+// Get implements raft.StableStore.
+func (s *store) Get(key []byte) ([]byte, error) {
+	e := &stableEntry{}
+	err := s.db.First(e, "key = ?", string(key)).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, errNotFound
+	case err != nil:
+		return nil, errors.Wrapf(err, "while reading %q", key)
+	}
+
+	return e.Value, nil
+}
+
+// SetUint64 implements raft.StableStore.
+func (s *store) SetUint64(key []byte, val uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, val)
+	return s.Set(key, buf)
+}
+
+// GetUint64 implements raft.StableStore.
+func (s *store) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	switch {
+	case err == errNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	case len(val) != 8:
+		return 0, errors.Errorf("invalid value for %q", key)
+	}
+
+	return binary.BigEndian.Uint64(val), nil
+}
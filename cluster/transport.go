@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/erikh/go-transport"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Every connection to the cluster port starts with a byte saying what it is
+// for, so raft and forwarded requests can share the port.
+const (
+	connRaft    byte = 'R'
+	connForward byte = 'F'
+
+	handshakeTimeout = 10 * time.Second
+)
+
+// streamLayer carries raft traffic over the mTLS transport used for GRPC.
+type streamLayer struct {
+	listener  net.Listener
+	addr      net.Addr
+	tlsConfig *tls.Config
+	forward   func(net.Conn)
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamLayer(cert *transport.Cert, listen string, forward func(net.Conn)) (*streamLayer, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cluster address %q", listen)
+	}
+
+	h, err := transport.NewHTTP(cert)
+	if err != nil {
+		return nil, errors.Wrap(err, "while configuring cluster transport")
+	}
+
+	l, err := transport.Listen(cert, "tcp", listen)
+	if err != nil {
+		return nil, errors.Wrap(err, "while configuring cluster listener")
+	}
+
+	s := &streamLayer{
+		listener:  l,
+		addr:      addr,
+		tlsConfig: h.Client(nil).Transport.(*http.Transport).TLSClientConfig,
+		forward:   forward,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+
+	go s.serve()
+
+	return s, nil
+}
+
+func (s *streamLayer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				logrus.Errorf("Error accepting cluster connection: %v", err)
+				s.Close()
+			}
+			return
+		}
+
+		go s.handshake(conn)
+	}
+}
+
+func (s *streamLayer) handshake(conn net.Conn) {
+	kind := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := conn.Read(kind); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch kind[0] {
+	case connRaft:
+		select {
+		case s.conns <- conn:
+		case <-s.closed:
+			conn.Close()
+		}
+	case connForward:
+		s.forward(conn)
+	default:
+		logrus.Warnf("Unknown cluster connection type %q from %v", kind[0], conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// Accept implements net.Listener.
+func (s *streamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.closed:
+		return nil, errors.New("cluster listener closed")
+	}
+}
+
+// Close implements net.Listener.
+func (s *streamLayer) Close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.listener.Close()
+	})
+
+	return err
+}
+
+// Addr implements net.Listener. It is the address advertised to peers.
+func (s *streamLayer) Addr() net.Addr {
+	return s.addr
+}
+
+// Dial implements raft.StreamLayer.
+func (s *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return s.dial(address, connRaft, timeout)
+}
+
+func (s *streamLayer) dial(address raft.ServerAddress, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), s.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{kind}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// roundTrip sends a request to the node at address and waits for its
+// response.
+func (s *streamLayer) roundTrip(address raft.ServerAddress, req *request, timeout time.Duration) error {
+	conn, err := s.dial(address, connForward, timeout)
+	if err != nil {
+		return errors.Wrapf(err, "while connecting to the leader at %v", address)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return errors.Wrapf(err, "while forwarding to the leader at %v", address)
+	}
+
+	resp := &response{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return errors.Wrapf(err, "while reading the response of the leader at %v", address)
+	}
+
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
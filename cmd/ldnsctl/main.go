@@ -3,13 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/hosts"
+	"github.com/erikh/ldnsd/plan"
 	"github.com/erikh/ldnsd/proto"
 	"github.com/erikh/ldnsd/version"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -43,6 +51,10 @@ func main() {
 			Usage: "Set the certificate authority",
 			Value: "/etc/ldnsd/rootCA.pem",
 		},
+		cli.StringFlag{
+			Name:  "view",
+			Usage: "Work on the records of a view instead of the default view",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -50,13 +62,23 @@ func main() {
 			Name:      "list",
 			ArgsUsage: " ",
 			Action:    list,
-			Usage:     "List the A record table",
+			Usage:     "List the A record table; every view unless --view is given",
 		},
 		{
 			Name:      "set",
 			Action:    set,
-			ArgsUsage: "[host] [v4 IP]",
+			ArgsUsage: "[host] [v4 IP[,v4 IP...]]",
 			Usage:     "Set an A record, only takes IPv4",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "check",
+					Usage: "Health check the addresses with tcp:PORT or http:PORT/PATH, and only serve the ones that pass",
+				},
+				cli.StringFlag{
+					Name:  "policy",
+					Usage: "Choose among the addresses with weighted:WEIGHT,... or failover",
+				},
+			},
 		},
 		{
 			Name:      "delete",
@@ -64,6 +86,162 @@ func main() {
 			ArgsUsage: "[host]",
 			Usage:     "Delete an A record by hostname",
 		},
+		{
+			Name:      "import",
+			Action:    importRecords,
+			ArgsUsage: "[file]",
+			Usage:     "Import A records from a file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "Format of the file; only 'hosts' is supported",
+					Value: "hosts",
+				},
+				cli.StringFlag{
+					Name:  "domain, d",
+					Usage: "Domain suffix to strip from imported names",
+					Value: "internal",
+				},
+			},
+		},
+		{
+			Name:      "export",
+			Action:    exportRecords,
+			ArgsUsage: " ",
+			Usage:     "Export the A record table to standard output",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "Format of the output; only 'hosts' is supported",
+					Value: "hosts",
+				},
+				cli.StringFlag{
+					Name:  "domain, d",
+					Usage: "Domain suffix to qualify exported names with",
+					Value: "internal",
+				},
+			},
+		},
+		{
+			Name:      "apply",
+			Action:    apply,
+			ArgsUsage: " ",
+			Usage:     "Make the A record table match a YAML file of records",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "YAML file of records to apply",
+				},
+				cli.BoolFlag{
+					Name:  "prune",
+					Usage: "Delete records that are not in the file",
+				},
+			},
+		},
+		{
+			Name:      "diff",
+			Action:    diff,
+			ArgsUsage: " ",
+			Usage:     "Show what apply would change without changing anything",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "YAML file of records to compare",
+				},
+				cli.BoolFlag{
+					Name:  "prune",
+					Usage: "Include records that are not in the file as deletions",
+				},
+				cli.BoolFlag{
+					Name:  "exit-code",
+					Usage: "Exit with an error if there are changes",
+				},
+			},
+		},
+		{
+			Name:      "watch",
+			Action:    watch,
+			ArgsUsage: " ",
+			Usage:     "Print record changes as they happen",
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name:  "revision, r",
+					Usage: "Print changes after this revision; 0 is the current revision",
+				},
+			},
+		},
+		{
+			Name:  "cluster",
+			Usage: "Manage the members of a cluster",
+			Subcommands: []cli.Command{
+				{
+					Name:      "status",
+					Action:    clusterStatus,
+					ArgsUsage: " ",
+					Usage:     "Show the state of the node and the members of its cluster",
+				},
+				{
+					Name:      "join",
+					Action:    clusterJoin,
+					ArgsUsage: "[id] [address]",
+					Usage:     "Add a node, listening for raft traffic on address, to the cluster",
+				},
+				{
+					Name:      "leave",
+					Action:    clusterLeave,
+					ArgsUsage: "[id]",
+					Usage:     "Remove a node from the cluster",
+				},
+			},
+		},
+		{
+			Name:  "policy",
+			Usage: "Manage how the addresses of records are chosen",
+			Subcommands: []cli.Command{
+				{
+					Name:      "set",
+					Action:    policySet,
+					ArgsUsage: "[host] [policy]",
+					Usage:     "Serve one address picked by weight (weighted:90,10), or the first that is up (failover)",
+				},
+				{
+					Name:      "clear",
+					Action:    policyClear,
+					ArgsUsage: "[host]",
+					Usage:     "Serve every address again, in random order",
+				},
+			},
+		},
+		{
+			Name:      "ratelimit",
+			Action:    rateLimit,
+			ArgsUsage: " ",
+			Usage:     "Show how many responses the rate limiter held back",
+		},
+		{
+			Name:      "dnstap",
+			Action:    dnstap,
+			ArgsUsage: " ",
+			Usage:     "Show how many dnstap messages were sent and dropped",
+		},
+		{
+			Name:  "dnssec",
+			Usage: "Show the DNSSEC configuration of the domain",
+			Subcommands: []cli.Command{
+				{
+					Name:      "ds",
+					Action:    dnssecDS,
+					ArgsUsage: " ",
+					Usage:     "Print the DS record to install in the parent zone",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dnskey",
+							Usage: "Print the DNSKEY record as well",
+						},
+					},
+				},
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -92,15 +270,32 @@ func list(ctx *cli.Context) error {
 		return errors.Wrap(err, "cold not query A record list")
 	}
 
-	fmt.Println("Host\tIP")
+	fmt.Println("Host\tIP\tStatic\tView\tPolicy\tHealth")
 
 	for _, record := range list.Records {
-		fmt.Printf("%s\t%s\n", record.Host, record.Address)
+		if ctx.GlobalIsSet("view") && record.View != ctx.GlobalString("view") {
+			continue
+		}
+
+		fmt.Printf("%s\t%s\t%v\t%s\t%s\t%s\n", record.Host, record.Address, record.Static, record.View, record.Policy, health(record))
 	}
 
 	return nil
 }
 
+// health describes the health of the addresses of a record: empty if they are
+// not checked, and which are down otherwise.
+func health(record *proto.Record) string {
+	switch {
+	case record.Check == "":
+		return ""
+	case len(record.Down) == 0:
+		return fmt.Sprintf("up (%s)", record.Check)
+	default:
+		return fmt.Sprintf("down: %s (%s)", strings.Join(record.Down, ","), record.Check)
+	}
+}
+
 func set(ctx *cli.Context) error {
 	if len(ctx.Args()) != 2 {
 		return errors.New("invalid arguments")
@@ -114,6 +309,9 @@ func set(ctx *cli.Context) error {
 	_, err = client.SetA(context.Background(), &proto.Record{
 		Host:    ctx.Args()[0],
 		Address: ctx.Args()[1],
+		View:    ctx.GlobalString("view"),
+		Check:   ctx.String("check"),
+		Policy:  ctx.String("policy"),
 	})
 
 	if err != nil {
@@ -133,10 +331,391 @@ func delete(ctx *cli.Context) error {
 		return errors.Wrap(err, "could not create client")
 	}
 
-	_, err = client.DeleteA(context.Background(), &proto.Record{Host: ctx.Args()[0]})
+	_, err = client.DeleteA(context.Background(), &proto.Record{Host: ctx.Args()[0], View: ctx.GlobalString("view")})
 	if err != nil {
 		return errors.Wrap(err, "could not set A record")
 	}
 
 	return nil
 }
+
+func checkFormat(ctx *cli.Context) error {
+	if ctx.String("format") != "hosts" {
+		return errors.Errorf("unsupported format %q", ctx.String("format"))
+	}
+
+	return nil
+}
+
+func importRecords(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("invalid arguments")
+	}
+
+	if err := checkFormat(ctx); err != nil {
+		return err
+	}
+
+	f, err := os.Open(ctx.Args()[0])
+	if err != nil {
+		return errors.Wrap(err, "could not open file for import")
+	}
+	defer f.Close()
+
+	records, errs := hosts.Parse(f, ctx.String("domain"))
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "skipping: %v\n", err)
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	var failed int
+	for _, record := range records {
+		_, err := client.SetA(context.Background(), &proto.Record{Host: record.Host, Address: record.Address, View: ctx.GlobalString("view")})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set A record %q: %v\n", record.Host, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("Imported %d records\n", len(records)-failed)
+
+	if failed+len(errs) > 0 {
+		return errors.Errorf("%d lines were skipped and %d records could not be set", len(errs), failed)
+	}
+
+	return nil
+}
+
+func exportRecords(ctx *cli.Context) error {
+	if err := checkFormat(ctx); err != nil {
+		return err
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		return errors.Wrap(err, "could not query A record list")
+	}
+
+	records := []*dnsdb.Record{}
+	for _, record := range list.Records {
+		if record.View == ctx.GlobalString("view") {
+			records = append(records, &dnsdb.Record{Host: record.Host, Address: record.Address})
+		}
+	}
+
+	return hosts.Write(os.Stdout, ctx.String("domain"), records)
+}
+
+func makePlan(ctx *cli.Context, client proto.DNSControlClient) (*plan.Plan, error) {
+	if len(ctx.Args()) != 0 || ctx.String("file") == "" {
+		return nil, errors.New("invalid arguments")
+	}
+
+	f, err := os.Open(ctx.String("file"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open records file")
+	}
+	defer f.Close()
+
+	desired, err := plan.Load(f)
+	if err != nil {
+		return nil, err
+	}
+
+	view := ctx.GlobalString("view")
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query A record list")
+	}
+
+	current := []*dnsdb.Record{}
+	static := map[string]struct{}{}
+	for _, record := range list.Records {
+		if record.View != view {
+			continue
+		}
+
+		current = append(current, &dnsdb.Record{Host: record.Host, Address: record.Address, Check: record.Check, Policy: record.Policy})
+		if record.Static {
+			static[record.Host] = struct{}{}
+		}
+	}
+
+	p := plan.Diff(desired, current, ctx.Bool("prune"))
+
+	// static records cannot be deleted, so never try to prune them.
+	remove := []*dnsdb.Record{}
+	for _, record := range p.Remove {
+		if _, ok := static[record.Host]; !ok {
+			remove = append(remove, record)
+		}
+	}
+	p.Remove = remove
+
+	return p, nil
+}
+
+func diff(ctx *cli.Context) error {
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	p, err := makePlan(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(p)
+
+	if ctx.Bool("exit-code") && !p.Empty() {
+		return errors.New("records differ")
+	}
+
+	return nil
+}
+
+func apply(ctx *cli.Context) error {
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	p, err := makePlan(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(p)
+
+	if p.Empty() {
+		return nil
+	}
+
+	view := ctx.GlobalString("view")
+
+	changes := &proto.Changes{}
+	for _, record := range p.Set() {
+		changes.Set = append(changes.Set, &proto.Record{Host: record.Host, Address: record.Address, Check: record.Check, Policy: record.Policy, View: view})
+	}
+
+	for _, record := range p.Remove {
+		changes.Delete = append(changes.Delete, &proto.Record{Host: record.Host, View: view})
+	}
+
+	if _, err := client.Apply(context.Background(), changes); err != nil {
+		return errors.Wrap(err, "could not apply changes")
+	}
+
+	return nil
+}
+
+func watch(ctx *cli.Context) error {
+	if len(ctx.Args()) != 0 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	revision := ctx.Uint64("revision")
+	if revision == 0 {
+		// pin the starting point so a reconnect does not skip anything, even
+		// when the journal is empty and the revision is 0.
+		list, err := client.ListA(context.Background(), &empty.Empty{})
+		if err != nil {
+			return errors.Wrap(err, "could not query current revision")
+		}
+
+		revision = list.Revision
+	}
+
+	fmt.Println("Revision\tType\tHost\tIP\tView")
+
+	for {
+		stream, err := client.Watch(context.Background(), &proto.WatchRequest{Revision: revision, Pinned: true})
+		if err != nil {
+			return errors.Wrap(err, "could not watch records")
+		}
+
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+
+				if status.Code(err) != codes.Unavailable {
+					return errors.Wrap(err, "while watching records")
+				}
+
+				// the server restarted or we fell behind; pick up where we left off.
+				fmt.Fprintf(os.Stderr, "watch interrupted, resuming from revision %d: %v\n", revision, err)
+				time.Sleep(time.Second)
+				break
+			}
+
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\n", event.Revision, event.Type, event.Record.Host, event.Record.Address, event.Record.View)
+			revision = event.Revision
+		}
+	}
+}
+
+func clusterStatus(ctx *cli.Context) error {
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	s, err := client.ClusterStatus(context.Background(), &empty.Empty{})
+	if err != nil {
+		return errors.Wrap(err, "could not query cluster status")
+	}
+
+	fmt.Printf("Node:\t%s\nState:\t%s\nLeader:\t%s\nTerm:\t%d\nIndex:\t%d (applied %d)\n\n", s.Id, s.State, s.Leader, s.Term, s.LastIndex, s.AppliedIndex)
+	fmt.Println("ID\tAddress\tVoter\tLeader")
+
+	for _, p := range s.Peers {
+		fmt.Printf("%s\t%s\t%v\t%v\n", p.Id, p.Address, p.Voter, p.Leader)
+	}
+
+	return nil
+}
+
+func clusterJoin(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	if _, err := client.ClusterJoin(context.Background(), &proto.Peer{Id: ctx.Args()[0], Address: ctx.Args()[1]}); err != nil {
+		return errors.Wrap(err, "could not add node to the cluster")
+	}
+
+	return nil
+}
+
+func clusterLeave(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	if _, err := client.ClusterLeave(context.Background(), &proto.Peer{Id: ctx.Args()[0]}); err != nil {
+		return errors.Wrap(err, "could not remove node from the cluster")
+	}
+
+	return nil
+}
+
+func dnssecDS(ctx *cli.Context) error {
+	if len(ctx.Args()) != 0 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	key, err := client.DNSSECKey(context.Background(), &empty.Empty{})
+	if err != nil {
+		return errors.Wrap(err, "could not query dnssec key")
+	}
+
+	fmt.Println(key.Ds)
+
+	if ctx.Bool("dnskey") {
+		fmt.Println(key.Dnskey)
+	}
+
+	return nil
+}
+
+func rateLimit(ctx *cli.Context) error {
+	if len(ctx.Args()) != 0 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	c, err := client.RateLimitCounters(context.Background(), &empty.Empty{})
+	if err != nil {
+		return errors.Wrap(err, "could not query rate limit counters")
+	}
+
+	fmt.Printf("Dropped:\t%d\nSlipped:\t%d\n", c.Dropped, c.Slipped)
+	return nil
+}
+
+func dnstap(ctx *cli.Context) error {
+	if len(ctx.Args()) != 0 {
+		return errors.New("invalid arguments")
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	c, err := client.DNSTapCounters(context.Background(), &empty.Empty{})
+	if err != nil {
+		return errors.Wrap(err, "could not query dnstap counters")
+	}
+
+	fmt.Printf("Sent:\t%d\nDropped:\t%d\n", c.Sent, c.Dropped)
+	return nil
+}
+
+func policySet(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.New("invalid arguments")
+	}
+
+	return setPolicy(ctx, ctx.Args()[0], ctx.Args()[1])
+}
+
+func policyClear(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("invalid arguments")
+	}
+
+	return setPolicy(ctx, ctx.Args()[0], "")
+}
+
+func setPolicy(ctx *cli.Context, host, policy string) error {
+	client, err := getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not create client")
+	}
+
+	_, err = client.SetPolicy(context.Background(), &proto.RoutingPolicy{Host: host, View: ctx.GlobalString("view"), Policy: policy})
+	if err != nil {
+		return errors.Wrap(err, "could not set policy")
+	}
+
+	return nil
+}
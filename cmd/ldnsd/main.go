@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/erikh/ldnsd/config"
+	"github.com/erikh/ldnsd/dnsdb"
 	"github.com/erikh/ldnsd/service"
 	"github.com/erikh/ldnsd/version"
 	"github.com/pkg/errors"
@@ -24,6 +26,21 @@ func main() {
 	app.Author = Author
 	app.Action = runDNS
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "fsck",
+			Action:    fsck,
+			ArgsUsage: "[db file]",
+			Usage:     "Check the database for records that cannot be served and for schema drift",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Move invalid records into the quarantine table",
+				},
+			},
+		},
+	}
+
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -45,7 +62,58 @@ func runDNS(ctx *cli.Context) error {
 		return errors.Wrap(err, "while running service")
 	}
 
-	srv.InstallSignalHandler()
+	srv.InstallSignalHandler(ctx.Args()[0])
 
 	return srv.Boot()
 }
+
+func fsck(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.New("invalid arguments")
+	}
+
+	if _, err := os.Stat(ctx.Args()[0]); err != nil {
+		return errors.Wrap(err, "could not open database")
+	}
+
+	report, err := dnsdb.Check(ctx.Args()[0], ctx.Bool("repair"))
+	if err != nil {
+		return errors.Wrap(err, "while checking database")
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Printf("invalid: %s\n", problem)
+	}
+
+	for _, hosts := range report.Duplicates {
+		fmt.Printf("duplicate: %s differ only by case\n", strings.Join(hosts, ", "))
+	}
+
+	for _, drift := range report.Drift {
+		fmt.Printf("schema: %s\n", drift)
+	}
+
+	if report.Quarantined > 0 {
+		fmt.Printf("Quarantined %d records\n", report.Quarantined)
+	}
+
+	if report.Clean() {
+		fmt.Println("No problems found.")
+		return nil
+	}
+
+	if report.Quarantined > 0 {
+		report, err = dnsdb.Check(ctx.Args()[0], false)
+		if err != nil {
+			return errors.Wrap(err, "while re-checking database")
+		}
+
+		if report.Clean() {
+			return nil
+		}
+
+		return errors.New("database still has problems after repair")
+	}
+
+	return errors.New("database has problems")
+}
@@ -1,9 +1,17 @@
 package config
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/erikh/go-transport"
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -15,20 +23,613 @@ const (
 	defaultKeyFile  = "/etc/ldnsd/server.key"
 	defaultDomain   = "internal"
 
+	defaultClientCertFile = "/etc/ldnsd/client.pem"
+	defaultClientKeyFile  = "/etc/ldnsd/client.key"
+	defaultClusterDir     = "ldnsd-cluster"
+	defaultWebhookQueue   = "ldnsd-webhooks.db"
+	defaultDNSSECKey      = "/etc/ldnsd/dnssec.key"
+	defaultDNSSECPrivate  = "/etc/ldnsd/dnssec.private"
+	defaultDNSSECAlg      = "ECDSAP256SHA256"
+	defaultTSIGAlg        = "hmac-sha256"
+
+	defaultWebhookQueueSize = 10000
+	defaultHealthInterval   = 10
+	defaultDNSTapQueueSize  = 10000
+
+	defaultResponsesPerSecond = 20
+	defaultSlip               = 2
+	defaultIPv4PrefixLength   = 24
+	defaultIPv6PrefixLength   = 56
+
+	// ACLRefuse and ACLDrop are the actions for queries an ACL denies.
+	ACLRefuse = "refuse"
+	ACLDrop   = "drop"
+
 	// DefaultGRPCListen is the default host:port that we listen for GRPC requests on.
 	DefaultGRPCListen = "localhost:7847"
 	// DefaultDNSListen is the default host:port that we listen for DNS requests on.
 	DefaultDNSListen = "localhost:53"
+
+	// ProtocolUDP and ProtocolTCP are the protocols of listeners.
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
 )
 
 // Config is the configuration of the dhcpd service
 type Config struct {
-	GRPCListen string `yaml:"grpc"`
-	DNSListen  string `yaml:"listen"`
-	Domain     string `yaml:"domain"`
+	GRPCListen string    `yaml:"grpc"`
+	DNSListen  Listeners `yaml:"listen"`
+	Domain     string    `yaml:"domain"`
 
 	DBFile      string      `yaml:"db_file"`
 	Certificate Certificate `yaml:"certificate"`
+
+	// DoTListen, if set, is the host:port DNS-over-TLS is served on.
+	DoTListen string `yaml:"dot_listen"`
+	// DoTCertificate is the certificate for DNS-over-TLS. It defaults to the
+	// certificate used for GRPC; no CA is needed since clients do not present
+	// certificates.
+	DoTCertificate *Certificate `yaml:"dot_certificate"`
+
+	// DoHListen, if set, is the host:port DNS-over-HTTPS is served on.
+	DoHListen string `yaml:"doh_listen"`
+	// DoHCertificate is the certificate for DNS-over-HTTPS. Like
+	// DoTCertificate, it defaults to the certificate used for GRPC.
+	DoHCertificate *Certificate `yaml:"doh_certificate"`
+
+	// DoQListen, if set, is the host:port DNS-over-QUIC is served on.
+	DoQListen string `yaml:"doq_listen"`
+	// DoQCertificate is the certificate for DNS-over-QUIC, defaulting like
+	// DoTCertificate.
+	DoQCertificate *Certificate `yaml:"doq_certificate"`
+
+	// JournalSize is the number of changes kept for resuming watches and
+	// incremental zone transfers. 0 keeps every change.
+	JournalSize *uint64 `yaml:"journal_size"`
+
+	// Records are static records that always exist and cannot be modified
+	// over GRPC.
+	Records []*dnsdb.Record `yaml:"records"`
+
+	// HealthInterval is the number of seconds between the health checks of
+	// the addresses of records that have one.
+	HealthInterval int `yaml:"health_interval"`
+
+	// ACL decides which clients may query the DNS listeners.
+	ACL ACL `yaml:"acl"`
+
+	// UpdateKeys are the TSIG keys allowed to change records with DNS UPDATE
+	// messages (RFC 2136). UPDATE messages are refused if there are none.
+	UpdateKeys []*UpdateKey `yaml:"update_keys"`
+
+	// RateLimit, if set, limits the rate of responses sent over UDP to each
+	// client network.
+	RateLimit *RateLimit `yaml:"rate_limit"`
+
+	// DNSSEC, if set, signs the answers for the domain.
+	DNSSEC *DNSSEC `yaml:"dnssec"`
+
+	// DNSTap, if set, logs client queries and responses as dnstap messages.
+	DNSTap *DNSTap `yaml:"dnstap"`
+
+	// Views give clients in different networks different answers. A client is
+	// served from the first view that matches it; hosts that view has no
+	// record for, and clients no view matches, are served from the default
+	// view.
+	Views []*View `yaml:"views"`
+
+	// Primary, if set, makes this server a read-only secondary of another ldnsd.
+	Primary *Primary `yaml:"primary"`
+
+	// Transfer controls zone transfers: transfer.allow lists the networks that
+	// may transfer the domain with AXFR and IXFR, and is empty by default, which
+	// refuses every transfer. transfer.notify lists the secondaries told of
+	// changes.
+	Transfer Transfer `yaml:"transfer"`
+
+	// Forward sends queries for names outside the domain to upstream
+	// resolvers.
+	Forward Forward `yaml:"forward"`
+
+	// Zones are transferred from external primaries and served read-only.
+	Zones []*Zone `yaml:"zones"`
+
+	// Cluster, if set, replicates the records between several nodes with Raft.
+	Cluster *Cluster `yaml:"cluster"`
+
+	// Webhooks are sent every change to the records.
+	Webhooks []*Webhook `yaml:"webhooks"`
+	// WebhookQueue is the file events are queued in until they are delivered.
+	WebhookQueue string `yaml:"webhook_queue"`
+	// WebhookQueueSize is the number of undelivered events kept; the oldest
+	// are dropped when the queue is full.
+	WebhookQueueSize int `yaml:"webhook_queue_size"`
+}
+
+// DNSSEC configures the signing of the domain.
+type DNSSEC struct {
+	// KeyFile holds the public key as a DNSKEY record, and PrivateKeyFile the
+	// private key. A key is generated into them if neither exists.
+	KeyFile        string `yaml:"key"`
+	PrivateKeyFile string `yaml:"private_key"`
+	// Algorithm is the algorithm keys are generated with, like
+	// ECDSAP256SHA256 or ED25519.
+	Algorithm string `yaml:"algorithm"`
+	// NSEC3 proves names do not exist with NSEC3 instead of NSEC.
+	NSEC3 bool `yaml:"nsec3"`
+}
+
+// AlgorithmNumber returns the DNSSEC number of the algorithm.
+func (d *DNSSEC) AlgorithmNumber() (uint8, error) {
+	alg, ok := dns.StringToAlgorithm[strings.ToUpper(d.Algorithm)]
+	if !ok {
+		return 0, errors.Errorf("unknown dnssec algorithm %q", d.Algorithm)
+	}
+
+	switch alg {
+	case dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return alg, nil
+	default:
+		return 0, errors.Errorf("dnssec algorithm %q is not supported", d.Algorithm)
+	}
+}
+
+func (d *DNSSEC) validateAndFix() error {
+	if d.KeyFile == "" {
+		d.KeyFile = defaultDNSSECKey
+	}
+
+	if d.PrivateKeyFile == "" {
+		d.PrivateKeyFile = defaultDNSSECPrivate
+	}
+
+	if d.Algorithm == "" {
+		d.Algorithm = defaultDNSSECAlg
+	}
+
+	if d.KeyFile == d.PrivateKeyFile {
+		return errors.New("key and private_key must be different files")
+	}
+
+	_, err := d.AlgorithmNumber()
+	return err
+}
+
+// Listener is an address DNS is served on.
+type Listener struct {
+	// Address is the host:port to listen on. A host name is resolved, and
+	// every address it has is listened on, so "localhost:53" serves both
+	// 127.0.0.1 and ::1 where localhost has both.
+	Address string `yaml:"address"`
+	// Protocol is "udp" or "tcp". If empty, both are served.
+	Protocol string `yaml:"protocol"`
+	// ACL, if set, is used for this listener instead of the top-level ACL.
+	ACL *ACL `yaml:"acl"`
+}
+
+// Protocols returns the protocols the listener serves.
+func (l *Listener) Protocols() []string {
+	if l.Protocol == "" {
+		return []string{ProtocolUDP, ProtocolTCP}
+	}
+
+	return []string{l.Protocol}
+}
+
+func (l *Listener) validateAndFix() error {
+	if _, _, err := net.SplitHostPort(l.Address); err != nil {
+		return errors.Wrapf(err, "invalid address %q", l.Address)
+	}
+
+	switch l.Protocol {
+	case "", ProtocolUDP, ProtocolTCP:
+	default:
+		return errors.Errorf("protocol must be %q or %q, not %q", ProtocolUDP, ProtocolTCP, l.Protocol)
+	}
+
+	if l.ACL != nil {
+		if err := l.ACL.validateAndFix(); err != nil {
+			return errors.Wrap(err, "in acl")
+		}
+	}
+
+	return nil
+}
+
+// Listeners are the addresses DNS is served on. Besides a list of listeners,
+// the configuration file can hold a single host:port, or a list of them,
+// which are served over both UDP and TCP.
+type Listeners []*Listener
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (l *Listeners) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = Listeners{{Address: value.Value}}
+		return nil
+	}
+
+	if value.Kind != yaml.SequenceNode {
+		return errors.Errorf("line %d: listen must be an address or a list of listeners", value.Line)
+	}
+
+	listeners := Listeners{}
+	for _, node := range value.Content {
+		listener := &Listener{}
+
+		if node.Kind == yaml.ScalarNode {
+			listener.Address = node.Value
+		} else if err := node.Decode(listener); err != nil {
+			return err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	*l = listeners
+	return nil
+}
+
+// ACL lists the networks (or addresses) clients may query from.
+type ACL struct {
+	// Allow, if set, denies every client outside these networks.
+	Allow []string `yaml:"allow"`
+	// Deny denies clients in these networks, even if they are allowed.
+	Deny []string `yaml:"deny"`
+	// Action is what denied queries get: "refuse" answers them with REFUSED,
+	// and "drop" sends nothing back.
+	Action string `yaml:"action"`
+}
+
+// AllowNetworks parses the allow list.
+func (a ACL) AllowNetworks() ([]*net.IPNet, error) {
+	return parseNetworks(a.Allow)
+}
+
+// DenyNetworks parses the deny list.
+func (a ACL) DenyNetworks() ([]*net.IPNet, error) {
+	return parseNetworks(a.Deny)
+}
+
+// Drop returns true if denied queries are dropped.
+func (a ACL) Drop() bool {
+	return a.Action == ACLDrop
+}
+
+func (a *ACL) validateAndFix() error {
+	if a.Action == "" {
+		a.Action = ACLRefuse
+	}
+
+	if a.Action != ACLRefuse && a.Action != ACLDrop {
+		return errors.Errorf("action must be %q or %q, not %q", ACLRefuse, ACLDrop, a.Action)
+	}
+
+	if _, err := a.AllowNetworks(); err != nil {
+		return errors.Wrap(err, "in allow list")
+	}
+
+	if _, err := a.DenyNetworks(); err != nil {
+		return errors.Wrap(err, "in deny list")
+	}
+
+	return nil
+}
+
+// UpdateKey is a TSIG key allowed to change records with DNS UPDATE.
+type UpdateKey struct {
+	Name string `yaml:"name"`
+	// Algorithm is hmac-sha256 unless set to hmac-sha1 or hmac-sha512. Updates
+	// signed with the key using another algorithm are refused.
+	Algorithm string `yaml:"algorithm"`
+	// Secret is the base64 encoded secret of the key.
+	Secret string `yaml:"secret"`
+	// Names restrict the hosts the key may change, relative to the domain:
+	// "laptop" is just that host, "*.dhcp" every host under dhcp, and "*"
+	// every host. If empty, the key may change any host.
+	Names []string `yaml:"names"`
+}
+
+func (k *UpdateKey) validateAndFix() error {
+	if k.Algorithm == "" {
+		k.Algorithm = defaultTSIGAlg
+	}
+
+	switch dns.Fqdn(strings.ToLower(k.Algorithm)) {
+	case dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+	default:
+		return errors.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+
+	if k.Secret == "" {
+		return errors.New("secret must be set")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+		return errors.Wrap(err, "secret is not base64")
+	}
+
+	for _, name := range k.Names {
+		if name == "*" {
+			continue
+		}
+
+		host := strings.TrimPrefix(name, "*.")
+		if err := dnsdb.ValidateHost(strings.ToLower(host)); err != nil {
+			return errors.Wrapf(err, "invalid name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// RateLimit configures response rate limiting.
+type RateLimit struct {
+	// ResponsesPerSecond is the rate of identical responses a client network
+	// may receive. NXDomainsPerSecond and ErrorsPerSecond, which default to
+	// it, are the rates of NXDOMAIN responses for the domain and of error
+	// responses. Each kind can be left unlimited with -1.
+	ResponsesPerSecond int `yaml:"responses_per_second"`
+	NXDomainsPerSecond int `yaml:"nxdomains_per_second"`
+	ErrorsPerSecond    int `yaml:"errors_per_second"`
+	// Slip makes every Slip-th limited response be sent back truncated, so
+	// real clients retry over TCP; the others are dropped. 0 drops them all.
+	Slip *int `yaml:"slip"`
+	// IPv4PrefixLength and IPv6PrefixLength size the client networks.
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+	// Exempt networks (or addresses) are never limited.
+	Exempt []string `yaml:"exempt"`
+}
+
+// ExemptNetworks parses the exempt list.
+func (r *RateLimit) ExemptNetworks() ([]*net.IPNet, error) {
+	return parseNetworks(r.Exempt)
+}
+
+func (r *RateLimit) validateAndFix() error {
+	if r.ResponsesPerSecond == 0 {
+		r.ResponsesPerSecond = defaultResponsesPerSecond
+	}
+
+	if r.NXDomainsPerSecond == 0 {
+		r.NXDomainsPerSecond = r.ResponsesPerSecond
+	}
+
+	if r.ErrorsPerSecond == 0 {
+		r.ErrorsPerSecond = r.ResponsesPerSecond
+	}
+
+	for _, rate := range []int{r.ResponsesPerSecond, r.NXDomainsPerSecond, r.ErrorsPerSecond} {
+		if rate < -1 {
+			return errors.Errorf("invalid rate %d", rate)
+		}
+	}
+
+	if r.Slip == nil {
+		slip := defaultSlip
+		r.Slip = &slip
+	}
+
+	if *r.Slip < 0 || *r.Slip > 10 {
+		return errors.Errorf("slip must be between 0 and 10, not %d", *r.Slip)
+	}
+
+	if r.IPv4PrefixLength == 0 {
+		r.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+
+	if r.IPv6PrefixLength == 0 {
+		r.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+
+	if r.IPv4PrefixLength < 1 || r.IPv4PrefixLength > 32 {
+		return errors.Errorf("invalid ipv4_prefix_length %d", r.IPv4PrefixLength)
+	}
+
+	if r.IPv6PrefixLength < 1 || r.IPv6PrefixLength > 128 {
+		return errors.Errorf("invalid ipv6_prefix_length %d", r.IPv6PrefixLength)
+	}
+
+	if _, err := r.ExemptNetworks(); err != nil {
+		return errors.Wrap(err, "in exempt list")
+	}
+
+	return nil
+}
+
+// DNSTap configures dnstap logging.
+type DNSTap struct {
+	// Socket is the unix socket of a dnstap collector; File is a file to
+	// write instead. Exactly one must be set.
+	Socket string `yaml:"socket"`
+	File   string `yaml:"file"`
+	// Identity is sent with every message; it defaults to the hostname.
+	Identity string `yaml:"identity"`
+	// QueueSize is the number of messages waiting to be written; more are
+	// dropped and counted.
+	QueueSize int `yaml:"queue_size"`
+}
+
+func (d *DNSTap) validateAndFix() error {
+	if (d.Socket == "") == (d.File == "") {
+		return errors.New("exactly one of socket and file must be set")
+	}
+
+	if d.Identity == "" {
+		d.Identity, _ = os.Hostname()
+	}
+
+	switch {
+	case d.QueueSize == 0:
+		d.QueueSize = defaultDNSTapQueueSize
+	case d.QueueSize < 0:
+		return errors.Errorf("invalid queue_size %d", d.QueueSize)
+	}
+
+	return nil
+}
+
+// View is a set of records served to the clients in its networks.
+type View struct {
+	Name string `yaml:"name"`
+	// Networks are the networks (or addresses) of the clients the view is
+	// served to. The EDNS Client Subnet of a query is matched instead of its
+	// source address when it is present.
+	Networks []string `yaml:"networks"`
+}
+
+// IPNets returns the parsed networks of the view.
+func (v *View) IPNets() ([]*net.IPNet, error) {
+	return parseNetworks(v.Networks)
+}
+
+// Webhook is a URL that changes are posted to.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Secret, if set, is used to sign each request with HMAC-SHA256.
+	Secret string `yaml:"secret"`
+}
+
+// Cluster configures this node's membership in a cluster.
+type Cluster struct {
+	// ID is the unique name of this node.
+	ID string `yaml:"id"`
+	// Listen is the host:port raft traffic is accepted on; it must be reachable
+	// by the other nodes.
+	Listen string `yaml:"listen"`
+	// Dir holds the raft log and snapshots.
+	Dir string `yaml:"dir"`
+	// Peers are the initial members of the cluster, including this node. Nodes
+	// added later with ldnsctl leave it empty.
+	Peers []*Peer `yaml:"peers"`
+}
+
+// Peer is a member of a cluster.
+type Peer struct {
+	ID      string `yaml:"id"`
+	Address string `yaml:"address"`
+}
+
+// Zone is a zone transferred from external primaries, like BIND.
+type Zone struct {
+	Name string `yaml:"name"`
+	// Primaries are tried in order, as host or host:port.
+	Primaries []string `yaml:"primaries"`
+}
+
+// PrimaryAddrs returns the primaries as host:port pairs; the port defaults to
+// 53.
+func (z *Zone) PrimaryAddrs() ([]string, error) {
+	return hostPorts(z.Primaries)
+}
+
+// Forward configures forwarding to upstream resolvers.
+type Forward struct {
+	// Upstreams, as host or host:port, answer queries for names outside the
+	// domain. If empty, only the zones are forwarded.
+	Upstreams []string `yaml:"upstreams"`
+	// Zones are forwarded to their own upstreams instead, even inside the
+	// domain.
+	Zones []*ForwardZone `yaml:"zones"`
+}
+
+// ForwardZone is a conditional forwarder: queries for names in the zone go to
+// its upstreams.
+type ForwardZone struct {
+	Name      string   `yaml:"name"`
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// UpstreamAddrs returns the upstreams as host:port pairs; the port defaults
+// to 53.
+func (f Forward) UpstreamAddrs() ([]string, error) {
+	return hostPorts(f.Upstreams)
+}
+
+// UpstreamAddrs returns the upstreams as host:port pairs; the port defaults
+// to 53.
+func (z *ForwardZone) UpstreamAddrs() ([]string, error) {
+	return hostPorts(z.Upstreams)
+}
+
+// Transfer configures outbound zone transfers.
+type Transfer struct {
+	// Allow is the list of networks (or addresses) permitted to transfer the
+	// zone. If empty, zone transfers are refused.
+	Allow []string `yaml:"allow"`
+	// Notify is the list of secondaries, as host or host:port, sent a NOTIFY
+	// when the zone changes.
+	Notify []string `yaml:"notify"`
+}
+
+// Networks parses the allow list.
+func (t Transfer) Networks() ([]*net.IPNet, error) {
+	return parseNetworks(t.Allow)
+}
+
+// NotifyTargets returns the notify list as host:port pairs; the port defaults
+// to 53.
+func (t Transfer) NotifyTargets() ([]string, error) {
+	return hostPorts(t.Notify)
+}
+
+// hostPorts adds the DNS port to any host that lacks one.
+func hostPorts(hosts []string) ([]string, error) {
+	ret := []string{}
+
+	for _, host := range hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "53")
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				return nil, errors.Wrapf(err, "invalid address %q", host)
+			}
+		}
+
+		ret = append(ret, host)
+	}
+
+	return ret, nil
+}
+
+// parseNetworks parses a list of CIDRs; bare addresses are treated as a
+// network of one.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	ret := []*net.IPNet{}
+
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %q", network)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", network)
+		}
+
+		ret = append(ret, ipnet)
+	}
+
+	return ret, nil
+}
+
+// Primary is the ldnsd a secondary follows.
+type Primary struct {
+	// Host is the host:port of the primary's GRPC listener.
+	Host string `yaml:"host"`
+	// Certificate is the client certificate used to authenticate to the primary.
+	Certificate Certificate `yaml:"certificate"`
 }
 
 // Empty is a config that has all the defaults configured; usually for testing.
@@ -63,14 +664,26 @@ func (c *Config) validateAndFix() error {
 		c.GRPCListen = DefaultGRPCListen
 	}
 
-	if c.DNSListen == "" {
-		c.DNSListen = DefaultDNSListen
+	if len(c.DNSListen) == 0 {
+		c.DNSListen = Listeners{{Address: DefaultDNSListen}}
 	}
 
 	if c.Domain == "" {
 		c.Domain = defaultDomain
 	}
 
+	if c.JournalSize == nil {
+		size := uint64(dnsdb.DefaultJournalSize)
+		c.JournalSize = &size
+	}
+
+	switch {
+	case c.HealthInterval == 0:
+		c.HealthInterval = defaultHealthInterval
+	case c.HealthInterval < 0:
+		return errors.Errorf("health_interval must be a positive number of seconds, not %d", c.HealthInterval)
+	}
+
 	if c.Certificate.CertFile == "" {
 		c.Certificate.CertFile = defaultCertFile
 	}
@@ -83,6 +696,298 @@ func (c *Config) validateAndFix() error {
 		c.Certificate.CAFile = defaultCAFile
 	}
 
+	if c.DoTListen != "" {
+		if _, _, err := net.SplitHostPort(c.DoTListen); err != nil {
+			return errors.Wrapf(err, "invalid dot_listen address %q", c.DoTListen)
+		}
+
+		if c.DoTCertificate == nil {
+			c.DoTCertificate = &Certificate{CertFile: c.Certificate.CertFile, KeyFile: c.Certificate.KeyFile}
+		}
+
+		if c.DoTCertificate.CertFile == "" || c.DoTCertificate.KeyFile == "" {
+			return errors.New("dot_certificate needs both a cert and a key")
+		}
+	}
+
+	if c.DoHListen != "" {
+		if _, _, err := net.SplitHostPort(c.DoHListen); err != nil {
+			return errors.Wrapf(err, "invalid doh_listen address %q", c.DoHListen)
+		}
+
+		if c.DoHCertificate == nil {
+			c.DoHCertificate = &Certificate{CertFile: c.Certificate.CertFile, KeyFile: c.Certificate.KeyFile}
+		}
+
+		if c.DoHCertificate.CertFile == "" || c.DoHCertificate.KeyFile == "" {
+			return errors.New("doh_certificate needs both a cert and a key")
+		}
+	}
+
+	if c.DoQListen != "" {
+		if _, _, err := net.SplitHostPort(c.DoQListen); err != nil {
+			return errors.Wrapf(err, "invalid doq_listen address %q", c.DoQListen)
+		}
+
+		if c.DoQCertificate == nil {
+			c.DoQCertificate = &Certificate{CertFile: c.Certificate.CertFile, KeyFile: c.Certificate.KeyFile}
+		}
+
+		if c.DoQCertificate.CertFile == "" || c.DoQCertificate.KeyFile == "" {
+			return errors.New("doq_certificate needs both a cert and a key")
+		}
+	}
+
+	if _, err := c.Transfer.Networks(); err != nil {
+		return errors.Wrap(err, "in transfer allow list")
+	}
+
+	if _, err := c.Transfer.NotifyTargets(); err != nil {
+		return errors.Wrap(err, "in transfer notify list")
+	}
+
+	if _, err := c.Forward.UpstreamAddrs(); err != nil {
+		return errors.Wrap(err, "in forward upstreams")
+	}
+
+	forwarded := map[string]struct{}{}
+	for i, z := range c.Forward.Zones {
+		if z == nil || strings.Trim(z.Name, ".") == "" {
+			return errors.Errorf("forwarded zone %d has no name", i)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(z.Name, "."))
+		if _, ok := forwarded[name]; ok {
+			return errors.Errorf("forwarded zone %q is declared more than once", z.Name)
+		}
+		forwarded[name] = struct{}{}
+
+		if len(z.Upstreams) == 0 {
+			return errors.Errorf("forwarded zone %q has no upstreams", z.Name)
+		}
+
+		if _, err := z.UpstreamAddrs(); err != nil {
+			return errors.Wrapf(err, "in upstreams of forwarded zone %q", z.Name)
+		}
+	}
+
+	if c.Primary != nil {
+		if c.Primary.Host == "" {
+			return errors.New("primary host must be set for secondaries")
+		}
+
+		if c.Primary.Certificate.CertFile == "" {
+			c.Primary.Certificate.CertFile = defaultClientCertFile
+		}
+
+		if c.Primary.Certificate.KeyFile == "" {
+			c.Primary.Certificate.KeyFile = defaultClientKeyFile
+		}
+
+		if c.Primary.Certificate.CAFile == "" {
+			c.Primary.Certificate.CAFile = c.Certificate.CAFile
+		}
+	}
+
+	if c.Cluster != nil {
+		if err := c.Cluster.validateAndFix(); err != nil {
+			return errors.Wrap(err, "in cluster configuration")
+		}
+
+		if c.Primary != nil {
+			return errors.New("a cluster node cannot also be a secondary")
+		}
+	}
+
+	if c.WebhookQueue == "" {
+		c.WebhookQueue = defaultWebhookQueue
+	}
+
+	if c.WebhookQueueSize <= 0 {
+		c.WebhookQueueSize = defaultWebhookQueueSize
+	}
+
+	urls := map[string]struct{}{}
+	for i, w := range c.Webhooks {
+		if w == nil || w.URL == "" {
+			return errors.Errorf("webhook %d has no url", i)
+		}
+
+		u, err := url.Parse(w.URL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid webhook url %q", w.URL)
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("webhook url %q must be an http or https url", w.URL)
+		}
+
+		if _, ok := urls[w.URL]; ok {
+			return errors.Errorf("webhook %q is declared more than once", w.URL)
+		}
+		urls[w.URL] = struct{}{}
+	}
+
+	zones := map[string]struct{}{}
+	for i, z := range c.Zones {
+		if z == nil || z.Name == "" {
+			return errors.Errorf("zone %d has no name", i)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(z.Name, "."))
+		if _, ok := zones[name]; ok {
+			return errors.Errorf("zone %q is declared more than once", z.Name)
+		}
+		zones[name] = struct{}{}
+
+		if len(z.Primaries) == 0 {
+			return errors.Errorf("zone %q has no primaries", z.Name)
+		}
+
+		if _, err := z.PrimaryAddrs(); err != nil {
+			return errors.Wrapf(err, "in primaries of zone %q", z.Name)
+		}
+	}
+
+	if err := c.ACL.validateAndFix(); err != nil {
+		return errors.Wrap(err, "in acl configuration")
+	}
+
+	for i, l := range c.DNSListen {
+		if l == nil {
+			return errors.Errorf("listener %d is empty", i)
+		}
+
+		if err := l.validateAndFix(); err != nil {
+			return errors.Wrapf(err, "in listener %q", l.Address)
+		}
+	}
+
+	keys := map[string]struct{}{}
+	for i, k := range c.UpdateKeys {
+		if k == nil || strings.Trim(k.Name, ".") == "" {
+			return errors.Errorf("update key %d has no name", i)
+		}
+
+		name := dns.Fqdn(strings.ToLower(k.Name))
+		if _, ok := keys[name]; ok {
+			return errors.Errorf("update key %q is declared more than once", k.Name)
+		}
+		keys[name] = struct{}{}
+
+		if err := k.validateAndFix(); err != nil {
+			return errors.Wrapf(err, "in update key %q", k.Name)
+		}
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validateAndFix(); err != nil {
+			return errors.Wrap(err, "in rate_limit configuration")
+		}
+	}
+
+	if c.DNSSEC != nil {
+		if err := c.DNSSEC.validateAndFix(); err != nil {
+			return errors.Wrap(err, "in dnssec configuration")
+		}
+	}
+
+	if c.DNSTap != nil {
+		if err := c.DNSTap.validateAndFix(); err != nil {
+			return errors.Wrap(err, "in dnstap configuration")
+		}
+	}
+
+	views := map[string]struct{}{}
+	for i, v := range c.Views {
+		if v == nil {
+			return errors.Errorf("view %d is empty", i)
+		}
+
+		if v.Name == "" {
+			return errors.Errorf("view %d has no name", i)
+		}
+
+		if err := dnsdb.ValidateView(v.Name); err != nil {
+			return err
+		}
+
+		if _, ok := views[v.Name]; ok {
+			return errors.Errorf("view %q is declared more than once", v.Name)
+		}
+		views[v.Name] = struct{}{}
+
+		if len(v.Networks) == 0 {
+			return errors.Errorf("view %q has no networks", v.Name)
+		}
+
+		if _, err := v.IPNets(); err != nil {
+			return errors.Wrapf(err, "in networks of view %q", v.Name)
+		}
+	}
+
+	seen := map[string]struct{}{}
+	for i, r := range c.Records {
+		if r == nil {
+			return errors.Errorf("static record %d is empty", i)
+		}
+
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "static record %q", r.Host)
+		}
+
+		if _, ok := views[r.View]; r.View != "" && !ok {
+			return errors.Errorf("static record %q is in view %q, which is not configured", r.Host, r.View)
+		}
+
+		name := r.View + "/" + r.Host
+		if _, ok := seen[name]; ok {
+			return errors.Errorf("static record %q is declared more than once", r.Host)
+		}
+
+		seen[name] = struct{}{}
+	}
+
+	return nil
+}
+
+func (c *Cluster) validateAndFix() error {
+	if c.ID == "" {
+		return errors.New("id must be set")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return errors.Wrapf(err, "invalid listen address %q", c.Listen)
+	}
+
+	if c.Dir == "" {
+		c.Dir = defaultClusterDir
+	}
+
+	if len(c.Peers) == 0 {
+		return nil
+	}
+
+	ids := map[string]struct{}{}
+	for i, p := range c.Peers {
+		if p == nil || p.ID == "" {
+			return errors.Errorf("peer %d has no id", i)
+		}
+
+		if _, ok := ids[p.ID]; ok {
+			return errors.Errorf("peer %q is declared more than once", p.ID)
+		}
+		ids[p.ID] = struct{}{}
+
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return errors.Wrapf(err, "invalid address %q for peer %q", p.Address, p.ID)
+		}
+	}
+
+	if _, ok := ids[c.ID]; !ok {
+		return errors.Errorf("peers must include this node (%q)", c.ID)
+	}
+
 	return nil
 }
 
@@ -97,3 +1002,14 @@ type Certificate struct {
 func (crt Certificate) NewCert() (*transport.Cert, error) {
 	return transport.LoadCert(crt.CAFile, crt.CertFile, crt.KeyFile, "")
 }
+
+// TLSConfig returns a TLS configuration for servers whose clients are not
+// authenticated, like DNS-over-TLS.
+func (crt Certificate) TLSConfig() (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(crt.CertFile, crt.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "while loading certificate")
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}, nil
+}
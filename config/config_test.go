@@ -1,8 +1,13 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"testing"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"gopkg.in/yaml.v3"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -39,3 +44,563 @@ func TestConfigDefaults(t *testing.T) {
 		}
 	})
 }
+
+func TestStaticRecords(t *testing.T) {
+	table := map[string]struct {
+		records []*dnsdb.Record
+		success bool
+	}{
+		"none": {
+			success: true,
+		},
+		"basic": {
+			records: []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.1"}, {Host: "ntp", Address: "10.0.0.2"}},
+			success: true,
+		},
+		"invalid address": {
+			records: []*dnsdb.Record{{Host: "gateway", Address: "fe80::1"}},
+			success: false,
+		},
+		"invalid host": {
+			records: []*dnsdb.Record{{Host: "", Address: "10.0.0.1"}},
+			success: false,
+		},
+		"duplicate": {
+			records: []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.1"}, {Host: "gateway", Address: "10.0.0.2"}},
+			success: false,
+		},
+	}
+
+	for testName, result := range table {
+		c := Empty()
+		c.Records = result.records
+		resultErr := c.validateAndFix()
+		if result.success && resultErr != nil {
+			t.Fatalf("Result for %q should be success but was %v", testName, resultErr)
+		}
+		if !result.success && resultErr == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", testName)
+		}
+	}
+}
+
+func TestPrimary(t *testing.T) {
+	c := Empty()
+	c.Primary = &Primary{}
+	if err := c.validateAndFix(); err == nil {
+		t.Fatal("primary without a host validated")
+	}
+
+	c.Primary.Host = "primary:7847"
+	if err := c.validateAndFix(); err != nil {
+		t.Fatalf("primary with a host did not validate: %v", err)
+	}
+
+	if c.Primary.Certificate.CertFile != defaultClientCertFile || c.Primary.Certificate.KeyFile != defaultClientKeyFile {
+		t.Fatal("primary certificate did not default to the client certificate")
+	}
+
+	if c.Primary.Certificate.CAFile != c.Certificate.CAFile {
+		t.Fatal("primary CA did not default to the server CA")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	peers := []*Peer{{ID: "one", Address: "10.0.0.1:7946"}, {ID: "two", Address: "10.0.0.2:7946"}}
+
+	table := map[string]struct {
+		cluster *Cluster
+		success bool
+	}{
+		"basic": {
+			cluster: &Cluster{ID: "one", Listen: "10.0.0.1:7946", Peers: peers},
+			success: true,
+		},
+		"joining": {
+			cluster: &Cluster{ID: "three", Listen: "10.0.0.3:7946"},
+			success: true,
+		},
+		"no id": {
+			cluster: &Cluster{Listen: "10.0.0.1:7946", Peers: peers},
+			success: false,
+		},
+		"invalid listen": {
+			cluster: &Cluster{ID: "one", Listen: "10.0.0.1", Peers: peers},
+			success: false,
+		},
+		"not a peer": {
+			cluster: &Cluster{ID: "three", Listen: "10.0.0.3:7946", Peers: peers},
+			success: false,
+		},
+		"duplicate peer": {
+			cluster: &Cluster{ID: "one", Listen: "10.0.0.1:7946", Peers: append(peers, peers[0])},
+			success: false,
+		},
+	}
+
+	for testName, result := range table {
+		c := Empty()
+		c.Cluster = result.cluster
+		resultErr := c.validateAndFix()
+		if result.success && resultErr != nil {
+			t.Fatalf("Result for %q should be success but was %v", testName, resultErr)
+		}
+		if !result.success && resultErr == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", testName)
+		}
+		if result.success && c.Cluster.Dir != defaultClusterDir {
+			t.Fatalf("Result for %q: directory did not default", testName)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	table := map[string]struct {
+		webhooks []*Webhook
+		success  bool
+	}{
+		"basic": {
+			webhooks: []*Webhook{{URL: "https://inventory.example.com/dns", Secret: "secret"}, {URL: "http://10.0.0.1:8080/"}},
+			success:  true,
+		},
+		"no url": {
+			webhooks: []*Webhook{{Secret: "secret"}},
+			success:  false,
+		},
+		"not http": {
+			webhooks: []*Webhook{{URL: "ftp://example.com/"}},
+			success:  false,
+		},
+		"duplicate": {
+			webhooks: []*Webhook{{URL: "http://10.0.0.1/"}, {URL: "http://10.0.0.1/"}},
+			success:  false,
+		},
+	}
+
+	for testName, result := range table {
+		c := Empty()
+		c.Webhooks = result.webhooks
+		resultErr := c.validateAndFix()
+		if result.success && resultErr != nil {
+			t.Fatalf("Result for %q should be success but was %v", testName, resultErr)
+		}
+		if !result.success && resultErr == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", testName)
+		}
+	}
+
+	c := Empty()
+	if c.WebhookQueue != defaultWebhookQueue || c.WebhookQueueSize != defaultWebhookQueueSize {
+		t.Fatal("webhook queue did not default")
+	}
+}
+
+func TestDoT(t *testing.T) {
+	c := Empty()
+	c.DoTListen = "0.0.0.0:853"
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DoTCertificate == nil || c.DoTCertificate.CertFile != c.Certificate.CertFile || c.DoTCertificate.KeyFile != c.Certificate.KeyFile {
+		t.Fatal("dns-over-tls certificate did not default to the server certificate")
+	}
+
+	c = Empty()
+	c.DoTListen = "0.0.0.0"
+	if err := c.validateAndFix(); err == nil {
+		t.Fatal("dot_listen without a port validated")
+	}
+
+	c = Empty()
+	c.DoTListen = "0.0.0.0:853"
+	c.DoTCertificate = &Certificate{CertFile: "/etc/ldnsd/dot.pem"}
+	if err := c.validateAndFix(); err == nil {
+		t.Fatal("dns-over-tls certificate without a key validated")
+	}
+}
+
+func TestViews(t *testing.T) {
+	table := map[string]struct {
+		views   []*View
+		records []*dnsdb.Record
+		success bool
+	}{
+		"basic": {
+			views:   []*View{{Name: "vpn", Networks: []string{"10.8.0.0/16", "10.9.0.1"}}},
+			records: []*dnsdb.Record{{Host: "gw", Address: "10.0.0.1"}, {Host: "gw", View: "vpn", Address: "10.8.0.1"}},
+			success: true,
+		},
+		"no name": {
+			views:   []*View{{Networks: []string{"10.8.0.0/16"}}},
+			success: false,
+		},
+		"bad name": {
+			views:   []*View{{Name: "VPN!", Networks: []string{"10.8.0.0/16"}}},
+			success: false,
+		},
+		"no networks": {
+			views:   []*View{{Name: "vpn"}},
+			success: false,
+		},
+		"bad network": {
+			views:   []*View{{Name: "vpn", Networks: []string{"10.8.0.0/33"}}},
+			success: false,
+		},
+		"duplicate": {
+			views:   []*View{{Name: "vpn", Networks: []string{"10.8.0.0/16"}}, {Name: "vpn", Networks: []string{"10.9.0.0/16"}}},
+			success: false,
+		},
+		"record in unknown view": {
+			records: []*dnsdb.Record{{Host: "gw", View: "vpn", Address: "10.8.0.1"}},
+			success: false,
+		},
+	}
+
+	for testName, result := range table {
+		c := Empty()
+		c.Views = result.views
+		c.Records = result.records
+		resultErr := c.validateAndFix()
+		if result.success && resultErr != nil {
+			t.Fatalf("Result for %q should be success but was %v", testName, resultErr)
+		}
+		if !result.success && resultErr == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", testName)
+		}
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	c := Empty()
+	c.DNSSEC = &DNSSEC{}
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DNSSEC.KeyFile != defaultDNSSECKey || c.DNSSEC.PrivateKeyFile != defaultDNSSECPrivate || c.DNSSEC.Algorithm != defaultDNSSECAlg {
+		t.Fatalf("dnssec defaults were not set: %+v", c.DNSSEC)
+	}
+
+	table := map[string]bool{
+		"ED25519":         true,
+		"rsasha256":       true,
+		"ECDSAP384SHA384": true,
+		"RSAMD5":          false,
+		"DSA":             false,
+		"bogus":           false,
+	}
+
+	for alg, result := range table {
+		c := Empty()
+		c.DNSSEC = &DNSSEC{Algorithm: alg}
+		err := c.validateAndFix()
+		if result && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", alg, err)
+		} else if !result && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", alg)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	table := map[string]struct {
+		forward Forward
+		success bool
+	}{
+		"upstreams": {
+			forward: Forward{Upstreams: []string{"1.1.1.1", "[2606:4700:4700::1111]:53"}},
+			success: true,
+		},
+		"zones only": {
+			forward: Forward{Zones: []*ForwardZone{{Name: "corp.example.com", Upstreams: []string{"10.0.0.2"}}}},
+			success: true,
+		},
+		"invalid upstream": {
+			forward: Forward{Upstreams: []string{"[::1"}},
+		},
+		"zone without upstreams": {
+			forward: Forward{Zones: []*ForwardZone{{Name: "corp.example.com"}}},
+		},
+		"zone without a name": {
+			forward: Forward{Zones: []*ForwardZone{{Name: ".", Upstreams: []string{"10.0.0.2"}}}},
+		},
+		"duplicate zone": {
+			forward: Forward{Zones: []*ForwardZone{
+				{Name: "corp.example.com", Upstreams: []string{"10.0.0.2"}},
+				{Name: "Corp.Example.com.", Upstreams: []string{"10.0.0.3"}},
+			}},
+		},
+	}
+
+	for name, result := range table {
+		c := Empty()
+		c.Forward = result.forward
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := Empty()
+	c.RateLimit = &RateLimit{ResponsesPerSecond: 10}
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := c.RateLimit
+	if r.NXDomainsPerSecond != 10 || r.ErrorsPerSecond != 10 || *r.Slip != defaultSlip || r.IPv4PrefixLength != defaultIPv4PrefixLength || r.IPv6PrefixLength != defaultIPv6PrefixLength {
+		t.Fatalf("rate limit defaults were not set: %+v", r)
+	}
+
+	zero := 0
+	eleven := 11
+
+	table := map[string]struct {
+		rateLimit RateLimit
+		success   bool
+	}{
+		"defaults":            {rateLimit: RateLimit{}, success: true},
+		"never slip":          {rateLimit: RateLimit{Slip: &zero}, success: true},
+		"unlimited errors":    {rateLimit: RateLimit{ErrorsPerSecond: -1}, success: true},
+		"exempt":              {rateLimit: RateLimit{Exempt: []string{"10.0.0.0/8", "::1"}}, success: true},
+		"negative rate":       {rateLimit: RateLimit{ResponsesPerSecond: -2}},
+		"slip too large":      {rateLimit: RateLimit{Slip: &eleven}},
+		"ipv4 prefix too big": {rateLimit: RateLimit{IPv4PrefixLength: 33}},
+		"ipv6 prefix too big": {rateLimit: RateLimit{IPv6PrefixLength: 129}},
+		"invalid exempt":      {rateLimit: RateLimit{Exempt: []string{"10.0.0.0/33"}}},
+	}
+
+	for name, result := range table {
+		c := Empty()
+		rateLimit := result.rateLimit
+		c.RateLimit = &rateLimit
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	c := Empty()
+	if c.ACL.Action != ACLRefuse || c.ACL.Drop() {
+		t.Fatalf("acl action did not default to refuse: %q", c.ACL.Action)
+	}
+
+	table := map[string]struct {
+		acl     ACL
+		success bool
+	}{
+		"allow and deny": {acl: ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.1.0/24", "::1"}}, success: true},
+		"drop":           {acl: ACL{Deny: []string{"192.0.2.1"}, Action: ACLDrop}, success: true},
+		"invalid action": {acl: ACL{Action: "ignore"}},
+		"invalid allow":  {acl: ACL{Allow: []string{"10.0.0.0/33"}}},
+		"invalid deny":   {acl: ACL{Deny: []string{"not an address"}}},
+	}
+
+	for name, result := range table {
+		c := Empty()
+		c.ACL = result.acl
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+	c := Empty()
+	c.UpdateKeys = []*UpdateKey{{Name: "dhcp", Secret: "c2VjcmV0"}}
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.UpdateKeys[0].Algorithm != defaultTSIGAlg {
+		t.Fatalf("algorithm did not default to %s: %q", defaultTSIGAlg, c.UpdateKeys[0].Algorithm)
+	}
+
+	table := map[string]struct {
+		keys    []*UpdateKey
+		success bool
+	}{
+		"names": {
+			keys:    []*UpdateKey{{Name: "dhcp.", Algorithm: "HMAC-SHA512", Secret: "c2VjcmV0", Names: []string{"laptop", "*.dhcp", "*"}}},
+			success: true,
+		},
+		"no name":           {keys: []*UpdateKey{{Secret: "c2VjcmV0"}}},
+		"no secret":         {keys: []*UpdateKey{{Name: "dhcp"}}},
+		"invalid secret":    {keys: []*UpdateKey{{Name: "dhcp", Secret: "not base64!"}}},
+		"invalid algorithm": {keys: []*UpdateKey{{Name: "dhcp", Algorithm: "hmac-md5", Secret: "c2VjcmV0"}}},
+		"invalid name":      {keys: []*UpdateKey{{Name: "dhcp", Secret: "c2VjcmV0", Names: []string{"_acme-challenge"}}}},
+		"duplicate key": {
+			keys: []*UpdateKey{{Name: "dhcp", Secret: "c2VjcmV0"}, {Name: "DHCP.", Secret: "c2VjcmV0"}},
+		},
+	}
+
+	for name, result := range table {
+		c := Empty()
+		c.UpdateKeys = result.keys
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	table := map[string]struct {
+		yaml      string
+		listeners Listeners
+		success   bool
+	}{
+		"default": {
+			listeners: Listeners{{Address: DefaultDNSListen}},
+			success:   true,
+		},
+		"address": {
+			yaml:      `listen: "127.0.0.1:53"`,
+			listeners: Listeners{{Address: "127.0.0.1:53"}},
+			success:   true,
+		},
+		"list of addresses": {
+			yaml:      "listen:\n  - \"127.0.0.1:53\"\n  - \"[::1]:53\"",
+			listeners: Listeners{{Address: "127.0.0.1:53"}, {Address: "[::1]:53"}},
+			success:   true,
+		},
+		"listeners": {
+			yaml: "listen:\n  - address: \"10.0.0.1:53\"\n    protocol: udp\n    acl:\n      allow:\n        - \"10.0.0.0/8\"\n  - \"127.0.0.1:53\"",
+			listeners: Listeners{
+				{Address: "10.0.0.1:53", Protocol: ProtocolUDP, ACL: &ACL{Allow: []string{"10.0.0.0/8"}, Action: ACLRefuse}},
+				{Address: "127.0.0.1:53"},
+			},
+			success: true,
+		},
+		"no port":          {yaml: `listen: "127.0.0.1"`},
+		"invalid protocol": {yaml: "listen:\n  - address: \"127.0.0.1:53\"\n    protocol: sctp"},
+		"invalid acl":      {yaml: "listen:\n  - address: \"127.0.0.1:53\"\n    acl:\n      deny:\n        - bogus"},
+		"mapping":          {yaml: "listen:\n  address: \"127.0.0.1:53\""},
+	}
+
+	for name, result := range table {
+		f, err := ioutil.TempFile("", "ldnsd-config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		if _, err := f.WriteString(result.yaml + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		c, err := Parse(f.Name())
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+
+		if result.success && !reflect.DeepEqual(c.DNSListen, result.listeners) {
+			t.Fatalf("Result for %q should be %v but was %v", name, result.listeners, c.DNSListen)
+		}
+	}
+
+	l := &Listener{Address: "127.0.0.1:53"}
+	if !reflect.DeepEqual(l.Protocols(), []string{ProtocolUDP, ProtocolTCP}) {
+		t.Fatalf("listener without a protocol serves %v", l.Protocols())
+	}
+}
+
+func TestHealthInterval(t *testing.T) {
+	table := map[int]struct {
+		interval int
+		success  bool
+	}{
+		0:  {interval: defaultHealthInterval, success: true},
+		1:  {interval: 1, success: true},
+		-1: {success: false},
+	}
+
+	for interval, result := range table {
+		c := &Config{HealthInterval: interval}
+
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %d should be success but was %v", interval, err)
+		}
+		if !result.success && err == nil {
+			t.Fatalf("Result for %d should NOT be success but was.", interval)
+		}
+
+		if result.success && c.HealthInterval != result.interval {
+			t.Fatalf("Result for %d should be an interval of %d but was %d", interval, result.interval, c.HealthInterval)
+		}
+	}
+}
+
+func TestDNSTap(t *testing.T) {
+	c := Empty()
+	c.DNSTap = &DNSTap{Socket: "/run/dnstap.sock"}
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DNSTap.QueueSize != defaultDNSTapQueueSize || c.DNSTap.Identity == "" {
+		t.Fatalf("dnstap defaults were not set: %+v", c.DNSTap)
+	}
+
+	table := map[string]struct {
+		dnstap  DNSTap
+		success bool
+	}{
+		"socket":         {dnstap: DNSTap{Socket: "/run/dnstap.sock"}, success: true},
+		"file":           {dnstap: DNSTap{File: "/var/log/ldnsd.dnstap", Identity: "ns1", QueueSize: 100}, success: true},
+		"neither":        {dnstap: DNSTap{}},
+		"both":           {dnstap: DNSTap{Socket: "/run/dnstap.sock", File: "/var/log/ldnsd.dnstap"}},
+		"negative queue": {dnstap: DNSTap{Socket: "/run/dnstap.sock", QueueSize: -1}},
+	}
+
+	for name, result := range table {
+		c := Empty()
+		dnstap := result.dnstap
+		c.DNSTap = &dnstap
+		err := c.validateAndFix()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
+
+func TestJournalSize(t *testing.T) {
+	c := Empty()
+	if *c.JournalSize != dnsdb.DefaultJournalSize {
+		t.Fatalf("journal size did not default to %d: %d", dnsdb.DefaultJournalSize, *c.JournalSize)
+	}
+
+	// 0 keeps every change, so it is not replaced with the default.
+	c = &Config{}
+	if err := yaml.Unmarshal([]byte("journal_size: 0\n"), c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.validateAndFix(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *c.JournalSize != 0 {
+		t.Fatalf("journal size of 0 was replaced with %d", *c.JournalSize)
+	}
+}
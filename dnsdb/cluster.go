@@ -0,0 +1,110 @@
+package dnsdb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// ClusterState records the last command committed from a cluster's log. It is
+// written in the same transaction as the command, so commands replayed after a
+// restart are not applied twice.
+type ClusterState struct {
+	ID           uint `gorm:"primary_key"`
+	AppliedIndex uint64
+}
+
+const clusterStateID = 1
+
+// AppliedIndex returns the index of the last command committed.
+func (db *DB) AppliedIndex() (uint64, error) {
+	return appliedIndex(db.db)
+}
+
+func appliedIndex(tx *gorm.DB) (uint64, error) {
+	state := &ClusterState{}
+	err := tx.First(state, clusterStateID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "while reading cluster state")
+	}
+
+	return state.AppliedIndex, nil
+}
+
+func setAppliedIndex(tx *gorm.DB, index uint64) error {
+	if err := tx.Save(&ClusterState{ID: clusterStateID, AppliedIndex: index}).Error; err != nil {
+		return errors.Wrap(err, "while writing cluster state")
+	}
+
+	return nil
+}
+
+// Commit runs a command taken from the log at index, ignoring static records
+// and read-only mode. Commands at or below the applied index have already
+// been committed and are skipped. A command that fails is not recorded as
+// applied; it will fail the same way if it is replayed.
+func (db *DB) Commit(index uint64, c *Command) error {
+	return db.write(func(tx *gorm.DB, record recordFunc) error {
+		applied, err := appliedIndex(tx)
+		if err != nil {
+			return err
+		}
+
+		if index <= applied {
+			return nil
+		}
+
+		if err := c.run(tx, record); err != nil {
+			return err
+		}
+
+		return setAppliedIndex(tx, index)
+	})
+}
+
+// ClusterSnapshot returns the records in the table, without static records,
+// and the applied index they reflect.
+func (db *DB) ClusterSnapshot() ([]*Record, uint64, error) {
+	var (
+		records = []*Record{}
+		applied uint64
+	)
+
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if applied, err = appliedIndex(tx); err != nil {
+			return err
+		}
+
+		if err := tx.Find(&records).Error; err != nil {
+			return errors.Wrap(err, "while reading records")
+		}
+
+		return nil
+	})
+
+	return records, applied, err
+}
+
+// Restore replaces the records with a snapshot taken at index, unless
+// commands past the snapshot have already been committed.
+func (db *DB) Restore(index uint64, records []*Record) error {
+	return db.write(func(tx *gorm.DB, record recordFunc) error {
+		applied, err := appliedIndex(tx)
+		if err != nil {
+			return err
+		}
+
+		if index <= applied {
+			return nil
+		}
+
+		if err := syncRecords(tx, records, record); err != nil {
+			return err
+		}
+
+		return setAppliedIndex(tx, index)
+	})
+}
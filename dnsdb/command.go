@@ -0,0 +1,137 @@
+package dnsdb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// OpCreate creates records, failing if any of them exist.
+	OpCreate = "create"
+	// OpDelete deletes records.
+	OpDelete = "delete"
+	// OpApply deletes and then sets records, like Apply.
+	OpApply = "apply"
+)
+
+// Command is a mutation of the records table. Commands are what a Proposer
+// replicates, so running the same commands in the same order always produces
+// the same records and events.
+type Command struct {
+	Op      string    `json:"op"`
+	Records []*Record `json:"records,omitempty"`
+	// Delete holds the hosts to delete from the default view. It is kept in
+	// the form it had before views, so commands already in a log, or from
+	// nodes that have not been upgraded, still apply.
+	Delete []string `json:"delete,omitempty"`
+	// DeleteRecords holds the records to delete from other views; only their
+	// hosts and views are used.
+	DeleteRecords []*Record `json:"delete_records,omitempty"`
+}
+
+// newCommand creates a command deleting del, then writing records.
+func newCommand(op string, records []*Record, del []*Record) *Command {
+	c := &Command{Op: op, Records: records}
+
+	for _, r := range del {
+		if r.View == "" {
+			c.Delete = append(c.Delete, r.Host)
+		} else {
+			c.DeleteRecords = append(c.DeleteRecords, r)
+		}
+	}
+
+	return c
+}
+
+// deletes returns all the records the command deletes.
+func (c *Command) deletes() []*Record {
+	del := []*Record{}
+	for _, host := range c.Delete {
+		del = append(del, &Record{Host: host})
+	}
+
+	return append(del, c.DeleteRecords...)
+}
+
+// Proposer replicates commands before they are applied. When one is set, the
+// mutations of the DB are handed to it instead of being written directly; it
+// is expected to call Commit on every member of the cluster, this one
+// included.
+type Proposer interface {
+	Propose(c *Command) error
+}
+
+// SetProposer sends all further mutations through p.
+func (db *DB) SetProposer(p Proposer) {
+	db.configMutex.Lock()
+	db.proposer = p
+	db.configMutex.Unlock()
+}
+
+// mutate proposes the command if there is a proposer, and writes it
+// otherwise.
+func (db *DB) mutate(c *Command) error {
+	db.configMutex.RLock()
+	p := db.proposer
+	db.configMutex.RUnlock()
+
+	if p != nil {
+		return p.Propose(c)
+	}
+
+	return db.write(c.run)
+}
+
+func (c *Command) validate() error {
+	for _, r := range c.deletes() {
+		if err := r.validateHost(); err != nil {
+			return errors.Wrapf(err, "during validation of hostname %q", r.Host)
+		}
+	}
+
+	for _, r := range c.Records {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "during validation of record %q", r.Host)
+		}
+	}
+
+	return nil
+}
+
+func (c *Command) run(tx *gorm.DB, record recordFunc) error {
+	switch c.Op {
+	case OpCreate, OpDelete, OpApply:
+	default:
+		return errors.Errorf("unknown operation %q", c.Op)
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	for _, r := range c.deletes() {
+		if err := remove(tx, r, record); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range c.Records {
+		if c.Op != OpCreate {
+			if err := set(tx, r, record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := tx.Create(r).Error; err != nil {
+			return err
+		}
+
+		if err := record(EventSet, r, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package dnsdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandEncoding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.SetViews([]string{"vpn"})
+
+	for _, r := range []*Record{
+		{Host: "old", Address: "10.0.0.1"},
+		{Host: "gw", Address: "10.0.0.2"},
+		{Host: "gw", View: "vpn", Address: "10.8.0.1"},
+	} {
+		if err := db.SetRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a delete from before views, as it is in older logs.
+	var commands []string
+	commands = append(commands, `{"op":"delete","delete":["old"]}`)
+
+	// deletes from the default view keep that form; other views have their
+	// own field.
+	b, err := json.Marshal(newCommand(OpDelete, nil, []*Record{{Host: "gw", View: "vpn"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands = append(commands, string(b))
+
+	if expected := `{"op":"delete","delete_records":[`; string(b)[:len(expected)] != expected {
+		t.Fatalf("unexpected encoding: %s", b)
+	}
+
+	for i, command := range commands {
+		c := &Command{}
+		if err := json.Unmarshal([]byte(command), c); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Commit(uint64(i+1), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := map[string]struct {
+		view   string
+		exists bool
+	}{
+		"old": {exists: false},
+		"gw":  {exists: true},
+	}
+
+	for host, result := range table {
+		_, err := db.LookupRecord(result.view, host)
+		if result.exists && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", host, err)
+		} else if !result.exists && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", host)
+		}
+	}
+
+	if r, err := db.LookupRecord("vpn", "gw"); err == nil && r.View == "vpn" {
+		t.Fatalf("record in view was not deleted: %+v", r)
+	}
+
+	b, err = json.Marshal(newCommand(OpDelete, nil, []*Record{{Host: "gw"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"op":"delete","delete":["gw"]}` {
+		t.Fatalf("unexpected encoding: %s", b)
+	}
+}
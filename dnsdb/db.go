@@ -3,7 +3,9 @@ package dnsdb
 import (
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	dnsserverDB "github.com/erikh/dnsserver/db"
 	"github.com/jinzhu/gorm"
@@ -17,25 +19,168 @@ var hostMatch = regexp.MustCompile(`^[a-z][0-9a-z-]{0,62}$`)
 var (
 	// ErrNotSupported is for when something is not supported by this interface
 	ErrNotSupported = errors.New("not supported")
+	// ErrStatic is for when a mutation targets a record declared in the
+	// configuration file.
+	ErrStatic = errors.New("record is static and cannot be modified")
+	// ErrReadOnly is for when a mutation is attempted on a secondary.
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrCompacted is for when events are requested from a revision that is no
+	// longer in the journal.
+	ErrCompacted = errors.New("revision has been compacted out of the journal")
+	// ErrUnknownView is for when a mutation targets a view that is not
+	// configured.
+	ErrUnknownView = errors.New("view is not configured")
 )
 
+// key identifies a record: a host in a view.
+type key struct {
+	view string
+	host string
+}
+
 // DB is the outer shell for the gorm DB handle.
 type DB struct {
-	db *gorm.DB
+	db          *gorm.DB
+	writeMutex  sync.Mutex
+	journalSize uint64
+
+	configMutex sync.RWMutex
+	static      map[key]*Record
+	views       map[string]struct{}
+	primary     string
+	domain      string
+	transferred []string
+	proposer    Proposer
+
+	subscriberMutex sync.Mutex
+	subscribers     map[chan *Event]struct{}
+	watchersClosed  bool
 }
 
 // New opens the DB
-func New(dbfile string) (dnsserverDB.DB, error) {
+func New(dbfile string) (*DB, error) {
 	db, err := gorm.Open("sqlite3", dbfile)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not connect to db")
 	}
 
-	if err := db.AutoMigrate(&Record{}).Error; err != nil {
+	if err := migrateViews(db); err != nil {
+		return nil, err
+	}
+
+	if err := db.AutoMigrate(&Record{}, &Event{}, &ClusterState{}).Error; err != nil {
 		return nil, errors.Wrap(err, "while migrating database")
 	}
 
-	return &DB{db: db}, nil
+	return &DB{
+		db:          db,
+		static:      map[key]*Record{},
+		subscribers: map[chan *Event]struct{}{},
+	}, nil
+}
+
+// SetStatic replaces the static records. Static records are never written to
+// the database; they are overlaid on top of it, take precedence over records
+// in the database with the same host, and cannot be modified or deleted.
+func (db *DB) SetStatic(records []*Record) error {
+	static := map[key]*Record{}
+
+	for _, r := range records {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "during validation of static record %q", r.Host)
+		}
+
+		r := *r
+		static[key{r.View, r.Host}] = &r
+	}
+
+	db.configMutex.Lock()
+	db.static = static
+	db.configMutex.Unlock()
+
+	return nil
+}
+
+// IsStatic returns true if the host is a static record in the view.
+func (db *DB) IsStatic(view, host string) bool {
+	db.configMutex.RLock()
+	defer db.configMutex.RUnlock()
+
+	_, ok := db.static[key{view, host}]
+	return ok
+}
+
+// SetViews sets the names of the views records may be written to, besides
+// the default view.
+func (db *DB) SetViews(names []string) {
+	views := map[string]struct{}{}
+	for _, name := range names {
+		views[name] = struct{}{}
+	}
+
+	db.configMutex.Lock()
+	db.views = views
+	db.configMutex.Unlock()
+}
+
+// SetReadOnly rejects all mutations except replication from the primary,
+// whose address is included in the error so clients know where to go.
+func (db *DB) SetReadOnly(primary string) {
+	db.configMutex.Lock()
+	db.primary = primary
+	db.configMutex.Unlock()
+}
+
+// SetTransferred marks zones transferred from external primaries as
+// read-only. Hosts in domain that fall inside one of the zones, which are
+// fully qualified, cannot be modified.
+func (db *DB) SetTransferred(domain string, zones []string) {
+	db.configMutex.Lock()
+	db.domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	db.transferred = zones
+	db.configMutex.Unlock()
+}
+
+// transferredZone returns the transferred zone host falls in, if any.
+func (db *DB) transferredZone(host string) string {
+	db.configMutex.RLock()
+	defer db.configMutex.RUnlock()
+
+	name := strings.ToLower(host) + "." + db.domain + "."
+	for _, zone := range db.transferred {
+		zone = strings.ToLower(zone)
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return zone
+		}
+	}
+
+	return ""
+}
+
+// checkWritable returns an error if the host may not be modified in the view.
+func (db *DB) checkWritable(view, host string) error {
+	db.configMutex.RLock()
+	primary := db.primary
+	_, known := db.views[view]
+	db.configMutex.RUnlock()
+
+	if primary != "" {
+		return errors.Wrapf(ErrReadOnly, "this server is a secondary; make changes on the primary at %s", primary)
+	}
+
+	if zone := db.transferredZone(host); zone != "" {
+		return errors.Wrapf(ErrReadOnly, "%q is in zone %s, which is transferred from an external primary", host, zone)
+	}
+
+	if view != "" && !known {
+		return errors.Wrapf(ErrUnknownView, "%q", view)
+	}
+
+	if db.IsStatic(view, host) {
+		return errors.Wrapf(ErrStatic, "%q is declared in the configuration file", host)
+	}
+
+	return nil
 }
 
 // Close the database
@@ -45,34 +190,96 @@ func (db *DB) Close() error {
 
 // Record is the notion of an A record in the database.
 type Record struct {
-	Host    string `gorm:"primary_key"`
-	Address string
+	Host string `gorm:"primary_key" yaml:"host"`
+	// View is the view the record is served in. Records in the default view,
+	// which has no name, are served to everyone, unless the view a client is
+	// in has a record for the same host.
+	View string `gorm:"primary_key;not null;default:''" yaml:"view,omitempty"`
+	// Address is the address of the host, or several separated by commas,
+	// which are all served.
+	Address string `yaml:"address"`
+	// Check, if set, is the health check of the addresses; see ParseCheck.
+	// Addresses that fail it are left out of answers, unless all of them do.
+	Check string `gorm:"not null;default:''" yaml:"check,omitempty"`
+	// Policy, if set, is how the addresses are chosen; see ParsePolicy. By
+	// default every address is served, in random order.
+	Policy string `gorm:"not null;default:''" yaml:"policy,omitempty"`
+}
+
+// same returns true if the records serve the same addresses the same way.
+func (r *Record) same(other *Record) bool {
+	return r.Address == other.Address && r.Check == other.Check && r.Policy == other.Policy
 }
 
 // Validate ensures the record is safe to insert.
 func (r *Record) Validate() error {
-	ip := net.ParseIP(r.Address)
-	if len(ip) == 0 {
-		return errors.New("IP address did not parse")
+	seen := map[string]struct{}{}
+
+	for _, addr := range strings.Split(r.Address, ",") {
+		ip := net.ParseIP(addr)
+		if len(ip) == 0 {
+			return errors.New("IP address did not parse")
+		}
+
+		if !ip.To4().Equal(ip) {
+			return errors.New("IP is not IPv4. ldnsd does not support IPv6 yet")
+		}
+
+		if _, ok := seen[ip.String()]; ok {
+			return errors.Errorf("address %s is listed more than once", addr)
+		}
+		seen[ip.String()] = struct{}{}
+	}
+
+	if r.Check != "" {
+		if _, err := ParseCheck(r.Check); err != nil {
+			return err
+		}
 	}
 
-	if !ip.To4().Equal(ip) {
-		return errors.New("IP is not IPv4. ldnsd does not support IPv6 yet")
+	if r.Policy != "" {
+		p, err := ParsePolicy(r.Policy)
+		if err != nil {
+			return err
+		}
+
+		if p.Type == PolicyWeighted && len(p.Weights) != len(seen) {
+			return errors.Errorf("policy %q has %d weights for %d addresses", r.Policy, len(p.Weights), len(seen))
+		}
 	}
 
 	return r.validateHost()
 }
 
+// ValidateView ensures the name of a view is safe to use. The empty name of
+// the default view is valid.
+func ValidateView(name string) error {
+	if name != "" && !hostMatch.MatchString(name) {
+		return errors.Errorf("invalid view name %q", name)
+	}
+
+	return nil
+}
+
 func (r *Record) validateHost() error {
-	if len(r.Host) == 0 {
+	if err := ValidateView(r.View); err != nil {
+		return err
+	}
+
+	return ValidateHost(r.Host)
+}
+
+// ValidateHost ensures the name of a host is safe to use.
+func ValidateHost(host string) error {
+	if len(host) == 0 {
 		return errors.New("name is 0 length")
 	}
 
-	if len(r.Host) > 255 {
+	if len(host) > 255 {
 		return errors.New("name is longer than 255 characters")
 	}
 
-	for _, name := range strings.Split(r.Host, ".") {
+	for _, name := range strings.Split(host, ".") {
 		if !hostMatch.MatchString(name) {
 			return errors.New("names in DNS must be 63 characters or less, per part")
 		}
@@ -81,59 +288,310 @@ func (r *Record) validateHost() error {
 	return nil
 }
 
-// IP returns the parsed IP address of the record in IPv4 32-bit format.
+// IP returns the parsed IP address of the record in IPv4 32-bit format. For
+// records with several addresses, it is the first one.
 func (r *Record) IP() net.IP {
-	return net.ParseIP(r.Address).To4()
+	return r.IPs()[0]
 }
 
-// SetA sets an A record in the database.
-func (db *DB) SetA(host string, ip net.IP) error {
-	return db.db.Transaction(func(tx *gorm.DB) error {
-		r := &Record{
-			Host:    host,
-			Address: ip.String(),
+// IPs returns every address of the record in IPv4 32-bit format.
+func (r *Record) IPs() []net.IP {
+	ips := []net.IP{}
+	for _, addr := range strings.Split(r.Address, ",") {
+		ips = append(ips, net.ParseIP(addr).To4())
+	}
+
+	return ips
+}
+
+// AddAddress adds ip to the end of the addresses of the record. It returns
+// false if the record already has it.
+func (r *Record) AddAddress(ip net.IP) bool {
+	if r.Address == "" {
+		r.Address = ip.String()
+		return true
+	}
+
+	for _, addr := range r.IPs() {
+		if addr.Equal(ip) {
+			return false
 		}
+	}
 
-		if err := r.Validate(); err != nil {
-			return errors.Wrap(err, "during record validation")
+	r.Address += "," + ip.String()
+	return true
+}
+
+// RemoveAddress removes ip from the addresses of the record, along with its
+// weight if the policy is weighted, leaving the health check and the rest of
+// the policy alone. Address is empty once the last address is removed. It
+// returns false if the record does not have ip.
+func (r *Record) RemoveAddress(ip net.IP) bool {
+	if r.Address == "" {
+		return false
+	}
+
+	ips := r.IPs()
+	for i, addr := range ips {
+		if !addr.Equal(ip) {
+			continue
 		}
 
-		return tx.Create(r).Error
-	})
+		addrs := []string{}
+		for j, addr := range ips {
+			if j != i {
+				addrs = append(addrs, addr.String())
+			}
+		}
+		r.Address = strings.Join(addrs, ",")
+
+		if p, err := ParsePolicy(r.Policy); err == nil && p.Type == PolicyWeighted && len(p.Weights) == len(ips) {
+			p.Weights = append(p.Weights[:i], p.Weights[i+1:]...)
+			r.Policy = p.String()
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// HealthCheck is a parsed Record.Check.
+type HealthCheck struct {
+	// Protocol is "tcp", which checks a connection can be opened, or "http",
+	// which checks a GET of Path answers with a 2xx or 3xx status.
+	Protocol string
+	Port     int
+	Path     string
+}
+
+// ParseCheck parses a health check: "tcp:PORT", or "http:PORT" followed by the
+// path to request, which defaults to "/".
+func ParseCheck(check string) (*HealthCheck, error) {
+	i := strings.Index(check, ":")
+	if i < 0 {
+		return nil, errors.Errorf("invalid health check %q; must be tcp:PORT or http:PORT/PATH", check)
+	}
+
+	hc := &HealthCheck{Protocol: check[:i]}
+	port := check[i+1:]
+
+	switch hc.Protocol {
+	case "tcp":
+	case "http":
+		hc.Path = "/"
+		if j := strings.Index(port, "/"); j >= 0 {
+			port, hc.Path = port[:j], port[j:]
+		}
+	default:
+		return nil, errors.Errorf("invalid protocol %q in health check %q; must be tcp or http", hc.Protocol, check)
+	}
+
+	var err error
+	hc.Port, err = strconv.Atoi(port)
+	if err != nil || hc.Port < 1 || hc.Port > 65535 {
+		return nil, errors.Errorf("invalid port in health check %q", check)
+	}
+
+	return hc, nil
+}
+
+// SetA sets an A record in the default view.
+func (db *DB) SetA(host string, ip net.IP) error {
+	return db.SetRecord(&Record{Host: host, Address: ip.String()})
+}
+
+// SetRecord creates a record, failing if the host already has a record in the
+// view.
+func (db *DB) SetRecord(r *Record) error {
+	if err := db.checkWritable(r.View, r.Host); err != nil {
+		return err
+	}
+
+	if err := r.Validate(); err != nil {
+		return errors.Wrap(err, "during record validation")
+	}
+
+	return db.mutate(&Command{Op: OpCreate, Records: []*Record{r}})
 }
 
-// GetA retrieves an A record in the database.
+// GetA retrieves an A record from the default view.
 func (db *DB) GetA(host string) (net.IP, error) {
-	r := &Record{}
+	return db.Lookup("", host)
+}
 
-	err := db.db.Transaction(func(tx *gorm.DB) error {
-		return tx.First(r, "host = ?", host).Error
-	})
+// Lookup retrieves the address of the host as it is served in the view:
+// the view's own record if it has one, or the default view's otherwise.
+// Static records shadow the database within each view.
+// dnsserverDB.ErrNotFound is returned if neither has a record. For records
+// with several addresses, the first one is returned.
+func (db *DB) Lookup(view, host string) (net.IP, error) {
+	r, err := db.LookupRecord(view, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.IP(), nil
+}
+
+// SetPolicy sets the routing policy of the record for the host in the view,
+// leaving its addresses and health check alone. dnsserverDB.ErrNotFound is
+// returned if there is no such record.
+func (db *DB) SetPolicy(view, host, policy string) error {
+	if err := db.checkWritable(view, host); err != nil {
+		return err
+	}
 
+	r := &Record{}
+	err := db.db.First(r, "host = ? AND view = ?", host, view).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return errors.Wrapf(dnsserverDB.ErrNotFound, "%q", host)
+	case err != nil:
+		return errors.Wrapf(err, "while reading %q", host)
+	}
+
+	r.Policy = policy
 	if err := r.Validate(); err != nil {
-		return nil, errors.Wrap(err, "during validation of record fetched")
+		return errors.Wrap(err, "during record validation")
+	}
+
+	return db.mutate(&Command{Op: OpApply, Records: []*Record{r}})
+}
+
+// LookupRecord retrieves the record of the host as it is served in the view,
+// like Lookup.
+func (db *DB) LookupRecord(view, host string) (*Record, error) {
+	views := []string{view}
+	if view != "" {
+		views = append(views, "")
+	}
+
+	for _, view := range views {
+		db.configMutex.RLock()
+		static, ok := db.static[key{view, host}]
+		db.configMutex.RUnlock()
+
+		if ok {
+			return static, nil
+		}
+
+		r := &Record{}
+		err := db.db.First(r, "host = ? AND view = ?", host, view).Error
+		switch {
+		case gorm.IsRecordNotFoundError(err):
+			continue
+		case err != nil:
+			return nil, errors.Wrapf(err, "while reading %q", host)
+		}
+
+		if err := r.Validate(); err != nil {
+			return nil, errors.Wrap(err, "during validation of record fetched")
+		}
+
+		return r, nil
 	}
 
-	return r.IP(), err
+	return nil, dnsserverDB.ErrNotFound
 }
 
-// DeleteA removes a DNS record
+// DeleteA removes a DNS record from the default view.
 func (db *DB) DeleteA(host string) error {
-	return db.db.Transaction(func(tx *gorm.DB) error {
-		r := &Record{Host: host}
-		if err := r.validateHost(); err != nil {
-			return errors.Wrap(err, "during validation of hostname")
+	return db.DeleteRecord(&Record{Host: host})
+}
+
+// DeleteRecord removes the record for the host in the view. The address of r
+// is ignored.
+func (db *DB) DeleteRecord(r *Record) error {
+	if err := db.checkWritable(r.View, r.Host); err != nil {
+		return err
+	}
+
+	r = &Record{Host: r.Host, View: r.View}
+	if err := r.validateHost(); err != nil {
+		return errors.Wrap(err, "during validation of hostname")
+	}
+
+	return db.mutate(newCommand(OpDelete, nil, []*Record{r}))
+}
+
+// Apply sets and deletes records in a single transaction; if any of the
+// operations fail, none of them are applied. Deletions happen first, and
+// records overwrite any existing record with the same host and view. Only the
+// host and view of the deletions are used.
+func (db *DB) Apply(records []*Record, del []*Record) error {
+	for _, r := range del {
+		if err := db.checkWritable(r.View, r.Host); err != nil {
+			return err
 		}
+	}
 
-		return tx.Delete(r).Error
-	})
+	for _, r := range records {
+		if err := db.checkWritable(r.View, r.Host); err != nil {
+			return err
+		}
+	}
+
+	c := newCommand(OpApply, records, del)
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	return db.mutate(c)
+}
+
+func (db *DB) apply(records []*Record, del []*Record) error {
+	return db.write(newCommand(OpApply, records, del).run)
 }
 
-// ListA lists all the A records in the table
+// ListA lists all the A records in the default view, including static
+// records.
 func (db *DB) ListA() (dnsserverDB.ARecords, error) {
+	tmp, _, err := db.Snapshot()
+	return tmp, err
+}
+
+// Snapshot lists all the A records in the default view, including static
+// records, along with the revision of the last event applied to them.
+// Watching events after that revision will observe every later change.
+func (db *DB) Snapshot() (dnsserverDB.ARecords, uint64, error) {
+	records, rev, err := db.Records()
+	if err != nil {
+		return nil, 0, err
+	}
+
 	tmp := dnsserverDB.ARecords{}
+	for _, r := range records {
+		if r.View == "" {
+			tmp[r.Host] = r.IP()
+		}
+	}
+
+	return tmp, rev, nil
+}
+
+// Records lists the records of every view, including static records, along
+// with the revision of the last event applied to them.
+func (db *DB) Records() ([]*Record, uint64, error) {
+	var rev uint64
+	tmp := []*Record{}
+	seen := map[key]struct{}{}
+
+	db.configMutex.RLock()
+	for k, r := range db.static {
+		r := *r
+		tmp = append(tmp, &r)
+		seen[k] = struct{}{}
+	}
+	db.configMutex.RUnlock()
+
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		rev, err = revision(tx)
+		if err != nil {
+			return err
+		}
 
-	return tmp, db.db.Transaction(func(tx *gorm.DB) error {
 		recs := []*Record{}
 		if err := tx.Find(&recs).Error; err != nil {
 			return err
@@ -145,11 +603,18 @@ func (db *DB) ListA() (dnsserverDB.ARecords, error) {
 				continue
 			}
 
-			tmp[rec.Host] = rec.IP()
+			if _, ok := seen[key{rec.View, rec.Host}]; ok {
+				// static records shadow the database
+				continue
+			}
+
+			tmp = append(tmp, rec)
 		}
 
 		return nil
 	})
+
+	return tmp, rev, err
 }
 
 // ListSRV does nothing but fulfill an interface.
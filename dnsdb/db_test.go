@@ -55,6 +55,82 @@ func TestRecordValidation(t *testing.T) {
 			r:       &Record{Host: "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Address: "127.0.0.1"},
 			success: false,
 		},
+		"several addresses": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2"},
+			success: true,
+		},
+		"repeated address": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.1"},
+			success: false,
+		},
+		"empty address in list": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,"},
+			success: false,
+		},
+		"tcp check": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "tcp:80"},
+			success: true,
+		},
+		"http check": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "http:8080/healthz"},
+			success: true,
+		},
+		"http check without path": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "http:8080"},
+			success: true,
+		},
+		"tcp check with path": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "tcp:80/healthz"},
+			success: false,
+		},
+		"check without port": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "tcp"},
+			success: false,
+		},
+		"check with bad port": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "tcp:65536"},
+			success: false,
+		},
+		"icmp check": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Check: "icmp:1"},
+			success: false,
+		},
+		"weighted policy": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "weighted:90,10"},
+			success: true,
+		},
+		"weighted policy with a drained address": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "weighted:0,10"},
+			success: true,
+		},
+		"weighted policy without weight": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "weighted:0,0"},
+			success: false,
+		},
+		"weighted policy with too few weights": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "weighted:90"},
+			success: false,
+		},
+		"weighted policy with negative weight": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "weighted:-1,10"},
+			success: false,
+		},
+		"weighted policy without weights": {
+			r:       &Record{Host: "test", Address: "127.0.0.1", Policy: "weighted"},
+			success: false,
+		},
+		"failover policy": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "failover"},
+			success: true,
+		},
+		"failover policy with arguments": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "failover:1"},
+			success: false,
+		},
+		"unknown policy": {
+			r:       &Record{Host: "test", Address: "127.0.0.1,127.0.0.2", Policy: "geo"},
+			success: false,
+		},
 	}
 
 	for testName, result := range table {
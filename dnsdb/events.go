@@ -0,0 +1,266 @@
+package dnsdb
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EventSet is the type of event emitted when a record is set.
+	EventSet = "set"
+	// EventDelete is the type of event emitted when a record is deleted.
+	EventDelete = "delete"
+
+	subscriberBuffer = 1024
+
+	// DefaultJournalSize is the number of events kept by default.
+	DefaultJournalSize = 10000
+)
+
+// Event is a change to the records table. Every mutation stores its events in
+// the same transaction as the change itself, so revisions are monotonically
+// increasing and survive restarts.
+type Event struct {
+	Revision uint64 `gorm:"primary_key"`
+	Type     string
+	Host     string
+	View     string
+	// Address is the address after the change; it is empty for deletions.
+	Address string
+	// Previous is the address before the change; it is empty if the record did
+	// not exist.
+	Previous string
+	// Check and Policy are the health check and routing policy after the
+	// change.
+	Check     string
+	Policy    string
+	CreatedAt time.Time
+}
+
+// Record returns the record the event refers to. For deletions only the host
+// and view are set.
+func (e *Event) Record() *Record {
+	return &Record{Host: e.Host, View: e.View, Address: e.Address, Check: e.Check, Policy: e.Policy}
+}
+
+// recordFunc records an event in the transaction it is passed to.
+type recordFunc func(typ string, r *Record, previous string) error
+
+// write runs fn in a transaction and publishes any events fn records once the
+// transaction has committed. Writes are serialized so that subscribers always
+// see events in revision order.
+func (db *DB) write(fn func(tx *gorm.DB, record recordFunc) error) error {
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	events := []*Event{}
+
+	err := transaction(db.db, func(tx *gorm.DB) error {
+		return fn(tx, func(typ string, r *Record, previous string) error {
+			e := &Event{Type: typ, Host: r.Host, View: r.View, Address: r.Address, Previous: previous, Check: r.Check, Policy: r.Policy}
+			if typ == EventDelete {
+				e.Address = ""
+				e.Check = ""
+				e.Policy = ""
+			}
+
+			if err := tx.Create(e).Error; err != nil {
+				return errors.Wrap(err, "while recording event")
+			}
+
+			events = append(events, e)
+			return nil
+		})
+	}, func(tx *gorm.DB) error {
+		if len(events) == 0 {
+			return nil
+		}
+
+		return db.compact(tx, events[len(events)-1].Revision)
+	})
+	if err != nil {
+		return err
+	}
+
+	db.publish(events)
+	return nil
+}
+
+// transaction runs every fn in a single transaction.
+func transaction(db *gorm.DB, fns ...func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetJournalSize sets the number of events kept in the journal. Older events
+// are removed as new ones are recorded; at least one event is always kept so
+// the revision survives. 0 keeps every event.
+func (db *DB) SetJournalSize(size uint64) {
+	db.writeMutex.Lock()
+	db.journalSize = size
+	db.writeMutex.Unlock()
+}
+
+// compact removes events that no longer fit in the journal.
+func (db *DB) compact(tx *gorm.DB, last uint64) error {
+	if db.journalSize == 0 || last <= db.journalSize {
+		return nil
+	}
+
+	if err := tx.Delete(&Event{}, "revision <= ?", last-db.journalSize).Error; err != nil {
+		return errors.Wrap(err, "while compacting journal")
+	}
+
+	return nil
+}
+
+// set writes r, replacing any record with the same host and view, and records
+// the event. Writing a record that is already in the table does nothing.
+func set(tx *gorm.DB, r *Record, record recordFunc) error {
+	prev := &Record{}
+	err := tx.First(prev, "host = ? AND view = ?", r.Host, r.View).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		prev.Address = ""
+	case err != nil:
+		return errors.Wrapf(err, "while reading %q", r.Host)
+	case prev.same(r):
+		return nil
+	}
+
+	if err := tx.Save(r).Error; err != nil {
+		return errors.Wrapf(err, "while setting %q", r.Host)
+	}
+
+	return record(EventSet, r, prev.Address)
+}
+
+// remove deletes the record for the host in r's view, if there is one, and
+// records the event.
+func remove(tx *gorm.DB, r *Record, record recordFunc) error {
+	prev := &Record{}
+	err := tx.First(prev, "host = ? AND view = ?", r.Host, r.View).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "while reading %q", r.Host)
+	}
+
+	if err := tx.Delete(&Record{}, "host = ? AND view = ?", r.Host, r.View).Error; err != nil {
+		return errors.Wrapf(err, "while deleting %q", r.Host)
+	}
+
+	return record(EventDelete, prev, prev.Address)
+}
+
+func (db *DB) publish(events []*Event) {
+	db.subscriberMutex.Lock()
+	defer db.subscriberMutex.Unlock()
+
+	for sub := range db.subscribers {
+	send:
+		for _, e := range events {
+			select {
+			case sub <- e:
+			default:
+				// the subscriber has fallen behind; it will have to resume from its
+				// last revision.
+				delete(db.subscribers, sub)
+				close(sub)
+				break send
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every event after it has been
+// committed, and a function to stop the subscription. The channel is closed if
+// the subscriber falls too far behind or CloseWatchers is called; callers
+// should resume with Events from the last revision they saw.
+func (db *DB) Subscribe() (<-chan *Event, func()) {
+	db.subscriberMutex.Lock()
+	defer db.subscriberMutex.Unlock()
+
+	sub := make(chan *Event, subscriberBuffer)
+
+	if db.watchersClosed {
+		close(sub)
+		return sub, func() {}
+	}
+
+	db.subscribers[sub] = struct{}{}
+
+	return sub, func() {
+		db.subscriberMutex.Lock()
+		defer db.subscriberMutex.Unlock()
+
+		if _, ok := db.subscribers[sub]; ok {
+			delete(db.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// CloseWatchers closes every subscription and refuses new ones. It is used to
+// end long-running watches before shutting down.
+func (db *DB) CloseWatchers() {
+	db.subscriberMutex.Lock()
+	defer db.subscriberMutex.Unlock()
+
+	db.watchersClosed = true
+
+	for sub := range db.subscribers {
+		delete(db.subscribers, sub)
+		close(sub)
+	}
+}
+
+// Events returns all events after the revision, in order. If events after
+// the revision have been compacted out of the journal, ErrCompacted is
+// returned.
+func (db *DB) Events(after uint64) ([]*Event, error) {
+	events := []*Event{}
+
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		var first struct{ Revision uint64 }
+		if err := tx.Model(&Event{}).Select("coalesce(min(revision), 0) as revision").Scan(&first).Error; err != nil {
+			return errors.Wrap(err, "while reading journal")
+		}
+
+		if first.Revision > after+1 {
+			return errors.Wrapf(ErrCompacted, "the oldest revision is %d", first.Revision)
+		}
+
+		if err := tx.Order("revision asc").Find(&events, "revision > ?", after).Error; err != nil {
+			return errors.Wrap(err, "while reading events")
+		}
+
+		return nil
+	})
+
+	return events, err
+}
+
+// Revision returns the revision of the last event.
+func (db *DB) Revision() (uint64, error) {
+	return revision(db.db)
+}
+
+func revision(tx *gorm.DB) (uint64, error) {
+	var rev struct{ Revision uint64 }
+	if err := tx.Model(&Event{}).Select("coalesce(max(revision), 0) as revision").Scan(&rev).Error; err != nil {
+		return 0, errors.Wrap(err, "while reading revision")
+	}
+
+	return rev.Revision, nil
+}
@@ -0,0 +1,97 @@
+package dnsdb
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.SetJournalSize(3)
+
+	if err := db.SetA("foo", net.ParseIP("1.2.3.4")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Apply([]*Record{{Host: "foo", Address: "1.2.3.5"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// setting the same address again is not a change
+	if err := db.Apply([]*Record{{Host: "foo", Address: "1.2.3.5"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteA("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting something that does not exist is not a change either
+	if err := db.DeleteA("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Event{
+		{Revision: 1, Type: EventSet, Host: "foo", Address: "1.2.3.4"},
+		{Revision: 2, Type: EventSet, Host: "foo", Address: "1.2.3.5", Previous: "1.2.3.4"},
+		{Revision: 3, Type: EventDelete, Host: "foo", Previous: "1.2.3.5"},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+
+	for i, e := range events {
+		x := expected[i]
+		if e.Revision != x.Revision || e.Type != x.Type || e.Host != x.Host || e.Address != x.Address || e.Previous != x.Previous {
+			t.Fatalf("event %d was %+v, expected %+v", i, e, x)
+		}
+	}
+
+	if err := db.SetA("bar", net.ParseIP("1.2.3.6")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Events(0); errors.Cause(err) != ErrCompacted {
+		t.Fatalf("reading compacted events did not fail properly: %v", err)
+	}
+
+	events, err = db.Events(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 || events[0].Revision != 2 {
+		t.Fatalf("unexpected events after compaction: %v", events)
+	}
+
+	rev, err := db.Revision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rev != 4 {
+		t.Fatalf("revision was %d instead of 4", rev)
+	}
+}
@@ -0,0 +1,324 @@
+package dnsdb
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// ErrClustered is for when a repair is attempted on a cluster node's
+// database, whose records may only change through the cluster's log.
+var ErrClustered = errors.New("the database belongs to a cluster node and cannot be repaired")
+
+// QuarantinedRecord is a row that was moved out of the records table by a
+// repair because it could not be served.
+type QuarantinedRecord struct {
+	ID            uint `gorm:"primary_key"`
+	Host          string
+	View          string
+	Address       string
+	Reason        string
+	QuarantinedAt time.Time
+}
+
+// Problem is an invalid row found during a check.
+type Problem struct {
+	Table   string
+	RowID   int64
+	Host    string
+	View    string
+	Address string
+	Reason  string
+}
+
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s row %d (%q/%q): %s", p.Table, p.RowID, p.Host, p.Address, p.Reason)
+}
+
+// Report is the result of a check of the database.
+type Report struct {
+	// Problems are rows that cannot be served.
+	Problems []*Problem
+	// Duplicates are groups of hosts that only differ by case.
+	Duplicates [][]string
+	// Drift describes differences between the on-disk schema and the schema
+	// ldnsd expects.
+	Drift []string
+	// Quarantined is the number of rows moved to the quarantine table.
+	Quarantined int
+}
+
+// Clean is true if nothing is wrong with the database.
+func (r *Report) Clean() bool {
+	return len(r.Problems)+len(r.Duplicates)+len(r.Drift) == 0
+}
+
+// Check scans the database in dbfile for rows that cannot be served and for
+// differences from the expected schema. Unlike New, it never migrates the
+// database. If repair is true, invalid rows are moved into the quarantine
+// table instead of being deleted, and their deletion is journaled so
+// secondaries and replicas follow; cluster nodes cannot be repaired, and
+// ErrClustered is returned for them.
+func Check(dbfile string, repair bool) (*Report, error) {
+	db, err := gorm.Open("sqlite3", dbfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to db")
+	}
+	defer db.Close()
+
+	report := &Report{}
+
+	recordsOK, err := checkSchema(db, report)
+	if err != nil {
+		return nil, err
+	}
+
+	if !recordsOK {
+		return report, nil
+	}
+
+	if err := checkRecords(db, report); err != nil {
+		return nil, err
+	}
+
+	if repair && len(report.Problems) > 0 {
+		clustered, err := isClustered(db)
+		if err != nil {
+			return nil, err
+		}
+
+		if clustered {
+			return nil, ErrClustered
+		}
+
+		if err := quarantine(db, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+func modelColumns(db *gorm.DB, model interface{}) (string, map[string]struct{}) {
+	scope := db.NewScope(model)
+	columns := map[string]struct{}{}
+	for _, field := range scope.GetModelStruct().StructFields {
+		if field.IsNormal && !field.IsIgnored {
+			columns[field.DBName] = struct{}{}
+		}
+	}
+
+	return scope.TableName(), columns
+}
+
+// checkSchema compares the tables on disk to the models. It returns true if
+// the records table can be scanned.
+func checkSchema(db *gorm.DB, report *Report) (bool, error) {
+	expected := map[string]map[string]struct{}{}
+	recordsTable, recordsColumns := modelColumns(db, &Record{})
+	expected[recordsTable] = recordsColumns
+	for _, model := range []interface{}{&Event{}, &ClusterState{}, &QuarantinedRecord{}} {
+		table, columns := modelColumns(db, model)
+		expected[table] = columns
+	}
+
+	tables := []string{}
+	rows, err := db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'").Rows()
+	if err != nil {
+		return false, errors.Wrap(err, "while listing tables")
+	}
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, errors.Wrap(err, "while listing tables")
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	recordsFound, recordsOK := false, false
+
+	for _, table := range tables {
+		columns, ok := expected[table]
+		if !ok {
+			report.Drift = append(report.Drift, fmt.Sprintf("unknown table %q", table))
+			continue
+		}
+
+		onDisk, err := tableColumns(db, table)
+		if err != nil {
+			return false, err
+		}
+
+		complete := true
+		for column := range columns {
+			if _, ok := onDisk[column]; !ok {
+				report.Drift = append(report.Drift, fmt.Sprintf("table %q is missing column %q", table, column))
+				complete = false
+			}
+		}
+
+		for column := range onDisk {
+			if _, ok := columns[column]; !ok {
+				report.Drift = append(report.Drift, fmt.Sprintf("table %q has unknown column %q", table, column))
+			}
+		}
+
+		if table == recordsTable {
+			recordsFound, recordsOK = true, complete
+		}
+	}
+
+	if !recordsFound {
+		report.Drift = append(report.Drift, fmt.Sprintf("table %q is missing", recordsTable))
+	}
+
+	sort.Strings(report.Drift)
+
+	return recordsOK, nil
+}
+
+func tableColumns(db *gorm.DB, table string) (map[string]struct{}, error) {
+	rows, err := db.Raw(fmt.Sprintf("PRAGMA table_info(%q)", table)).Rows()
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading schema of %q", table)
+	}
+	defer rows.Close()
+
+	columns := map[string]struct{}{}
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			typ     string
+			notNull bool
+			dflt    sql.NullString
+			pk      int
+		)
+
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, errors.Wrapf(err, "while reading schema of %q", table)
+		}
+
+		columns[name] = struct{}{}
+	}
+
+	return columns, nil
+}
+
+func checkRecords(db *gorm.DB, report *Report) error {
+	table := db.NewScope(&Record{}).TableName()
+
+	rows, err := db.Raw(fmt.Sprintf("SELECT rowid, host, view, address FROM %q", table)).Rows()
+	if err != nil {
+		return errors.Wrap(err, "while scanning records")
+	}
+	defer rows.Close()
+
+	folded := map[string][]string{}
+
+	for rows.Next() {
+		var (
+			rowid               int64
+			host, view, address sql.NullString
+		)
+
+		if err := rows.Scan(&rowid, &host, &view, &address); err != nil {
+			return errors.Wrap(err, "while scanning records")
+		}
+
+		r := &Record{Host: host.String, View: view.String, Address: address.String}
+		if err := r.Validate(); err != nil {
+			report.Problems = append(report.Problems, &Problem{
+				Table:   table,
+				RowID:   rowid,
+				Host:    r.Host,
+				View:    r.View,
+				Address: r.Address,
+				Reason:  err.Error(),
+			})
+		}
+
+		// hosts only clash with hosts in the same view.
+		lower := r.View + "/" + strings.ToLower(r.Host)
+		folded[lower] = append(folded[lower], r.Host)
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "while scanning records")
+	}
+
+	for _, hosts := range folded {
+		if len(hosts) > 1 {
+			sort.Strings(hosts)
+			report.Duplicates = append(report.Duplicates, hosts)
+		}
+	}
+
+	sort.Slice(report.Duplicates, func(i, j int) bool { return report.Duplicates[i][0] < report.Duplicates[j][0] })
+
+	return nil
+}
+
+func quarantine(db *gorm.DB, report *Report) error {
+	if err := db.AutoMigrate(&QuarantinedRecord{}).Error; err != nil {
+		return errors.Wrap(err, "while creating quarantine table")
+	}
+
+	// databases from before the journal have nobody following them.
+	journaled := db.HasTable(&Event{})
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		for _, p := range report.Problems {
+			q := &QuarantinedRecord{
+				Host:          p.Host,
+				View:          p.View,
+				Address:       p.Address,
+				Reason:        p.Reason,
+				QuarantinedAt: now,
+			}
+
+			if err := tx.Create(q).Error; err != nil {
+				return errors.Wrapf(err, "while quarantining %s", p)
+			}
+
+			if err := tx.Exec(fmt.Sprintf("DELETE FROM %q WHERE rowid = ?", p.Table), p.RowID).Error; err != nil {
+				return errors.Wrapf(err, "while quarantining %s", p)
+			}
+
+			if journaled {
+				e := &Event{Type: EventDelete, Host: p.Host, View: p.View, Previous: p.Address, CreatedAt: now}
+				if err := tx.Create(e).Error; err != nil {
+					return errors.Wrapf(err, "while journaling the quarantine of %s", p)
+				}
+			}
+		}
+
+		report.Quarantined = len(report.Problems)
+		return nil
+	})
+}
+
+// isClustered returns true if the database has committed commands from a
+// cluster's log.
+func isClustered(db *gorm.DB) (bool, error) {
+	if !db.HasTable(&ClusterState{}) {
+		return false, nil
+	}
+
+	index, err := appliedIndex(db)
+	if err != nil {
+		return false, err
+	}
+
+	return index > 0, nil
+}
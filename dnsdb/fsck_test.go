@@ -0,0 +1,163 @@
+package dnsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbfile := filepath.Join(dir, "test.db")
+
+	db, err := New(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*Record{
+		{Host: "good", Address: "1.2.3.4"},
+		{Host: "Good", Address: "1.2.3.5"},
+		{Host: "bad", Address: "fe80::1"},
+		{Host: "bad_name", Address: "1.2.3.6"},
+	} {
+		// bypass validation like an older or hand-edited database would
+		if err := db.db.Create(r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	report, err := Check(dbfile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 3 {
+		t.Fatalf("expected 3 problems, got %d: %v", len(report.Problems), report.Problems)
+	}
+
+	if len(report.Duplicates) != 1 || len(report.Duplicates[0]) != 2 {
+		t.Fatalf("expected one pair of duplicates, got %v", report.Duplicates)
+	}
+
+	if len(report.Drift) != 0 {
+		t.Fatalf("unexpected drift: %v", report.Drift)
+	}
+
+	report, err = Check(dbfile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Quarantined != 3 {
+		t.Fatalf("expected 3 quarantined records, got %d", report.Quarantined)
+	}
+
+	report, err = Check(dbfile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Clean() {
+		t.Fatalf("database was not clean after repair: %+v", report)
+	}
+
+	db, err = New(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	recs, err := db.ListA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recs) != 1 || recs["good"] == nil {
+		t.Fatalf("unexpected records after repair: %v", recs)
+	}
+
+	quarantined := []*QuarantinedRecord{}
+	if err := db.db.Find(&quarantined).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(quarantined) != 3 {
+		t.Fatalf("expected 3 rows in quarantine, got %d", len(quarantined))
+	}
+
+	// secondaries and replicas learn of the repair from the journal.
+	events, err := db.Events(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events for the quarantined records, got %d", len(events))
+	}
+
+	for _, e := range events {
+		if e.Type != EventDelete || e.Host == "good" || e.Previous == "" {
+			t.Fatalf("unexpected event for a quarantined record: %+v", e)
+		}
+	}
+
+	if err := db.db.Exec("ALTER TABLE records ADD COLUMN extra text").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Check(dbfile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Drift) != 1 {
+		t.Fatalf("expected 1 drift entry, got %v", report.Drift)
+	}
+}
+
+func TestCheckClustered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbfile := filepath.Join(dir, "test.db")
+
+	db, err := New(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.db.Create(&Record{Host: "bad", Address: "fe80::1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setAppliedIndex(db.db, 5); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	report, err := Check(dbfile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 1 {
+		t.Fatalf("expected 1 problem, got %v", report.Problems)
+	}
+
+	if _, err := Check(dbfile, true); errors.Cause(err) != ErrClustered {
+		t.Fatalf("a cluster node's database was repaired: %v", err)
+	}
+}
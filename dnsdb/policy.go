@@ -0,0 +1,75 @@
+package dnsdb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PolicyWeighted serves one address, picked at random in proportion to
+	// its weight.
+	PolicyWeighted = "weighted"
+	// PolicyFailover serves the first address, in the order of the record,
+	// that is up.
+	PolicyFailover = "failover"
+)
+
+// Policy is a parsed Record.Policy.
+type Policy struct {
+	Type string
+	// Weights are the weights of the addresses of the record, in order.
+	Weights []int
+}
+
+// String returns the policy in the form ParsePolicy parses.
+func (p *Policy) String() string {
+	if p.Type != PolicyWeighted {
+		return p.Type
+	}
+
+	weights := []string{}
+	for _, weight := range p.Weights {
+		weights = append(weights, strconv.Itoa(weight))
+	}
+
+	return p.Type + ":" + strings.Join(weights, ",")
+}
+
+// ParsePolicy parses a routing policy: "weighted:" followed by the weight of
+// every address, separated by commas, or "failover".
+func ParsePolicy(policy string) (*Policy, error) {
+	typ, args := policy, ""
+	if i := strings.Index(policy, ":"); i >= 0 {
+		typ, args = policy[:i], policy[i+1:]
+	}
+
+	p := &Policy{Type: typ}
+
+	switch typ {
+	case PolicyFailover:
+		if args != "" {
+			return nil, errors.Errorf("invalid policy %q; failover takes no arguments", policy)
+		}
+	case PolicyWeighted:
+		var total int
+		for _, arg := range strings.Split(args, ",") {
+			weight, err := strconv.Atoi(arg)
+			if err != nil || weight < 0 {
+				return nil, errors.Errorf("invalid weight %q in policy %q", arg, policy)
+			}
+
+			p.Weights = append(p.Weights, weight)
+			total += weight
+		}
+
+		if total == 0 {
+			return nil, errors.Errorf("policy %q has no weight", policy)
+		}
+	default:
+		return nil, errors.Errorf("invalid policy %q; must be weighted:WEIGHT,... or failover", policy)
+	}
+
+	return p, nil
+}
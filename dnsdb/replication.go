@@ -0,0 +1,77 @@
+package dnsdb
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Replicate sets and deletes records like Apply, but ignores static records
+// and read-only mode. It is used to copy changes from a primary.
+func (db *DB) Replicate(records []*Record, del []*Record) error {
+	return db.apply(records, del)
+}
+
+// Sync makes the records table match records exactly, in a single
+// transaction, ignoring static records and read-only mode. Only records that
+// differ are written, so only real changes produce events.
+func (db *DB) Sync(records []*Record) error {
+	return db.write(func(tx *gorm.DB, record recordFunc) error {
+		return syncRecords(tx, records, record)
+	})
+}
+
+// syncRecords is Sync inside an existing transaction.
+func syncRecords(tx *gorm.DB, records []*Record, record recordFunc) error {
+	existing := []*Record{}
+	if err := tx.Find(&existing).Error; err != nil {
+		return errors.Wrap(err, "while reading records")
+	}
+
+	current := map[key]*Record{}
+	for _, r := range existing {
+		current[key{r.View, r.Host}] = r
+	}
+
+	desired := map[key]struct{}{}
+
+	for _, r := range records {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "during validation of record %q", r.Host)
+		}
+
+		k := key{r.View, r.Host}
+		desired[k] = struct{}{}
+
+		var previous string
+		if prev, ok := current[k]; ok {
+			if prev.same(r) {
+				continue
+			}
+			previous = prev.Address
+		}
+
+		if err := tx.Save(r).Error; err != nil {
+			return errors.Wrapf(err, "while setting %q", r.Host)
+		}
+
+		if err := record(EventSet, r, previous); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range existing {
+		if _, ok := desired[key{r.View, r.Host}]; ok {
+			continue
+		}
+
+		if err := tx.Delete(&Record{}, "host = ? AND view = ?", r.Host, r.View).Error; err != nil {
+			return errors.Wrapf(err, "while deleting %q", r.Host)
+		}
+
+		if err := record(EventDelete, r, r.Address); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
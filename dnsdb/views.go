@@ -0,0 +1,99 @@
+package dnsdb
+
+import (
+	"net"
+
+	dnsserverDB "github.com/erikh/dnsserver/db"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// migrateViews rebuilds a records table created before views existed, so that
+// the view is part of its primary key. Existing records land in the default
+// view.
+func migrateViews(db *gorm.DB) error {
+	if !db.HasTable(&Record{}) {
+		return nil
+	}
+
+	table := db.NewScope(&Record{}).TableName()
+	if db.Dialect().HasColumn(table, "view") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		old := table + "_before_views"
+
+		if err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + old).Error; err != nil {
+			return errors.Wrap(err, "while migrating records to views")
+		}
+
+		if err := tx.CreateTable(&Record{}).Error; err != nil {
+			return errors.Wrap(err, "while migrating records to views")
+		}
+
+		if err := tx.Exec("INSERT INTO " + table + " (host, view, address) SELECT host, '', address FROM " + old).Error; err != nil {
+			return errors.Wrap(err, "while migrating records to views")
+		}
+
+		if err := tx.Exec("DROP TABLE " + old).Error; err != nil {
+			return errors.Wrap(err, "while migrating records to views")
+		}
+
+		return nil
+	})
+}
+
+// View returns the records as they are served in the named view, for a
+// dnsserver.Server to answer from. Hosts the view has no record for are
+// answered from the default view.
+func (db *DB) View(name string) dnsserverDB.DB {
+	return &viewDB{db: db, name: name}
+}
+
+type viewDB struct {
+	db   *DB
+	name string
+}
+
+func (v *viewDB) GetA(host string) (net.IP, error) {
+	return v.db.Lookup(v.name, host)
+}
+
+func (v *viewDB) SetA(host string, ip net.IP) error {
+	return v.db.SetRecord(&Record{Host: host, View: v.name, Address: ip.String()})
+}
+
+func (v *viewDB) DeleteA(host string) error {
+	return v.db.DeleteRecord(&Record{Host: host, View: v.name})
+}
+
+func (v *viewDB) ListA() (dnsserverDB.ARecords, error) {
+	records, _, err := v.db.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := dnsserverDB.ARecords{}
+	for _, r := range records {
+		if r.View == "" {
+			if _, ok := tmp[r.Host]; ok {
+				continue
+			}
+		} else if r.View != v.name {
+			continue
+		}
+
+		tmp[r.Host] = r.IP()
+	}
+
+	return tmp, nil
+}
+
+func (v *viewDB) ListSRV() (dnsserverDB.SRVRecords, error)      { return nil, ErrNotSupported }
+func (v *viewDB) SetSRV(string, *dnsserverDB.SRVRecord) error   { return ErrNotSupported }
+func (v *viewDB) GetSRV(string) (*dnsserverDB.SRVRecord, error) { return nil, ErrNotSupported }
+func (v *viewDB) DeleteSRV(string) error                        { return ErrNotSupported }
+
+// Close does nothing; the view does not own the database.
+func (v *viewDB) Close() error { return nil }
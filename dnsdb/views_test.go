@@ -0,0 +1,111 @@
+package dnsdb
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dnsserverDB "github.com/erikh/dnsserver/db"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+func TestViews(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-views")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbfile := filepath.Join(dir, "test.db")
+
+	// a database from before views, keyed by host alone.
+	old, err := gorm.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range []string{
+		"CREATE TABLE records (host varchar(255), address varchar(255), PRIMARY KEY (host))",
+		"CREATE TABLE events (revision integer primary key autoincrement, type varchar(255), host varchar(255), address varchar(255), previous varchar(255), created_at datetime)",
+		"INSERT INTO records (host, address) VALUES ('gw', '10.0.0.1')",
+		"INSERT INTO events (type, host, address, previous) VALUES ('set', 'gw', '10.0.0.1', '')",
+	} {
+		if err := old.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db, err := New(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if events, err := db.Events(0); err != nil || len(events) != 1 || events[0].View != "" {
+		t.Fatalf("unexpected journal after migration: %v: %v", events, err)
+	}
+
+	if err := db.SetRecord(&Record{Host: "gw", View: "vpn", Address: "10.8.0.1"}); errors.Cause(err) != ErrUnknownView {
+		t.Fatalf("record was written to an unknown view: %v", err)
+	}
+
+	db.SetViews([]string{"vpn"})
+
+	if err := db.SetStatic([]*Record{{Host: "ns", View: "vpn", Address: "10.8.0.53"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*Record{{Host: "gw", View: "vpn", Address: "10.8.0.1"}, {Host: "nas", Address: "10.0.0.2"}} {
+		if err := db.SetRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := map[string]struct {
+		view, host string
+		address    string
+	}{
+		"default":                 {host: "gw", address: "10.0.0.1"},
+		"view":                    {view: "vpn", host: "gw", address: "10.8.0.1"},
+		"fallback":                {view: "vpn", host: "nas", address: "10.0.0.2"},
+		"static in view":          {view: "vpn", host: "ns", address: "10.8.0.53"},
+		"static in other view":    {host: "ns"},
+		"missing in both":         {view: "vpn", host: "missing"},
+		"unknown view falls back": {view: "lab", host: "gw", address: "10.0.0.1"},
+	}
+
+	for testName, result := range table {
+		ip, err := db.Lookup(result.view, result.host)
+		if result.address == "" {
+			if err != dnsserverDB.ErrNotFound {
+				t.Fatalf("Result for %q should be not found but was %v (%v)", testName, ip, err)
+			}
+			continue
+		}
+
+		if err != nil || !ip.Equal(net.ParseIP(result.address)) {
+			t.Fatalf("Result for %q should be %s but was %v (%v)", testName, result.address, ip, err)
+		}
+	}
+
+	if err := db.DeleteRecord(&Record{Host: "gw", View: "vpn"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ip, err := db.Lookup("vpn", "gw"); err != nil || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("deleting from the view did not fall back to the default view: %v (%v)", ip, err)
+	}
+
+	records, _, err := db.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("unexpected records: %v", records)
+	}
+}
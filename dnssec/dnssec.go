@@ -0,0 +1,289 @@
+// Package dnssec signs the answers for a zone online. A single key is used as
+// both the key signing and the zone signing key, and denial of existence is
+// proven with minimal NSEC or NSEC3 records generated for each query, so
+// nothing has to be precomputed when records change.
+package dnssec
+
+import (
+	"crypto"
+	"encoding/base32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeyTTL is the TTL of the DNSKEY record.
+	KeyTTL = 3600
+
+	validity  = 7 * 24 * time.Hour
+	clockSkew = time.Hour
+)
+
+// Config configures a Signer.
+type Config struct {
+	// Zone is the fully qualified name of the zone.
+	Zone string
+	// KeyFile holds the public key as a DNSKEY record, and PrivateKeyFile the
+	// private key in the format BIND uses. If neither exists, a key is
+	// generated and written to them.
+	KeyFile        string
+	PrivateKeyFile string
+	// Algorithm is used to generate a key.
+	Algorithm uint8
+	// NSEC3 proves denial of existence with NSEC3 instead of NSEC.
+	NSEC3 bool
+}
+
+// Signer signs records for a zone.
+type Signer struct {
+	zone  string
+	key   *dns.DNSKEY
+	priv  crypto.Signer
+	nsec3 bool
+}
+
+// Load reads the key, or generates one if there is none yet.
+func Load(c Config) (*Signer, error) {
+	s := &Signer{zone: dns.Fqdn(strings.ToLower(c.Zone)), nsec3: c.NSEC3}
+
+	_, keyErr := os.Stat(c.KeyFile)
+	_, privErr := os.Stat(c.PrivateKeyFile)
+
+	var err error
+	switch {
+	case os.IsNotExist(keyErr) && os.IsNotExist(privErr):
+		err = s.generate(c)
+	case keyErr != nil:
+		err = errors.Wrap(keyErr, "while reading dnssec key")
+	case privErr != nil:
+		err = errors.Wrap(privErr, "while reading dnssec private key")
+	default:
+		err = s.load(c)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Signer) generate(c Config) error {
+	var bits int
+	switch c.Algorithm {
+	case dns.RSASHA256, dns.RSASHA512:
+		bits = 2048
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		bits = 256
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	default:
+		return errors.Errorf("unsupported dnssec algorithm %d", c.Algorithm)
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: s.zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: KeyTTL},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: c.Algorithm,
+	}
+
+	priv, err := key.Generate(bits)
+	if err != nil {
+		return errors.Wrap(err, "while generating dnssec key")
+	}
+
+	if err := ioutil.WriteFile(c.PrivateKeyFile, []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return errors.Wrap(err, "while writing dnssec private key")
+	}
+
+	if err := ioutil.WriteFile(c.KeyFile, []byte(key.String()+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "while writing dnssec key")
+	}
+
+	return s.setKey(key, priv)
+}
+
+func (s *Signer) load(c Config) error {
+	content, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "while reading dnssec key")
+	}
+
+	rr, err := dns.NewRR(string(content))
+	if err != nil {
+		return errors.Wrap(err, "while parsing dnssec key")
+	}
+
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return errors.Errorf("%s does not hold a DNSKEY record", c.KeyFile)
+	}
+
+	if !strings.EqualFold(key.Hdr.Name, s.zone) {
+		return errors.Errorf("dnssec key is for %q, not %q", key.Hdr.Name, s.zone)
+	}
+
+	f, err := os.Open(c.PrivateKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "while reading dnssec private key")
+	}
+	defer f.Close()
+
+	priv, err := key.ReadPrivateKey(f, c.PrivateKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "while parsing dnssec private key")
+	}
+
+	return s.setKey(key, priv)
+}
+
+func (s *Signer) setKey(key *dns.DNSKEY, priv crypto.PrivateKey) error {
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return errors.New("dnssec private key cannot sign")
+	}
+
+	key.Hdr.Name = s.zone
+	key.Hdr.Ttl = KeyTTL
+	s.key = key
+	s.priv = signer
+	return nil
+}
+
+// DNSKEY returns the key, for the apex of the zone.
+func (s *Signer) DNSKEY() *dns.DNSKEY {
+	return dns.Copy(s.key).(*dns.DNSKEY)
+}
+
+// DS returns the SHA-256 DS record to install in the parent zone.
+func (s *Signer) DS() *dns.DS {
+	return s.key.ToDS(dns.SHA256)
+}
+
+// NSEC3PARAM returns the NSEC3 parameters for the apex, or nil if NSEC is
+// used.
+func (s *Signer) NSEC3PARAM() *dns.NSEC3PARAM {
+	if !s.nsec3 {
+		return nil
+	}
+
+	return &dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: s.zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+		Hash: dns.SHA1,
+	}
+}
+
+// Sign returns the records with a signature after every RRset. Existing
+// signatures and OPT records are left as they are.
+func (s *Signer) Sign(rrs []dns.RR) ([]dns.RR, error) {
+	type rrset struct {
+		name string
+		typ  uint16
+	}
+
+	sets := map[rrset][]dns.RR{}
+	order := []rrset{}
+	ret := []dns.RR{}
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			ret = append(ret, rr)
+			continue
+		}
+
+		k := rrset{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	now := time.Now()
+
+	for _, k := range order {
+		set := sets[k]
+		h := set[0].Header()
+
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+			Algorithm:  s.key.Algorithm,
+			Expiration: uint32(now.Add(validity).Unix()),
+			Inception:  uint32(now.Add(-clockSkew).Unix()),
+			KeyTag:     s.key.KeyTag(),
+			SignerName: s.zone,
+		}
+
+		if err := sig.Sign(s.priv, set); err != nil {
+			return nil, errors.Wrapf(err, "while signing %s/%s", h.Name, dns.TypeToString[h.Rrtype])
+		}
+
+		ret = append(ret, set...)
+		ret = append(ret, sig)
+	}
+
+	return ret, nil
+}
+
+// Deny returns the record proving that name holds the types and no others,
+// with the given TTL. A name that does not exist holds no types; it is proven
+// to exist with none, which validating resolvers accept like a NXDOMAIN.
+func (s *Signer) Deny(name string, types []uint16, ttl uint32) dns.RR {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if s.nsec3 {
+		bitmap := append([]uint16{}, types...)
+		if len(bitmap) > 0 {
+			bitmap = append(bitmap, dns.TypeRRSIG)
+		}
+
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + s.zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: next(hash),
+			TypeBitMap: sortTypes(bitmap),
+		}
+	}
+
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		// the name right after this one in canonical order, so the record
+		// covers nothing else.
+		NextDomain: `\000.` + name,
+		TypeBitMap: sortTypes(append(append([]uint16{}, types...), dns.TypeRRSIG, dns.TypeNSEC)),
+	}
+}
+
+// next returns the hash right after the base32hex hash.
+func next(hash string) string {
+	enc := base32.HexEncoding.WithPadding(base32.NoPadding)
+
+	buf, err := enc.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+
+	for i := len(buf) - 1; i >= 0; i-- {
+		buf[i]++
+		if buf[i] != 0 {
+			break
+		}
+	}
+
+	return enc.EncodeToString(buf)
+}
+
+func sortTypes(types []uint16) []uint16 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
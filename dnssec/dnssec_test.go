@@ -0,0 +1,81 @@
+package dnssec
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, alg := range []uint8{dns.ECDSAP256SHA256, dns.ED25519, dns.RSASHA256} {
+		c := Config{
+			Zone:           "internal",
+			KeyFile:        filepath.Join(dir, dns.AlgorithmToString[alg]+".key"),
+			PrivateKeyFile: filepath.Join(dir, dns.AlgorithmToString[alg]+".private"),
+			Algorithm:      alg,
+		}
+
+		generated, err := Load(c)
+		if err != nil {
+			t.Fatalf("Result for %q should be success but was %v", dns.AlgorithmToString[alg], err)
+		}
+
+		// the second time around the key is read back.
+		s, err := Load(c)
+		if err != nil {
+			t.Fatalf("Result for %q should be success but was %v", dns.AlgorithmToString[alg], err)
+		}
+
+		if s.DNSKEY().KeyTag() != generated.DNSKEY().KeyTag() {
+			t.Fatalf("key for %q changed when it was loaded", dns.AlgorithmToString[alg])
+		}
+
+		a := &dns.A{Hdr: dns.RR_Header{Name: "laptop.internal.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}, A: net.ParseIP("10.0.0.7")}
+		rrs, err := s.Sign([]dns.RR{a})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rrs) != 2 {
+			t.Fatalf("unexpected signed records: %v", rrs)
+		}
+
+		if err := rrs[1].(*dns.RRSIG).Verify(s.DNSKEY(), []dns.RR{a}); err != nil {
+			t.Fatalf("signature for %q did not verify: %v", dns.AlgorithmToString[alg], err)
+		}
+	}
+
+	if _, err := Load(Config{Zone: "internal", KeyFile: filepath.Join(dir, "ED25519.key"), PrivateKeyFile: filepath.Join(dir, "missing.private")}); err == nil {
+		t.Fatal("key without a private key was loaded")
+	}
+}
+
+func TestDeny(t *testing.T) {
+	s := &Signer{zone: "internal.", nsec3: true}
+
+	nsec3 := s.Deny("missing.internal.", nil, 1).(*dns.NSEC3)
+	if !nsec3.Match("missing.internal.") || len(nsec3.TypeBitMap) != 0 {
+		t.Fatalf("NSEC3 does not prove the name has no records: %v", nsec3)
+	}
+
+	if nsec3.Match("other.internal.") || nsec3.Cover("other.internal.") {
+		t.Fatalf("NSEC3 covers other names: %v", nsec3)
+	}
+
+	s.nsec3 = false
+
+	nsec := s.Deny("Laptop.internal.", []uint16{dns.TypeA}, 1).(*dns.NSEC)
+	if nsec.Hdr.Name != "laptop.internal." || len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[0] != dns.TypeA {
+		t.Fatalf("unexpected NSEC: %v", nsec)
+	}
+}
@@ -0,0 +1,394 @@
+// Package dnstap logs the queries ldnsd is sent, and its responses, as dnstap
+// messages (https://dnstap.info) in a Frame Streams file or unix socket, which
+// dnstap collectors read. Messages are queued and written in the background;
+// when the queue is full, they are dropped and counted rather than holding up
+// answers. A collector that goes away is reconnected to, and is sent what was
+// queued in the meantime.
+package dnstap
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	contentType = "protobuf:dnstap.Dnstap"
+
+	// how long to wait before opening the output again after it failed.
+	reconnectDelay = time.Second
+	// how long a write to a collector may take before it is given up on.
+	writeTimeout = time.Second
+	// how long Close waits for the queue to be written.
+	closeTimeout = time.Second
+)
+
+// Config configures a Logger. One of Socket and File must be set.
+type Config struct {
+	// Socket is the unix socket of a collector.
+	Socket string
+	// File is written instead of a socket; it is truncated first.
+	File string
+	// Identity and Version are sent with every message.
+	Identity string
+	Version  string
+	// QueueSize is the number of messages waiting to be written; more are
+	// dropped.
+	QueueSize int
+}
+
+// Counters count the messages logged.
+type Counters struct {
+	Sent    uint64
+	Dropped uint64
+}
+
+// Logger writes dnstap messages.
+type Logger struct {
+	config Config
+	queue  chan *Dnstap
+	file   *os.File
+	done   chan struct{}
+	closed chan struct{}
+
+	mutex   sync.Mutex
+	running bool
+
+	sent    uint64
+	dropped uint64
+}
+
+// New creates a logger. The file, if there is one, is created right away; the
+// socket is connected to once the logger runs.
+func New(c Config) (*Logger, error) {
+	l := &Logger{
+		config: c,
+		queue:  make(chan *Dnstap, c.QueueSize),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+
+	if c.File != "" {
+		var err error
+		if l.file, err = os.Create(c.File); err != nil {
+			return nil, errors.Wrap(err, "while creating dnstap file")
+		}
+	}
+
+	return l, nil
+}
+
+// Counters returns the number of messages sent and dropped so far.
+func (l *Logger) Counters() Counters {
+	return Counters{
+		Sent:    atomic.LoadUint64(&l.sent),
+		Dropped: atomic.LoadUint64(&l.dropped),
+	}
+}
+
+// Log queues a message, or drops it if the queue is full.
+func (l *Logger) Log(m *Message) {
+	d := &Dnstap{
+		Type:    Dnstap_MESSAGE.Enum(),
+		Message: m,
+	}
+
+	if l.config.Identity != "" {
+		d.Identity = []byte(l.config.Identity)
+	}
+
+	if l.config.Version != "" {
+		d.Version = []byte(l.config.Version)
+	}
+
+	select {
+	case l.queue <- d:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Close writes what is queued, within reason, and stops the logger. If the
+// logger never ran, Close writes the queue itself rather than waiting for Run,
+// and Run does nothing afterwards.
+func (l *Logger) Close() {
+	l.mutex.Lock()
+	close(l.closed)
+	running := l.running
+	l.running = true
+	l.mutex.Unlock()
+
+	if !running {
+		l.run()
+		return
+	}
+
+	select {
+	case <-l.done:
+	case <-time.After(closeTimeout):
+	}
+}
+
+// Run writes the queued messages until the logger is closed, opening the
+// output again whenever it fails.
+func (l *Logger) Run() {
+	l.mutex.Lock()
+	running := l.running
+	l.running = true
+	l.mutex.Unlock()
+
+	if !running {
+		l.run()
+	}
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	var failing bool
+
+	for {
+		w, conn, err := l.open()
+		if err == nil {
+			if failing {
+				logrus.Infof("Writing dnstap messages again")
+				failing = false
+			}
+
+			err = l.write(w)
+			if err == nil {
+				w.Close()
+				conn.Close()
+				return
+			}
+
+			conn.Close()
+		}
+
+		if !failing {
+			logrus.Errorf("Error writing dnstap messages; retrying every %v: %v", reconnectDelay, err)
+			failing = true
+		}
+
+		select {
+		case <-l.closed:
+			// there is nowhere to write what is left.
+			atomic.AddUint64(&l.dropped, uint64(len(l.queue)))
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+type closer interface {
+	Close() error
+}
+
+// open opens the output: the file the first time, reopened for appending
+// after that, or a connection to the socket.
+func (l *Logger) open() (*framestream.Writer, closer, error) {
+	opts := &framestream.WriterOptions{ContentTypes: [][]byte{[]byte(contentType)}}
+
+	var conn interface {
+		closer
+		Write([]byte) (int, error)
+	}
+
+	switch {
+	case l.file != nil:
+		conn, l.file = l.file, nil
+	case l.config.File != "":
+		f, err := os.OpenFile(l.config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = f
+	default:
+		c, err := net.DialTimeout("unix", l.config.Socket, writeTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = c
+		opts.Bidirectional = true
+		opts.Timeout = writeTimeout
+	}
+
+	w, err := framestream.NewWriter(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "during frame streams handshake")
+	}
+
+	return w, conn, nil
+}
+
+// write writes the queued messages until the logger is closed, flushing
+// whenever the queue is empty.
+func (l *Logger) write(w *framestream.Writer) error {
+	for {
+		select {
+		case <-l.closed:
+			for {
+				select {
+				case d := <-l.queue:
+					if err := l.frame(w, d); err != nil {
+						return err
+					}
+				default:
+					return w.Flush()
+				}
+			}
+		case d := <-l.queue:
+			if err := l.frame(w, d); err != nil {
+				return err
+			}
+
+			if len(l.queue) == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (l *Logger) frame(w *framestream.Writer, d *Dnstap) error {
+	b, err := proto.Marshal(d)
+	if err != nil {
+		atomic.AddUint64(&l.dropped, 1)
+		logrus.Errorf("Error encoding dnstap message: %v", err)
+		return nil
+	}
+
+	if _, err := w.WriteFrame(b); err != nil {
+		atomic.AddUint64(&l.dropped, 1)
+		return err
+	}
+
+	atomic.AddUint64(&l.sent, 1)
+	return nil
+}
+
+// Handler returns a dns.Handler logging the queries it passes to next, and
+// the responses to them, as received over the protocol. A nil logger returns
+// next. Only what is written to the writer next is given is logged, so next
+// must do its rate limiting and truncation in writers wrapping it, as the
+// responder does: dropped responses are not logged, and slipped or truncated
+// ones are logged as they were sent.
+func (l *Logger) Handler(next dns.Handler, protocol SocketProtocol) dns.Handler {
+	if l == nil {
+		return next
+	}
+
+	return &handler{next: next, logger: l, protocol: protocol}
+}
+
+type handler struct {
+	next     dns.Handler
+	logger   *Logger
+	protocol SocketProtocol
+}
+
+// ServeDNS implements dns.Handler.
+func (h *handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	now := time.Now()
+
+	m := h.message(Message_CLIENT_QUERY, w, now)
+	if b, err := req.Pack(); err == nil {
+		m.QueryMessage = b
+	}
+	h.logger.Log(m)
+
+	h.next.ServeDNS(&responseWriter{ResponseWriter: w, h: h, queryTime: now}, req)
+}
+
+// message creates a message of the type about a query received at queryTime.
+func (h *handler) message(typ Message_Type, w dns.ResponseWriter, queryTime time.Time) *Message {
+	m := &Message{
+		Type:           typ.Enum(),
+		SocketProtocol: h.protocol.Enum(),
+		QueryTimeSec:   proto.Uint64(uint64(queryTime.Unix())),
+		QueryTimeNsec:  proto.Uint32(uint32(queryTime.Nanosecond())),
+	}
+
+	if ip, port := addr(w.RemoteAddr()); ip != nil {
+		m.SocketFamily = family(ip).Enum()
+		m.QueryAddress = ip
+		m.QueryPort = proto.Uint32(port)
+	}
+
+	if ip, port := addr(w.LocalAddr()); ip != nil {
+		m.ResponseAddress = ip
+		m.ResponsePort = proto.Uint32(port)
+	}
+
+	return m
+}
+
+// responseWriter logs the responses written to it.
+type responseWriter struct {
+	dns.ResponseWriter
+	h         *handler
+	queryTime time.Time
+}
+
+// WriteMsg implements dns.ResponseWriter.
+func (w *responseWriter) WriteMsg(res *dns.Msg) error {
+	if err := w.ResponseWriter.WriteMsg(res); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	m := w.h.message(Message_CLIENT_RESPONSE, w.ResponseWriter, w.queryTime)
+	m.ResponseTimeSec = proto.Uint64(uint64(now.Unix()))
+	m.ResponseTimeNsec = proto.Uint32(uint32(now.Nanosecond()))
+	if b, err := res.Pack(); err == nil {
+		m.ResponseMessage = b
+	}
+	w.h.logger.Log(m)
+
+	return nil
+}
+
+// addr returns the address and port of a client or server, with IPv4
+// addresses in their 4 byte form.
+func addr(a net.Addr) (net.IP, uint32) {
+	var (
+		ip   net.IP
+		port int
+	)
+
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if len(ip) == 0 || ip.IsUnspecified() {
+		return nil, 0
+	}
+
+	return ip, uint32(port)
+}
+
+func family(ip net.IP) SocketFamily {
+	if len(ip) == net.IPv4len {
+		return SocketFamily_INET
+	}
+
+	return SocketFamily_INET6
+}
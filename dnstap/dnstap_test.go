@@ -0,0 +1,316 @@
+package dnstap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	framestream "github.com/farsightsec/golang-framestream"
+	"github.com/golang/protobuf/proto"
+	"github.com/miekg/dns"
+)
+
+// read decodes the dnstap messages in a frame stream until it ends.
+func read(t *testing.T, r *framestream.Reader, out chan<- *Dnstap) {
+	defer close(out)
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.ReadFrame(buf)
+		if err != nil {
+			return
+		}
+
+		d := &Dnstap{}
+		if err := proto.Unmarshal(buf[:n], d); err != nil {
+			t.Error(err)
+			return
+		}
+
+		out <- d
+	}
+}
+
+func next(t *testing.T, messages <-chan *Dnstap) *Dnstap {
+	select {
+	case d, ok := <-messages:
+		if !ok {
+			t.Fatal("frame stream ended early")
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a dnstap message")
+	}
+
+	return nil
+}
+
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "dnstap.sock")
+
+	l, err := New(Config{Socket: socket, Identity: "ns1", Version: "test", QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the collector is not there yet; queries are queued until it is.
+	go l.Run()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: l.Handler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := &dns.Msg{}
+			m.SetRcode(req, dns.RcodeNameError)
+			w.WriteMsg(m)
+		}), SocketProtocol_UDP),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	m := &dns.Msg{}
+	m.SetQuestion("test.internal.", dns.TypeA)
+
+	res, err := dns.Exchange(m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected response: %v", res)
+	}
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r, err := framestream.NewReader(conn, &framestream.ReaderOptions{
+		ContentTypes:  [][]byte{[]byte(contentType)},
+		Bidirectional: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan *Dnstap)
+	go read(t, r, messages)
+
+	query, response := next(t, messages), next(t, messages)
+
+	if string(query.Identity) != "ns1" || string(query.Version) != "test" || query.GetType() != Dnstap_MESSAGE {
+		t.Fatalf("unexpected dnstap message: %v", query)
+	}
+
+	q, resp := query.Message, response.Message
+
+	if q.GetType() != Message_CLIENT_QUERY || resp.GetType() != Message_CLIENT_RESPONSE {
+		t.Fatalf("messages should be a query and a response but were %v and %v", q.GetType(), resp.GetType())
+	}
+
+	for _, msg := range []*Message{q, resp} {
+		if msg.GetSocketProtocol() != SocketProtocol_UDP || msg.GetSocketFamily() != SocketFamily_INET {
+			t.Fatalf("unexpected socket: %v %v", msg.GetSocketProtocol(), msg.GetSocketFamily())
+		}
+
+		if !net.IP(msg.QueryAddress).Equal(net.ParseIP("127.0.0.1")) || msg.GetQueryPort() == 0 {
+			t.Fatalf("unexpected client address: %v:%d", net.IP(msg.QueryAddress), msg.GetQueryPort())
+		}
+
+		if msg.GetResponsePort() != uint32(pc.LocalAddr().(*net.UDPAddr).Port) {
+			t.Fatalf("unexpected server port: %d", msg.GetResponsePort())
+		}
+
+		if msg.GetQueryTimeSec() != q.GetQueryTimeSec() || msg.GetQueryTimeNsec() != q.GetQueryTimeNsec() {
+			t.Fatal("query times differ")
+		}
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(q.QueryMessage, packed) {
+		t.Fatal("query message was not logged")
+	}
+
+	logged := &dns.Msg{}
+	if err := logged.Unpack(resp.ResponseMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	if logged.Id != m.Id || logged.Rcode != dns.RcodeNameError || resp.GetResponseTimeSec() == 0 {
+		t.Fatalf("response was not logged: %v", logged)
+	}
+
+	l.Close()
+
+	// the stream is stopped once the logger closes.
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("unexpected message after close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not stopped")
+	}
+
+	if counters := l.Counters(); counters.Sent != 2 || counters.Dropped != 0 {
+		t.Fatalf("unexpected counters: %+v", counters)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ldnsd.dnstap")
+
+	l, err := New(Config{File: file, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go l.Run()
+
+	for i := 0; i < 5; i++ {
+		l.Log(&Message{Type: Message_CLIENT_QUERY.Enum(), QueryPort: proto.Uint32(uint32(i))})
+	}
+
+	l.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := framestream.NewReader(f, &framestream.ReaderOptions{ContentTypes: [][]byte{[]byte(contentType)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan *Dnstap, 10)
+	read(t, r, messages)
+
+	var count uint32
+	for d := range messages {
+		if port := d.Message.GetQueryPort(); port != count {
+			t.Fatalf("message %d was out of order: %d", count, port)
+		}
+		count++
+	}
+
+	if count != 5 {
+		t.Fatalf("5 messages should have been written but %d were", count)
+	}
+}
+
+func TestDrops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nothing listens, so the queue fills up.
+	l, err := New(Config{Socket: filepath.Join(dir, "dnstap.sock"), QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			l.Log(&Message{Type: Message_CLIENT_QUERY.Enum()})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("logging blocked on a full queue")
+	}
+
+	if counters := l.Counters(); counters.Sent != 0 || counters.Dropped != 3 {
+		t.Fatalf("unexpected counters: %+v", counters)
+	}
+
+	go l.Run()
+	l.Close()
+
+	if counters := l.Counters(); counters.Dropped != 5 {
+		t.Fatalf("queued messages should be dropped when there is no collector, but the counters were %+v", counters)
+	}
+}
+
+func TestFileError(t *testing.T) {
+	if _, err := New(Config{File: "/nonexistent/ldnsd.dnstap", QueueSize: 1}); err == nil {
+		t.Fatal("logger was created with a file that cannot be written")
+	}
+}
+
+func TestCloseWithoutRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := New(Config{File: filepath.Join(dir, "ldnsd.dnstap"), QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Log(&Message{Type: Message_CLIENT_QUERY.Enum()})
+
+	start := time.Now()
+	l.Close()
+
+	if elapsed := time.Since(start); elapsed >= closeTimeout {
+		t.Fatalf("closing a logger that never ran took %v", elapsed)
+	}
+
+	if counters := l.Counters(); counters.Sent != 1 || counters.Dropped != 0 {
+		t.Fatalf("the queue was not written by Close: %+v", counters)
+	}
+
+	// running a closed logger does nothing.
+	done := make(chan struct{})
+	go func() {
+		l.Run()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a closed logger ran")
+	}
+}
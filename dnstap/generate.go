@@ -0,0 +1,3 @@
+package dnstap
+
+//go:generate protoc --proto_path=. --go_out=. dnstap.proto
@@ -0,0 +1,219 @@
+// Package doh serves DNS over HTTPS: the RFC 8484 wire format with GET and
+// POST, and the JSON form browsers and scripts use. Queries are answered by
+// the same handler that serves plain DNS.
+package doh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Path is the path of the RFC 8484 endpoint. It also serves the JSON form
+	// to GETs with a name parameter.
+	Path = "/dns-query"
+	// JSONPath is the path of the JSON endpoint.
+	JSONPath = "/resolve"
+
+	messageType = "application/dns-message"
+	jsonType    = "application/dns-json"
+
+	maxMessageSize = dns.MaxMsgSize
+)
+
+// Handler answers DNS-over-HTTPS requests with a dns.Handler.
+type Handler struct {
+	dns dns.Handler
+}
+
+// New returns a handler that answers queries with h.
+func New(h dns.Handler) *Handler {
+	return &Handler{dns: h}
+}
+
+// Mux returns a ServeMux with the handler on Path and JSONPath.
+func (h *Handler) Mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(Path, h)
+	mux.Handle(JSONPath, h)
+	return mux
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// an RFC 8484 query is answered as one, whatever the client accepts; the
+	// JSON form is told apart by its name parameter.
+	query := r.URL.Query()
+	asJSON := r.Method == http.MethodGet && query.Get("dns") == "" &&
+		(r.URL.Path == JSONPath || query.Get("name") != "")
+
+	var (
+		req *dns.Msg
+		err error
+	)
+
+	switch {
+	case asJSON && r.Method == http.MethodGet:
+		req, err = jsonQuery(r)
+	case r.Method == http.MethodGet:
+		req, err = getQuery(r)
+	case r.Method == http.MethodPost:
+		req, err = postQuery(r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the handler writes nothing for queries it drops, such as those of
+	// clients an ACL denies.
+	resp := h.resolve(r, req)
+	if resp == nil {
+		http.Error(w, "query refused", http.StatusForbidden)
+		return
+	}
+
+	var body []byte
+	if asJSON {
+		w.Header().Set("Content-Type", jsonType)
+		body, err = json.Marshal(toJSON(resp))
+	} else {
+		w.Header().Set("Content-Type", messageType)
+		body, err = resp.Pack()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(resp)), 10))
+	w.Write(body)
+}
+
+// resolve runs the query through the DNS handler. Zone transfers are refused;
+// they need more than one message, and HTTP carries just one.
+func (h *Handler) resolve(r *http.Request, req *dns.Msg) *dns.Msg {
+	if len(req.Question) > 0 {
+		if qt := req.Question[0].Qtype; qt == dns.TypeAXFR || qt == dns.TypeIXFR {
+			m := &dns.Msg{}
+			m.SetRcode(req, dns.RcodeRefused)
+			return m
+		}
+	}
+
+	rw := &responseWriter{remote: remoteAddr(r)}
+	h.dns.ServeDNS(rw, req)
+	return rw.msg
+}
+
+func getQuery(r *http.Request) (*dns.Msg, error) {
+	param := r.URL.Query().Get("dns")
+	if param == "" {
+		return nil, errors.New("missing dns parameter")
+	}
+
+	// RFC 8484 uses base64url without padding, but be lenient about padding.
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid dns parameter")
+	}
+
+	return unpack(buf)
+}
+
+func postQuery(r *http.Request) (*dns.Msg, error) {
+	if ct := r.Header.Get("Content-Type"); ct != messageType {
+		return nil, errors.Errorf("unsupported content type %q", ct)
+	}
+
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxMessageSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading request")
+	}
+
+	return unpack(buf)
+}
+
+func unpack(buf []byte) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	if err := req.Unpack(buf); err != nil {
+		return nil, errors.Wrap(err, "invalid dns message")
+	}
+
+	if len(req.Question) != 1 {
+		return nil, errors.New("exactly one question is required")
+	}
+
+	return req, nil
+}
+
+func jsonQuery(r *http.Request) (*dns.Msg, error) {
+	q := r.URL.Query()
+
+	name := q.Get("name")
+	if name == "" {
+		return nil, errors.New("missing name parameter")
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, errors.Errorf("invalid type %q", t)
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = q.Get("cd") == "1" || q.Get("cd") == "true"
+	return req, nil
+}
+
+// minTTL is the lowest TTL in the response, which is how long it may be
+// cached.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
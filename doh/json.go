@@ -0,0 +1,71 @@
+package doh
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Response is the JSON form of a response, as served by the common public
+// resolvers.
+type Response struct {
+	Status    int        `json:"Status"`
+	TC        bool       `json:"TC"`
+	RD        bool       `json:"RD"`
+	RA        bool       `json:"RA"`
+	AD        bool       `json:"AD"`
+	CD        bool       `json:"CD"`
+	Question  []Question `json:"Question"`
+	Answer    []Answer   `json:"Answer,omitempty"`
+	Authority []Answer   `json:"Authority,omitempty"`
+}
+
+// Question is a question in a JSON response.
+type Question struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// Answer is a record in a JSON response. Data is the record in presentation
+// format, without its header.
+type Answer struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+func toJSON(m *dns.Msg) *Response {
+	resp := &Response{
+		Status:    m.Rcode,
+		TC:        m.Truncated,
+		RD:        m.RecursionDesired,
+		RA:        m.RecursionAvailable,
+		AD:        m.AuthenticatedData,
+		CD:        m.CheckingDisabled,
+		Question:  []Question{},
+		Answer:    toAnswers(m.Answer),
+		Authority: toAnswers(m.Ns),
+	}
+
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, Question{Name: q.Name, Type: q.Qtype})
+	}
+
+	return resp
+}
+
+func toAnswers(rrs []dns.RR) []Answer {
+	answers := []Answer{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		answers = append(answers, Answer{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+
+	return answers
+}
@@ -0,0 +1,41 @@
+package doh
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// responseWriter keeps the response for the HTTP reply instead of writing it
+// to a connection.
+type responseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *responseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *responseWriter) Close() error         { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)  {}
+func (w *responseWriter) Hijack()              {}
+
+// TsigStatus implements dns.ResponseWriter. TSIG signatures are not verified
+// over HTTPS, so none are ever valid.
+func (w *responseWriter) TsigStatus() error { return dns.ErrSig }
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	if w.msg == nil {
+		w.msg = m
+	}
+
+	return nil
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+
+	return len(buf), w.WriteMsg(m)
+}
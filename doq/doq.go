@@ -0,0 +1,204 @@
+// Package doq serves DNS over QUIC (RFC 9250). Every query arrives on its own
+// stream, and is answered by the same handler that serves plain DNS.
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ALPN is the application protocol DoQ clients negotiate.
+	ALPN = "doq"
+
+	// error codes from RFC 9250 section 4.3.
+	noError       quic.ApplicationErrorCode = 0
+	protocolError quic.ApplicationErrorCode = 2
+
+	streamTimeout = 10 * time.Second
+	idleTimeout   = 30 * time.Second
+)
+
+// Server serves DNS over QUIC.
+type Server struct {
+	// Addr is the host:port to listen on.
+	Addr string
+	// Handler answers the queries.
+	Handler dns.Handler
+	// TLSConfig holds the server certificate. The DoQ ALPN is added to it.
+	TLSConfig *tls.Config
+
+	mutex    sync.Mutex
+	closed   bool
+	listener *quic.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// ListenAndServe listens on Addr and serves queries until the server is shut
+// down. If it already was, quic.ErrServerClosed is returned.
+func (s *Server) ListenAndServe() error {
+	tlsConfig := s.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{ALPN}
+
+	// the lock is held until the listener is stored, so Shutdown either sees
+	// it or keeps it from being opened.
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return quic.ErrServerClosed
+	}
+
+	l, err := quic.ListenAddr(s.Addr, tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout})
+	if err != nil {
+		s.mutex.Unlock()
+		return errors.Wrap(err, "while listening for dns-over-quic")
+	}
+
+	s.listener = l
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	ctx := s.ctx
+	s.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "while accepting dns-over-quic connection")
+		}
+
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// Shutdown stops the server and closes its connections. A server shut down
+// before it listens never does.
+func (s *Server) Shutdown() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+
+	if s.listener == nil {
+		return nil
+	}
+
+	s.cancel()
+	return s.listener.Close()
+}
+
+func (s *Server) serveConn(ctx context.Context, conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			conn.CloseWithError(noError, "")
+			return
+		}
+
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream answers the single query on a stream.
+func (s *Server) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(streamTimeout))
+
+	req, err := readQuery(stream)
+	if err != nil {
+		// an invalid query is a protocol error for the whole connection.
+		logrus.Warnf("Invalid dns-over-quic query from %v: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(protocolError, "invalid query")
+		return
+	}
+
+	s.Handler.ServeDNS(&responseWriter{conn: conn, stream: stream}, req)
+}
+
+func readQuery(r io.Reader) (*dns.Msg, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, errors.Wrap(err, "while reading query length")
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "while reading query")
+	}
+
+	req := &dns.Msg{}
+	if err := req.Unpack(buf); err != nil {
+		return nil, errors.Wrap(err, "while parsing query")
+	}
+
+	if req.Id != 0 {
+		return nil, errors.New("query ID is not zero")
+	}
+
+	return req, nil
+}
+
+// responseWriter writes length-prefixed responses to a stream. The client is
+// presented as a TCP client: like TCP, QUIC streams need no truncation, and
+// RFC 9250 allows zone transfers over them.
+type responseWriter struct {
+	conn   quic.Connection
+	stream quic.Stream
+}
+
+func (w *responseWriter) LocalAddr() net.Addr  { return tcpAddr(w.conn.LocalAddr()) }
+func (w *responseWriter) RemoteAddr() net.Addr { return tcpAddr(w.conn.RemoteAddr()) }
+func (w *responseWriter) Close() error         { return w.stream.Close() }
+func (w *responseWriter) TsigTimersOnly(bool)  {}
+func (w *responseWriter) Hijack()              {}
+
+// TsigStatus implements dns.ResponseWriter. TSIG signatures are not verified
+// over QUIC, so none are ever valid.
+func (w *responseWriter) TsigStatus() error { return dns.ErrSig }
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) {
+	if len(buf) > dns.MaxMsgSize {
+		return 0, dns.ErrBuf
+	}
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+
+	if _, err := w.stream.Write(msg); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+func tcpAddr(addr net.Addr) net.Addr {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
+	}
+
+	return addr
+}
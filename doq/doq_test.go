@@ -0,0 +1,29 @@
+package doq
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func TestShutdownBeforeListen(t *testing.T) {
+	s := &Server{Addr: "127.0.0.1:8853", Handler: dns.NewServeMux(), TLSConfig: &tls.Config{}}
+
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ListenAndServe(); err != quic.ErrServerClosed {
+		t.Fatalf("server shut down before listening served anyway: %v", err)
+	}
+
+	// nothing was left listening on the address.
+	pc, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+}
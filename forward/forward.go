@@ -0,0 +1,257 @@
+// Package forward sends queries ldnsd cannot answer itself to upstream
+// resolvers. Upstreams are tracked as queries go to them: the fastest healthy
+// upstream is tried first, and upstreams that keep failing are set aside for a
+// while, so a dead resolver does not slow every query down.
+package forward
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// an upstream is marked down after this many failures in a row.
+	maxFailures = 3
+	// how long a down upstream is set aside before it is tried again; doubled
+	// every time it fails again, up to maxDownTime.
+	minDownTime = 5 * time.Second
+	maxDownTime = 5 * time.Minute
+
+	queryTimeout = 2 * time.Second
+	// weight of the latest round trip in the smoothed round trip time.
+	rttWeight = 0.3
+)
+
+// ErrNoUpstream is returned when no upstream answered a query.
+var ErrNoUpstream = errors.New("no upstream answered")
+
+// Upstream is a resolver queries are forwarded to.
+type Upstream struct {
+	addr string
+
+	mutex     sync.Mutex
+	rtt       time.Duration
+	failures  int
+	downTime  time.Duration
+	downUntil time.Time
+}
+
+// Addr returns the host:port of the upstream.
+func (u *Upstream) Addr() string {
+	return u.addr
+}
+
+// Healthy returns false while the upstream is set aside for failing.
+func (u *Upstream) Healthy() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.healthy(time.Now())
+}
+
+func (u *Upstream) healthy(now time.Time) bool {
+	return !now.Before(u.downUntil)
+}
+
+func (u *Upstream) succeeded(rtt time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(u.rtt))
+	}
+
+	u.failures = 0
+	u.downTime = 0
+	u.downUntil = time.Time{}
+}
+
+func (u *Upstream) failed() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.failures++
+	if u.failures < maxFailures {
+		return
+	}
+
+	switch {
+	case u.downTime == 0:
+		u.downTime = minDownTime
+	case u.downTime < maxDownTime:
+		u.downTime *= 2
+		if u.downTime > maxDownTime {
+			u.downTime = maxDownTime
+		}
+	}
+
+	u.downUntil = time.Now().Add(u.downTime)
+}
+
+// Group is a set of upstreams that can answer the same queries.
+type Group struct {
+	upstreams []*Upstream
+	timeout   time.Duration
+}
+
+// NewGroup creates a group of the upstreams, which are host:port pairs.
+func NewGroup(addrs []string) *Group {
+	g := &Group{timeout: queryTimeout}
+	for _, addr := range addrs {
+		g.upstreams = append(g.upstreams, &Upstream{addr: addr})
+	}
+
+	return g
+}
+
+// Upstreams returns the upstreams in the group.
+func (g *Group) Upstreams() []*Upstream {
+	return g.upstreams
+}
+
+// order returns the upstreams in the order they should be tried: healthy ones
+// from the fastest, then the ones that are down, from the one that has been
+// set aside the longest. Upstreams with no round trip yet come first among the
+// healthy ones, so they are measured.
+func (g *Group) order() []*Upstream {
+	type state struct {
+		u         *Upstream
+		healthy   bool
+		rtt       time.Duration
+		downUntil time.Time
+	}
+
+	now := time.Now()
+	states := make([]state, len(g.upstreams))
+
+	for i, u := range g.upstreams {
+		u.mutex.Lock()
+		states[i] = state{u: u, healthy: u.healthy(now), rtt: u.rtt, downUntil: u.downUntil}
+		u.mutex.Unlock()
+	}
+
+	sort.SliceStable(states, func(i, j int) bool {
+		if states[i].healthy != states[j].healthy {
+			return states[i].healthy
+		}
+
+		if states[i].healthy {
+			return states[i].rtt < states[j].rtt
+		}
+
+		return states[i].downUntil.Before(states[j].downUntil)
+	})
+
+	ret := make([]*Upstream, len(states))
+	for i, s := range states {
+		ret[i] = s.u
+	}
+
+	return ret
+}
+
+// Exchange sends the query to the upstreams in turn until one answers.
+// Responses that are cut short are retried over TCP. SERVFAIL and REFUSED
+// count as failures of the upstream; if every upstream fails, the last such
+// response is returned.
+func (g *Group) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	var (
+		last    *dns.Msg
+		lastErr error = ErrNoUpstream
+	)
+
+	for _, u := range g.order() {
+		reply, rtt, err := g.exchange(u.addr, req)
+		if err != nil {
+			u.failed()
+			lastErr = errors.Wrapf(err, "while querying %s", u.addr)
+			continue
+		}
+
+		if reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused {
+			u.failed()
+			last = reply
+			continue
+		}
+
+		u.succeeded(rtt)
+		return reply, nil
+	}
+
+	if last != nil {
+		return last, nil
+	}
+
+	return nil, lastErr
+}
+
+func (g *Group) exchange(addr string, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	m := req.Copy()
+	m.Id = dns.Id()
+
+	reply, rtt, err := (&dns.Client{Net: "udp", Timeout: g.timeout, UDPSize: dns.DefaultMsgSize}).Exchange(m, addr)
+	if err == nil && reply.Truncated {
+		reply, rtt, err = (&dns.Client{Net: "tcp", Timeout: g.timeout}).Exchange(m, addr)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reply.Id = req.Id
+	return reply, rtt, nil
+}
+
+// Forwarder picks the upstreams for a query: the conditional forwarders of
+// the most specific zone that contains the name, or the default upstreams.
+type Forwarder struct {
+	def   *Group
+	zones map[string]*Group
+}
+
+// New creates a forwarder sending queries to the default upstreams, which are
+// host:port pairs. There may be none, if only zones are forwarded.
+func New(upstreams []string) *Forwarder {
+	f := &Forwarder{zones: map[string]*Group{}}
+	if len(upstreams) > 0 {
+		f.def = NewGroup(upstreams)
+	}
+
+	return f
+}
+
+// AddZone forwards queries for names in the zone to its own upstreams.
+func (f *Forwarder) AddZone(name string, upstreams []string) *Group {
+	g := NewGroup(upstreams)
+	f.zones[dns.Fqdn(strings.ToLower(name))] = g
+	return g
+}
+
+// Zone returns the upstreams of the most specific zone that contains name, or
+// nil if no zone does.
+func (f *Forwarder) Zone(name string) *Group {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	for {
+		if g, ok := f.zones[name]; ok {
+			return g
+		}
+
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			return nil
+		}
+		name = name[i:]
+	}
+}
+
+// Default returns the default upstreams, or nil if there are none.
+func (f *Forwarder) Default() *Group {
+	return f.def
+}
@@ -0,0 +1,157 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream starts a resolver answering every A query with the address, or
+// with the rcode if it is not successful.
+func upstream(t *testing.T, address string, rcode int) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetRcode(req, rcode)
+		if rcode == dns.RcodeSuccess {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(address),
+			}}
+		}
+		w.WriteMsg(m)
+	})
+
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+// deadUpstream returns an address nothing listens on.
+func deadUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	return pc.LocalAddr().String()
+}
+
+func query(t *testing.T, g *Group, name string) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, dns.TypeA)
+
+	reply, err := g.Exchange(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Id != m.Id {
+		t.Fatalf("reply has ID %d, not %d", reply.Id, m.Id)
+	}
+
+	return reply
+}
+
+func answer(reply *dns.Msg) string {
+	if len(reply.Answer) != 1 {
+		return ""
+	}
+
+	return reply.Answer[0].(*dns.A).A.String()
+}
+
+func TestHealth(t *testing.T) {
+	good, stop := upstream(t, "192.0.2.1", dns.RcodeSuccess)
+	defer stop()
+
+	failing, stopFailing := upstream(t, "", dns.RcodeServerFailure)
+	defer stopFailing()
+
+	dead := deadUpstream(t)
+
+	g := NewGroup([]string{dead, failing, good})
+	g.timeout = 500 * time.Millisecond
+
+	for i := 0; i < maxFailures; i++ {
+		if a := answer(query(t, g, "example.com.")); a != "192.0.2.1" {
+			t.Fatalf("query %d was answered with %q", i, a)
+		}
+	}
+
+	for _, u := range g.Upstreams() {
+		if u.Healthy() != (u.Addr() == good) {
+			t.Fatalf("health of %s is %v after %d queries", u.Addr(), u.Healthy(), maxFailures)
+		}
+	}
+
+	if order := g.order(); order[0].Addr() != good {
+		t.Fatalf("%s is tried before the healthy upstream", order[0].Addr())
+	}
+
+	// with every upstream failing, the failure is passed on.
+	g = NewGroup([]string{dead, failing})
+	g.timeout = 500 * time.Millisecond
+
+	if reply := query(t, g, "example.com."); reply.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("failing upstreams were answered with %s", dns.RcodeToString[reply.Rcode])
+	}
+
+	g = NewGroup([]string{dead})
+	g.timeout = 500 * time.Millisecond
+
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	if _, err := g.Exchange(m); err == nil {
+		t.Fatal("exchange with a dead upstream succeeded")
+	}
+
+	u := g.Upstreams()[0]
+	for i := 0; i < maxFailures; i++ {
+		u.failed()
+	}
+
+	if u.downTime != 2*minDownTime {
+		t.Fatalf("down time did not back off: %v", u.downTime)
+	}
+
+	u.succeeded(time.Millisecond)
+	if !u.Healthy() || u.downTime != 0 {
+		t.Fatal("upstream was not healthy after answering")
+	}
+}
+
+func TestZones(t *testing.T) {
+	f := New([]string{"127.0.0.1:53"})
+	corp := f.AddZone("corp.example.com", []string{"10.0.0.2:53"})
+	lab := f.AddZone("Lab.Corp.Example.com.", []string{"10.0.0.3:53"})
+
+	table := map[string]*Group{
+		"corp.example.com.":         corp,
+		"host.corp.example.com.":    corp,
+		"host.lab.corp.example.com": lab,
+		"HOST.LAB.CORP.EXAMPLE.COM": lab,
+		"example.com.":              nil,
+		"notcorp.example.com.":      nil,
+		"com.":                      nil,
+		".":                         nil,
+	}
+
+	for name, result := range table {
+		if g := f.Zone(name); g != result {
+			t.Fatalf("Result for %q should be %v but was %v", name, result, g)
+		}
+	}
+
+	if f.Default() == nil || New(nil).Default() != nil {
+		t.Fatal("default upstreams are not set from the upstreams")
+	}
+}
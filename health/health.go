@@ -0,0 +1,220 @@
+// Package health checks the addresses of records that have a health check, so
+// addresses that are down can be left out of answers. Every address is checked
+// on an interval; it is down from the first check it fails until the first one
+// it passes. Addresses that have not been checked yet count as up.
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const checkTimeout = 2 * time.Second
+
+// target is an address checked with a check.
+type target struct {
+	check string
+	addr  string
+}
+
+// Checker runs the health checks of the records in a database.
+type Checker struct {
+	db       *dnsdb.DB
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	client   *http.Client
+
+	mutex sync.RWMutex
+	down  map[target]bool
+}
+
+// New creates a checker for the records in db, checking every address each
+// interval.
+func New(db *dnsdb.DB, interval time.Duration) *Checker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Checker{
+		db:       db,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		down:     map[target]bool{},
+		client: &http.Client{
+			Timeout: checkTimeout,
+			// a redirect is an answer; where it leads is not our concern.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// Close stops the checker.
+func (c *Checker) Close() {
+	c.cancel()
+}
+
+// Run checks the records until the checker is closed.
+func (c *Checker) Run() {
+	for {
+		c.checkAll()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// Healthy returns false if the address failed its last check.
+func (c *Checker) Healthy(check string, ip net.IP) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return !c.down[target{check: check, addr: ip.String()}]
+}
+
+// Down returns the addresses of the record that failed their last check.
+func (c *Checker) Down(r *dnsdb.Record) []net.IP {
+	down := []net.IP{}
+	if r.Check == "" {
+		return down
+	}
+
+	for _, ip := range r.IPs() {
+		if !c.Healthy(r.Check, ip) {
+			down = append(down, ip)
+		}
+	}
+
+	return down
+}
+
+// Filter returns the addresses of the record that are up, or all of them if
+// every one is down; answering with addresses that may be down beats not
+// answering at all.
+func (c *Checker) Filter(r *dnsdb.Record) []net.IP {
+	ips := r.IPs()
+	if r.Check == "" {
+		return ips
+	}
+
+	up := []net.IP{}
+	for _, ip := range ips {
+		if c.Healthy(r.Check, ip) {
+			up = append(up, ip)
+		}
+	}
+
+	if len(up) == 0 {
+		return ips
+	}
+
+	return up
+}
+
+// checkAll checks every address of every record with a health check, at the
+// same time, and forgets the addresses that are no longer checked.
+func (c *Checker) checkAll() {
+	records, _, err := c.db.Records()
+	if err != nil {
+		logrus.Errorf("Error reading records for health checks: %v", err)
+		return
+	}
+
+	targets := map[target]*dnsdb.HealthCheck{}
+	for _, r := range records {
+		if r.Check == "" {
+			continue
+		}
+
+		hc, err := dnsdb.ParseCheck(r.Check)
+		if err != nil {
+			// records are validated when they are written.
+			continue
+		}
+
+		for _, ip := range r.IPs() {
+			targets[target{check: r.Check, addr: ip.String()}] = hc
+		}
+	}
+
+	results := map[target]bool{}
+	var (
+		wg          sync.WaitGroup
+		resultMutex sync.Mutex
+	)
+
+	for t, hc := range targets {
+		wg.Add(1)
+		go func(t target, hc *dnsdb.HealthCheck) {
+			defer wg.Done()
+
+			err := c.check(t.addr, hc)
+
+			resultMutex.Lock()
+			results[t] = err != nil
+			resultMutex.Unlock()
+
+			if err != nil {
+				logrus.Debugf("Health check %s of %s failed: %v", t.check, t.addr, err)
+			}
+		}(t, hc)
+	}
+
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for t, down := range results {
+		switch {
+		case down && !c.down[t]:
+			logrus.Warnf("%s is down: health check %s failed", t.addr, t.check)
+		case !down && c.down[t]:
+			logrus.Infof("%s is up again: health check %s passed", t.addr, t.check)
+		}
+	}
+
+	c.down = results
+}
+
+// check returns an error if the address fails the health check.
+func (c *Checker) check(addr string, hc *dnsdb.HealthCheck) error {
+	hostport := net.JoinHostPort(addr, strconv.Itoa(hc.Port))
+
+	switch hc.Protocol {
+	case "http":
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, "http://"+hostport+hc.Path, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return errors.Errorf("status %d", resp.StatusCode)
+		}
+
+		return nil
+	default:
+		conn, err := (&net.Dialer{Timeout: checkTimeout}).DialContext(c.ctx, "tcp", hostport)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package health
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+)
+
+// port returns the port of a host:port.
+func port(t *testing.T, hostport string) string {
+	_, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func ips(list []net.IP) string {
+	s := []string{}
+	for _, ip := range list {
+		s = append(s, ip.String())
+	}
+
+	return strings.Join(s, ",")
+}
+
+func TestChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := dnsdb.New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// only 127.0.0.1 listens; 127.0.0.2 refuses connections on the same port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	records := map[string]*dnsdb.Record{
+		"tcp":       {Host: "tcp", Address: "127.0.0.1,127.0.0.2", Check: "tcp:" + port(t, l.Addr().String())},
+		"http":      {Host: "http", Address: "127.0.0.1,127.0.0.2", Check: "http:" + port(t, srv.Listener.Addr().String()) + "/healthz"},
+		"http-fail": {Host: "http-fail", Address: "127.0.0.1", Check: "http:" + port(t, srv.Listener.Addr().String()) + "/broken"},
+		"unchecked": {Host: "unchecked", Address: "127.0.0.2"},
+	}
+
+	for _, r := range records {
+		if err := db.SetRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := New(db, time.Hour)
+
+	// nothing has been checked yet, so everything is up.
+	for name, r := range records {
+		if down := c.Down(r); len(down) != 0 {
+			t.Fatalf("%q was down before it was checked: %v", name, down)
+		}
+	}
+
+	c.checkAll()
+
+	table := map[string]struct {
+		down   string
+		served string
+	}{
+		"tcp":       {down: "127.0.0.2", served: "127.0.0.1"},
+		"http":      {down: "127.0.0.2", served: "127.0.0.1"},
+		"http-fail": {down: "127.0.0.1", served: "127.0.0.1"},
+		"unchecked": {down: "", served: "127.0.0.2"},
+	}
+
+	for name, result := range table {
+		if down := ips(c.Down(records[name])); down != result.down {
+			t.Fatalf("Result for %q should be %q down but was %q", name, result.down, down)
+		}
+
+		if served := ips(c.Filter(records[name])); served != result.served {
+			t.Fatalf("Result for %q should be %q served but was %q", name, result.served, served)
+		}
+	}
+
+	// addresses come back up, and are forgotten once they are no longer
+	// checked.
+	records["tcp"].Check = "tcp:" + port(t, srv.Listener.Addr().String())
+	if err := db.Apply([]*dnsdb.Record{records["tcp"]}, []*dnsdb.Record{records["http-fail"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.checkAll()
+
+	if down := ips(c.Down(records["tcp"])); down != "127.0.0.2" {
+		t.Fatalf("127.0.0.2 should still be down, but %q is", down)
+	}
+
+	if !c.Healthy(records["http-fail"].Check, net.ParseIP("127.0.0.1")) {
+		t.Fatal("deleted record was still down")
+	}
+
+	l.Close()
+	srv.Close()
+	c.checkAll()
+
+	if served := ips(c.Filter(records["http"])); served != "127.0.0.1,127.0.0.2" {
+		t.Fatalf("every address should be served when all are down, but %q was", served)
+	}
+}
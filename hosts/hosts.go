@@ -0,0 +1,108 @@
+// Package hosts reads and writes /etc/hosts formatted files in terms of
+// ldnsd records.
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/pkg/errors"
+)
+
+// LineError is an error tied to a specific line of a hosts file.
+type LineError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (le *LineError) Error() string {
+	return fmt.Sprintf("line %d (%q): %v", le.Line, le.Text, le.Err)
+}
+
+// Parse reads a hosts file from r and returns the records within it. Names
+// ending in the domain have the domain stripped, and every alias on a line
+// produces its own record; repeated names are only returned once. Lines that
+// fail validation are returned as *LineError in the error list and are not
+// included in the records.
+func Parse(r io.Reader, domain string) ([]*dnsdb.Record, []error) {
+	var (
+		records = []*dnsdb.Record{}
+		errs    = []error{}
+		suffix  = "." + strings.Trim(strings.ToLower(domain), ".")
+		scanner = bufio.NewScanner(r)
+		seen    = map[string]*dnsdb.Record{}
+		lineNo  int
+	)
+
+	for scanner.Scan() {
+		lineNo++
+		text := scanner.Text()
+
+		line := text
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) == 1 {
+			errs = append(errs, &LineError{Line: lineNo, Text: text, Err: errors.New("address has no names")})
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(name), "."), suffix)
+
+			r := &dnsdb.Record{Host: name, Address: fields[0]}
+			if err := r.Validate(); err != nil {
+				errs = append(errs, &LineError{Line: lineNo, Text: text, Err: errors.Wrapf(err, "name %q", name)})
+				continue
+			}
+
+			if prev, ok := seen[name]; ok {
+				if prev.Address != r.Address {
+					errs = append(errs, &LineError{Line: lineNo, Text: text, Err: errors.Errorf("name %q was already defined as %s", name, prev.Address)})
+				}
+				continue
+			}
+
+			seen[name] = r
+			records = append(records, r)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, errors.Wrap(err, "while reading hosts file"))
+	}
+
+	return records, errs
+}
+
+// Write renders the records to w in hosts format. Each record is written with
+// its fully qualified name first and the bare host as an alias, once for every
+// address it has.
+func Write(w io.Writer, domain string, records []*dnsdb.Record) error {
+	domain = strings.Trim(domain, ".")
+
+	sorted := make([]*dnsdb.Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+
+	for _, r := range sorted {
+		for _, addr := range strings.Split(r.Address, ",") {
+			if _, err := fmt.Fprintf(w, "%s\t%s.%s %s\n", addr, r.Host, domain, r.Host); err != nil {
+				return errors.Wrap(err, "while writing hosts file")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package hosts
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/erikh/ldnsd/dnsdb"
+)
+
+const testHosts = `# a comment
+127.0.0.1	localhost
+::1	localhost ip6-localhost
+
+10.0.0.1 gateway.internal gateway gw # the router
+10.0.0.2 ntp.internal.
+10.0.0.3
+10.0.0.4 Bad_Name
+10.0.0.5 gw
+`
+
+func TestParse(t *testing.T) {
+	records, errs := Parse(strings.NewReader(testHosts), "internal")
+
+	expected := map[string]string{
+		"localhost": "127.0.0.1",
+		"gateway":   "10.0.0.1",
+		"gw":        "10.0.0.1",
+		"ntp":       "10.0.0.2",
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	for _, r := range records {
+		if expected[r.Host] != r.Address {
+			t.Fatalf("record %q had address %q, expected %q", r.Host, r.Address, expected[r.Host])
+		}
+	}
+
+	lines := map[int]struct{}{}
+	for _, err := range errs {
+		le, ok := err.(*LineError)
+		if !ok {
+			t.Fatalf("error was not a line error: %v", err)
+		}
+		lines[le.Line] = struct{}{}
+	}
+
+	for _, line := range []int{3, 7, 8, 9} {
+		if _, ok := lines[line]; !ok {
+			t.Fatalf("line %d was not reported as an error", line)
+		}
+	}
+
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines in error, got %d", len(lines))
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	records := []*dnsdb.Record{
+		{Host: "web", Address: "10.0.0.5"},
+		{Host: "db", Address: "10.0.0.6"},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := Write(buf, "internal", records); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "10.0.0.6\tdb.internal db\n10.0.0.5\tweb.internal web\n" {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+
+	parsed, errs := Parse(buf, "internal")
+	if len(errs) != 0 {
+		t.Fatalf("errors re-parsing output: %v", errs)
+	}
+
+	if len(parsed) != 2 {
+		t.Fatalf("expected 2 records after parse, got %d", len(parsed))
+	}
+}
@@ -1,20 +1,41 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/erikh/ldnsd/config"
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/dnstap"
+	"github.com/erikh/ldnsd/doh"
+	"github.com/erikh/ldnsd/doq"
 	"github.com/erikh/ldnsd/proto"
 	"github.com/erikh/ldnsd/service"
+	framestream "github.com/farsightsec/golang-framestream"
+	protobuf "github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func init() {
@@ -42,9 +63,12 @@ func msgClient(fqdn string) (*dns.Msg, error) {
 }
 
 func startService() (*service.Service, error) {
-	c := config.Empty()
+	return startServiceWithConfig(config.Empty())
+}
+
+func startServiceWithConfig(c *config.Config) (*service.Service, error) {
 	c.DBFile = "test.db"
-	c.DNSListen = defaultDNSListen
+	c.DNSListen = config.Listeners{{Address: defaultDNSListen}}
 
 	srv, err := service.New("test-ldnsd", c)
 	if err != nil {
@@ -307,3 +331,2589 @@ func TestProtoRecordValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestApply(t *testing.T) {
+	srv, err := startService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "old", Address: "1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Apply(context.Background(), &proto.Changes{
+		Set: []*proto.Record{
+			{Host: "new", Address: "1.2.3.5"},
+			{Host: "bad", Address: "fe80::1"},
+		},
+		Delete: []*proto.Record{{Host: "old"}},
+	})
+	if err == nil {
+		t.Fatal("apply with an invalid record succeeded")
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Records) != 1 || list.Records[0].Host != "old" {
+		t.Fatalf("failed apply modified the table: %v", list.Records)
+	}
+
+	_, err = client.Apply(context.Background(), &proto.Changes{
+		Set: []*proto.Record{
+			{Host: "new", Address: "1.2.3.5"},
+			{Host: "old", Address: "1.2.3.6"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := msgClient("old.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.ParseIP("1.2.3.6")) {
+		t.Fatalf("record was not updated by apply: %v", m.Answer)
+	}
+
+	_, err = client.Apply(context.Background(), &proto.Changes{Delete: []*proto.Record{{Host: "old"}, {Host: "new"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err = client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Records) != 0 {
+		t.Fatalf("records remained after deletion: %v", list.Records)
+	}
+}
+
+func TestStaticRecords(t *testing.T) {
+	c := config.Empty()
+	c.Records = []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.1"}}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := msgClient("gateway.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("static record was not served: %v", m.Answer)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "gateway", Address: "10.0.0.2"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("setting a static record was not rejected: %v", err)
+	}
+
+	if _, err := client.DeleteA(context.Background(), &proto.Record{Host: "gateway"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("deleting a static record was not rejected: %v", err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "dynamic", Address: "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(list.Records))
+	}
+
+	for _, record := range list.Records {
+		if record.Static != (record.Host == "gateway") {
+			t.Fatalf("record %q had the wrong static flag", record.Host)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	srv, err := startService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &proto.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// give the server a moment to subscribe before we generate events
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "watched", Address: "1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.DeleteA(context.Background(), &proto.Record{Host: "watched"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Type != proto.Event_SET || first.Record.Host != "watched" || first.Record.Address != "1.2.3.4" {
+		t.Fatalf("unexpected first event: %v", first)
+	}
+
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Type != proto.Event_DELETE || second.Record.Host != "watched" || second.Revision <= first.Revision {
+		t.Fatalf("unexpected second event: %v", second)
+	}
+
+	resumed, err := client.Watch(ctx, &proto.WatchRequest{Revision: first.Revision})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := resumed.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Revision != second.Revision {
+		t.Fatalf("resumed watch started at revision %d instead of %d", e.Revision, second.Revision)
+	}
+
+	// 0 is the revision of the empty journal the changes were made to.
+	pinned, err := client.Watch(ctx, &proto.WatchRequest{Revision: 0, Pinned: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = pinned.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Revision != first.Revision {
+		t.Fatalf("pinned watch started at revision %d instead of %d", e.Revision, first.Revision)
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Revision != second.Revision {
+		t.Fatalf("list revision was %d instead of %d", list.Revision, second.Revision)
+	}
+
+	future, err := client.Watch(ctx, &proto.WatchRequest{Revision: second.Revision + 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := future.Recv(); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("watch from the future did not fail properly: %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := config.Empty()
+	// static records are the primary's own, and are not replicated.
+	c.Records = []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.254"}}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	primary, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := primary.SetA(context.Background(), &proto.Record{Host: "before", Address: "1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		secondaryGRPC = "localhost:7848"
+		secondaryDNS  = "127.0.0.1:5301"
+	)
+
+	c = config.Empty()
+	c.DBFile = "test-secondary.db"
+	c.GRPCListen = secondaryGRPC
+	c.DNSListen = config.Listeners{{Address: secondaryDNS}}
+	c.Primary = &config.Primary{
+		Host: config.DefaultGRPCListen,
+		Certificate: config.Certificate{
+			CAFile:   defaultCAFile,
+			CertFile: defaultCertFile,
+			KeyFile:  defaultKeyFile,
+		},
+	}
+
+	secondarySrv, err := service.New("test-ldnsd-secondary", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test-secondary.db")
+	defer secondarySrv.Shutdown()
+
+	go secondarySrv.Boot()
+
+	if _, err := primary.SetA(context.Background(), &proto.Record{Host: "after", Address: "1.2.3.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := primary.DeleteA(context.Background(), &proto.Record{Host: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err := proto.NewClient(secondaryGRPC, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list *proto.Records
+
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		list, err = secondary.ListA(context.Background(), &empty.Empty{})
+		if err != nil {
+			continue
+		}
+
+		if len(list.Records) == 1 && list.Records[0].Host == "after" {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Records) != 1 || list.Records[0].Host != "after" || list.Records[0].Address != "1.2.3.5" {
+		t.Fatalf("secondary did not converge with the primary: %v", list.Records)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("after.internal.", dns.TypeA)
+	m, err = dns.Exchange(m, secondaryDNS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.ParseIP("1.2.3.5")) {
+		t.Fatalf("secondary did not serve the replicated record: %v", m.Answer)
+	}
+
+	_, err = secondary.SetA(context.Background(), &proto.Record{Host: "rejected", Address: "1.2.3.6"})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), config.DefaultGRPCListen) {
+		t.Fatalf("secondary did not reject a mutation with a pointer to the primary: %v", err)
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	c := config.Empty()
+	c.Transfer.Allow = []string{"127.0.0.1"}
+	c.Records = []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.1"}}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := client.SetA(context.Background(), &proto.Record{Host: fmt.Sprintf("host%d", i), Address: "1.2.3.4"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("internal.", dns.TypeSOA)
+	soaReply, err := dns.Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(soaReply.Answer) != 1 || soaReply.Answer[0].(*dns.SOA).Serial != 1000 {
+		t.Fatalf("unexpected SOA reply: %v", soaReply.Answer)
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr("internal.")
+
+	tr := &dns.Transfer{}
+	envelopes, err := tr.In(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rrs := []dns.RR{}
+	for env := range envelopes {
+		if env.Error != nil {
+			t.Fatal(env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	// SOA, 1000 records, the static record, and the SOA again
+	if len(rrs) != 1003 {
+		t.Fatalf("expected 1003 records in transfer, got %d", len(rrs))
+	}
+
+	if rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("transfer was not bracketed by SOA records")
+	}
+
+	// over UDP, transfers are refused.
+	m = new(dns.Msg)
+	m.SetAxfr("internal.")
+	reply, err := dns.Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Rcode != dns.RcodeRefused {
+		t.Fatalf("transfer over UDP was not refused: %v", reply)
+	}
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	srv, err := startService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	m := new(dns.Msg)
+	m.SetAxfr("internal.")
+
+	tr := &dns.Transfer{}
+	envelopes, err := tr.In(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for env := range envelopes {
+		if env.Error == nil {
+			t.Fatal("zone transfer was not refused without an allow list")
+		}
+	}
+}
+
+func TestIncrementalTransferAndNotify(t *testing.T) {
+	const notifyListen = "127.0.0.1:5399"
+
+	notifies := make(chan *dns.Msg, 10)
+	notifySrv := &dns.Server{Addr: notifyListen, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		notifies <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go notifySrv.ListenAndServe()
+	defer notifySrv.Shutdown()
+
+	c := config.Empty()
+	c.Transfer.Allow = []string{"127.0.0.1"}
+	c.Transfer.Notify = []string{notifyListen}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"one", "two", "three"} {
+		if _, err := client.SetA(context.Background(), &proto.Record{Host: host, Address: "1.2.3.4"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case m := <-notifies:
+		if m.Opcode != dns.OpcodeNotify || m.Question[0].Name != "internal." {
+			t.Fatalf("unexpected notify: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no NOTIFY was sent")
+	}
+
+	select {
+	case <-notifies:
+		t.Fatal("burst of changes was not coalesced into one NOTIFY")
+	case <-time.After(2 * time.Second):
+	}
+
+	// serial is now 3; change one record, delete another, and add a third.
+	_, err = client.Apply(context.Background(), &proto.Changes{
+		Set:    []*proto.Record{{Host: "one", Address: "1.2.3.5"}, {Host: "four", Address: "1.2.3.6"}},
+		Delete: []*proto.Record{{Host: "two"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetIxfr("internal.", 3, "ns.internal.", "hostmaster.internal.")
+
+	tr := &dns.Transfer{}
+	envelopes, err := tr.In(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rrs := []dns.RR{}
+	for env := range envelopes {
+		if env.Error != nil {
+			t.Fatal(env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	// SOA 6, SOA 3, -one, -two, SOA 6, +four, +one, SOA 6
+	if len(rrs) != 8 {
+		t.Fatalf("unexpected incremental transfer: %v", rrs)
+	}
+
+	expected := []string{"internal.", "internal.", "one.internal.", "two.internal.", "internal.", "four.internal.", "one.internal.", "internal."}
+	for i, rr := range rrs {
+		if rr.Header().Name != expected[i] {
+			t.Fatalf("record %d was %v, expected %q", i, rr, expected[i])
+		}
+	}
+
+	if rrs[1].(*dns.SOA).Serial != 3 || rrs[0].(*dns.SOA).Serial != 6 {
+		t.Fatalf("unexpected serials in incremental transfer: %v", rrs)
+	}
+
+	if !rrs[2].(*dns.A).A.Equal(net.ParseIP("1.2.3.4")) || !rrs[6].(*dns.A).A.Equal(net.ParseIP("1.2.3.5")) {
+		t.Fatalf("changed record was not deleted and re-added: %v", rrs)
+	}
+
+	// a client that is up to date just gets the SOA.
+	m = new(dns.Msg)
+	m.SetIxfr("internal.", 6, "ns.internal.", "hostmaster.internal.")
+
+	tr = &dns.Transfer{}
+	envelopes, err = tr.In(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rrs = []dns.RR{}
+	for env := range envelopes {
+		if env.Error != nil {
+			t.Fatal(env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+
+	if len(rrs) != 1 || rrs[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("unexpected reply for an up to date client: %v", rrs)
+	}
+}
+
+func TestExternalZone(t *testing.T) {
+	const primaryListen = "127.0.0.1:5398"
+
+	var (
+		mutex  sync.Mutex
+		serial uint32 = 1
+		addr          = "10.0.0.1"
+	)
+
+	zone := func() []dns.RR {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		soa, _ := dns.NewRR(fmt.Sprintf("lab.internal. 60 IN SOA ns.lab.internal. hostmaster.lab.internal. %d 3600 600 86400 60", serial))
+		a, _ := dns.NewRR(fmt.Sprintf("www.lab.internal. 60 IN A %s", addr))
+		txt, _ := dns.NewRR(`lab.internal. 60 IN TXT "mastered elsewhere"`)
+		return []dns.RR{soa, a, txt, soa}
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		rrs := zone()
+
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			ch := make(chan *dns.Envelope, 1)
+			ch <- &dns.Envelope{RR: rrs}
+			close(ch)
+			(&dns.Transfer{}).Out(w, r, ch)
+		default:
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = rrs[:1]
+			w.WriteMsg(m)
+		}
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		primary := &dns.Server{Addr: primaryListen, Net: network, Handler: handler}
+		go primary.ListenAndServe()
+		defer primary.Shutdown()
+	}
+
+	c := config.Empty()
+	c.Zones = []*config.Zone{{Name: "lab.internal", Primaries: []string{primaryListen}}}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	lookup := func(expected string) {
+		for i := 0; i < 50; i++ {
+			msg, err := msgClient("www.lab.internal.")
+			if err == nil && msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 1 && msg.Answer[0].(*dns.A).A.String() == expected {
+				if !msg.Authoritative {
+					t.Fatal("transferred zone was not served authoritatively")
+				}
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		t.Fatalf("www.lab.internal. never resolved to %s", expected)
+	}
+
+	lookup("10.0.0.1")
+
+	msg, err := msgClient("missing.lab.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 1 {
+		t.Fatalf("unexpected reply for a missing name: %v", msg)
+	}
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.SetA(context.Background(), &proto.Record{Host: "lab", Address: "1.2.3.4"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("mutation of a transferred zone was not rejected: %v", err)
+	}
+
+	// the primary changes and tells us about it.
+	mutex.Lock()
+	serial, addr = 2, "10.0.0.2"
+	mutex.Unlock()
+
+	m := new(dns.Msg)
+	m.SetNotify("lab.internal.")
+	reply, err := dns.Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		t.Fatalf("NOTIFY was not accepted: %v", reply)
+	}
+
+	lookup("10.0.0.2")
+}
+
+func TestCluster(t *testing.T) {
+	const nodes = 3
+
+	dir, err := ioutil.TempDir("", "ldnsd-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	peers := []*config.Peer{}
+	for i := 0; i < nodes; i++ {
+		peers = append(peers, &config.Peer{ID: fmt.Sprintf("node%d", i), Address: fmt.Sprintf("127.0.0.1:%d", 7860+i)})
+	}
+
+	clients := []proto.DNSControlClient{}
+	dnsAddrs := []string{}
+
+	for i := 0; i < nodes; i++ {
+		c := config.Empty()
+		c.DBFile = filepath.Join(dir, fmt.Sprintf("node%d.db", i))
+		c.DNSListen = config.Listeners{{Address: fmt.Sprintf("127.0.0.1:%d", 5310+i)}}
+		c.GRPCListen = fmt.Sprintf("localhost:%d", 7850+i)
+		c.Cluster = &config.Cluster{
+			ID:     peers[i].ID,
+			Listen: peers[i].Address,
+			Dir:    filepath.Join(dir, peers[i].ID),
+			Peers:  peers,
+		}
+
+		srv, err := service.New("test-ldnsd", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Boot()
+		defer srv.Shutdown()
+
+		client, err := proto.NewClient(c.GRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clients = append(clients, client)
+		dnsAddrs = append(dnsAddrs, c.DNSListen[0].Address)
+	}
+
+	var leader string
+	for i := 0; i < 100 && leader == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+
+		s, err := clients[0].ClusterStatus(context.Background(), &empty.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leader = s.Leader
+		if len(s.Peers) != nodes {
+			t.Fatalf("unexpected peers: %v", s.Peers)
+		}
+	}
+
+	if leader == "" {
+		t.Fatal("no leader was elected")
+	}
+
+	// writes are accepted on every node, leader or not.
+	for i, client := range clients {
+		host := fmt.Sprintf("host%d", i)
+		if _, err := client.SetA(context.Background(), &proto.Record{Host: host, Address: fmt.Sprintf("10.0.0.%d", i+1)}); err != nil {
+			t.Fatalf("write through node%d (leader is %s) failed: %v", i, leader, err)
+		}
+	}
+
+	if _, err := clients[1].SetA(context.Background(), &proto.Record{Host: "host0", Address: "10.0.0.9"}); status.Code(err) != codes.Aborted {
+		t.Fatalf("creating an existing record through a follower did not fail: %v", err)
+	}
+
+	for _, addr := range dnsAddrs {
+		for i := 0; i < nodes; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion(fmt.Sprintf("host%d.internal.", i), dns.TypeA)
+
+			var resolved bool
+			for try := 0; try < 50 && !resolved; try++ {
+				reply, err := dns.Exchange(m, addr)
+				resolved = err == nil && len(reply.Answer) == 1 && reply.Answer[0].(*dns.A).A.Equal(net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)))
+				if !resolved {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+
+			if !resolved {
+				t.Fatalf("host%d did not resolve on %s", i, addr)
+			}
+		}
+	}
+
+	// every node applied the same changes in the same order.
+	for i, client := range clients {
+		records, err := client.ListA(context.Background(), &empty.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if records.Revision != nodes {
+			t.Fatalf("node%d is at revision %d, not %d", i, records.Revision, nodes)
+		}
+	}
+}
+
+func TestNewFailureCleansUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Remove("test.db")
+
+	c := config.Empty()
+	c.DBFile = "test.db"
+	c.Cluster = &config.Cluster{
+		ID:     "node0",
+		Listen: "127.0.0.1:7870",
+		Dir:    filepath.Join(dir, "node0"),
+		Peers:  []*config.Peer{{ID: "node0", Address: "127.0.0.1:7870"}},
+	}
+
+	// the cluster node and the grpc listener exist by the time this fails.
+	c.DoTListen = "127.0.0.1:8530"
+	c.DoTCertificate = &config.Certificate{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")}
+
+	if _, err := service.New("test-ldnsd", c); err == nil {
+		t.Fatal("service was created with a missing dns-over-tls certificate")
+	}
+
+	c.DoTListen = ""
+	c.DoTCertificate = nil
+
+	srv, err := service.New("test-ldnsd", c)
+	if err != nil {
+		t.Fatalf("service could not be created after a failed attempt: %v", err)
+	}
+	srv.Shutdown()
+}
+
+func TestTCPAndEDNS0(t *testing.T) {
+	srv, err := startService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "foo", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("foo.internal.", dns.TypeA)
+
+	reply, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected answer over TCP: %v", reply)
+	}
+
+	m.SetEdns0(1232, false)
+	reply, _, err = (&dns.Client{Net: "udp"}).Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reply.Answer) != 1 || reply.IsEdns0() == nil || reply.Truncated {
+		t.Fatalf("unexpected answer to an EDNS0 query: %v", reply)
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	const dotListen = "127.0.0.1:8530"
+
+	c := config.Empty()
+	c.DoTListen = dotListen
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "laptop", Address: "10.0.0.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := ioutil.ReadFile(defaultCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	m := new(dns.Msg)
+	m.SetQuestion("laptop.internal.", dns.TypeA)
+
+	// no client certificate is needed.
+	dc := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}}
+	reply, _, err := dc.Exchange(m, dotListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.7")) {
+		t.Fatalf("unexpected answer over TLS: %v", reply)
+	}
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	const dohListen = "127.0.0.1:8443"
+
+	c := config.Empty()
+	c.DoHListen = dohListen
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "laptop", Address: "10.0.0.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := ioutil.ReadFile(defaultCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	base := "https://" + dohListen
+
+	m := new(dns.Msg)
+	m.SetQuestion("laptop.internal.", dns.TypeA)
+	m.Id = 0
+
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(resp *http.Response, err error) {
+		t.Helper()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("unexpected response: %v %v", resp.Status, resp.Header)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.7")) {
+			t.Fatalf("unexpected answer over HTTPS: %v", reply)
+		}
+	}
+
+	check(hc.Get(base + doh.Path + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)))
+	check(hc.Post(base+doh.Path, "application/dns-message", bytes.NewReader(buf)))
+
+	// clients that also accept JSON still get an answer to their RFC 8484 query.
+	req, err := http.NewRequest(http.MethodGet, base+doh.Path+"?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/dns-json, application/dns-message")
+	check(hc.Do(req))
+
+	resp, err := hc.Get(base + doh.JSONPath + "?name=laptop.internal&type=A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	res := &doh.Response{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].Data != "10.0.0.7" || res.Answer[0].Type != dns.TypeA {
+		t.Fatalf("unexpected JSON answer: %+v", res)
+	}
+
+	resp, err = hc.Get(base + doh.Path + "?dns=!!!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid query was answered with %v", resp.Status)
+	}
+
+	// clients the ACL drops are forbidden, not served an error.
+	c = config.Empty()
+	c.ACL = config.ACL{Deny: []string{"127.0.0.1"}, Action: config.ACLDrop}
+	if err := srv.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = hc.Get(base + doh.Path + "?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dropped query was answered with %v", resp.Status)
+	}
+}
+
+func doqExchange(conn quic.Connection, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stream.Write(append([]byte{byte(len(buf) >> 8), byte(len(buf))}, buf...)); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	resp, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 2 || int(resp[0])<<8|int(resp[1]) != len(resp)-2 {
+		return nil, fmt.Errorf("invalid response length: %v", resp)
+	}
+
+	reply := new(dns.Msg)
+	return reply, reply.Unpack(resp[2:])
+}
+
+func TestDNSOverQUIC(t *testing.T) {
+	const doqListen = "127.0.0.1:8853"
+
+	c := config.Empty()
+	c.DoQListen = doqListen
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "laptop", Address: "10.0.0.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := ioutil.ReadFile(defaultCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	tlsConfig := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", NextProtos: []string{doq.ALPN}}
+
+	conn, err := quic.DialAddr(context.Background(), doqListen, tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// several queries share a connection, each on its own stream.
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("laptop.internal.", dns.TypeA)
+		m.Id = 0
+
+		reply, err := doqExchange(conn, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Id != 0 || len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.7")) {
+			t.Fatalf("unexpected answer over QUIC: %v", reply)
+		}
+	}
+
+	// queries must have an ID of zero; anything else ends the connection.
+	m := new(dns.Msg)
+	m.SetQuestion("laptop.internal.", dns.TypeA)
+	m.Id = 1
+
+	if _, err := doqExchange(conn, m); err == nil {
+		t.Fatal("query with an ID was answered")
+	}
+}
+
+func TestViews(t *testing.T) {
+	c := config.Empty()
+	c.Views = []*config.View{
+		{Name: "vpn", Networks: []string{"10.8.0.0/16"}},
+		{Name: "local", Networks: []string{"127.0.0.1"}},
+	}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*proto.Record{
+		{Host: "gw", Address: "10.0.0.1"},
+		{Host: "gw", Address: "10.8.0.1", View: "vpn"},
+		{Host: "gw", Address: "127.0.0.2", View: "local"},
+		{Host: "nas", Address: "10.0.0.2"},
+	} {
+		if _, err := client.SetA(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = client.SetA(context.Background(), &proto.Record{Host: "gw", Address: "10.9.0.1", View: "lab"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("record was set in an unknown view: %v", err)
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Records) != 4 {
+		t.Fatalf("unexpected records: %v", list.Records)
+	}
+
+	table := map[string]struct {
+		host    string
+		subnet  string
+		address string
+	}{
+		"no view matches the subnet": {host: "gw", subnet: "192.168.1.0", address: "10.0.0.1"},
+		"view matches the subnet":    {host: "gw", subnet: "10.8.1.0", address: "10.8.0.1"},
+		"fallback to default":        {host: "nas", subnet: "10.8.1.0", address: "10.0.0.2"},
+		"view matches the source":    {host: "gw", address: "127.0.0.2"},
+		"source falls back":          {host: "nas", address: "10.0.0.2"},
+	}
+
+	for testName, result := range table {
+		m := new(dns.Msg)
+		m.SetQuestion(result.host+".internal.", dns.TypeA)
+
+		if result.subnet != "" {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(result.subnet).To4(),
+			})
+		}
+
+		reply, _, err := (&dns.Client{Net: "udp"}).Exchange(m, defaultDNSListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP(result.address)) {
+			t.Fatalf("Result for %q should be %s but was %v", testName, result.address, reply.Answer)
+		}
+
+		if result.subnet == "" {
+			continue
+		}
+
+		var scope uint8
+		if opt := reply.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+					scope = subnet.SourceScope
+				}
+			}
+		}
+
+		if scope != 24 {
+			t.Fatalf("Result for %q did not scope the answer to the client subnet: %v", testName, reply)
+		}
+	}
+}
+
+func TestDNSSEC(t *testing.T) {
+	for _, nsec3 := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "ldnsd-dnssec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		c := config.Empty()
+		c.DNSSEC = &config.DNSSEC{
+			KeyFile:        filepath.Join(dir, "dnssec.key"),
+			PrivateKeyFile: filepath.Join(dir, "dnssec.private"),
+			Algorithm:      "ED25519",
+			NSEC3:          nsec3,
+		}
+
+		srv, err := startServiceWithConfig(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testDNSSEC(t, nsec3)
+
+		srv.Shutdown()
+		os.Remove("test.db")
+	}
+}
+
+func testDNSSEC(t *testing.T, nsec3 bool) {
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "signed", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(name string, typ uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, typ)
+		m.SetEdns0(dns.DefaultMsgSize, true)
+
+		reply, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, defaultDNSListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Rcode != dns.RcodeSuccess {
+			t.Fatalf("query for %s/%s failed: %s", name, dns.TypeToString[typ], dns.RcodeToString[reply.Rcode])
+		}
+
+		return reply
+	}
+
+	var key *dns.DNSKEY
+	for _, rr := range exchange("internal.", dns.TypeDNSKEY).Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			key = k
+		}
+	}
+
+	if key == nil {
+		t.Fatal("no DNSKEY at the apex")
+	}
+
+	keys, err := client.DNSSECKey(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ds := key.ToDS(dns.SHA256).String(); keys.Ds != ds {
+		t.Fatalf("DS was %q, not %q", keys.Ds, ds)
+	}
+
+	// verify checks every RRset in the section is signed with the key.
+	verify := func(section []dns.RR, types ...uint16) {
+		sets := map[uint16][]dns.RR{}
+		sigs := map[uint16]*dns.RRSIG{}
+
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs[sig.TypeCovered] = sig
+			} else {
+				sets[rr.Header().Rrtype] = append(sets[rr.Header().Rrtype], rr)
+			}
+		}
+
+		for _, typ := range types {
+			sig, ok := sigs[typ]
+			if !ok || len(sets[typ]) == 0 {
+				t.Fatalf("no signed %s records in %v", dns.TypeToString[typ], section)
+			}
+
+			if err := sig.Verify(key, sets[typ]); err != nil {
+				t.Fatalf("signature of %s records did not verify: %v", dns.TypeToString[typ], err)
+			}
+		}
+	}
+
+	reply := exchange("signed.internal.", dns.TypeA)
+	verify(reply.Answer, dns.TypeA)
+
+	if opt := reply.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatal("DO bit was not set in the signed response")
+	}
+
+	denial := dns.TypeNSEC
+	if nsec3 {
+		denial = dns.TypeNSEC3
+	}
+
+	reply = exchange("missing.internal.", dns.TypeA)
+	if len(reply.Answer) != 0 {
+		t.Fatalf("missing name was answered: %v", reply.Answer)
+	}
+	verify(reply.Ns, dns.TypeSOA, denial)
+
+	reply = exchange("signed.internal.", dns.TypeAAAA)
+	verify(reply.Ns, dns.TypeSOA, denial)
+
+	for _, rr := range reply.Ns {
+		var types []uint16
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			types = rr.TypeBitMap
+		case *dns.NSEC3:
+			types = rr.TypeBitMap
+		default:
+			continue
+		}
+
+		found := false
+		for _, typ := range types {
+			found = found || typ == dns.TypeA
+		}
+
+		if !found {
+			t.Fatalf("denial for an existing name does not hold its A record: %v", rr)
+		}
+	}
+
+	// clients that do not ask for DNSSEC get no signatures.
+	unsigned, err := msgClient("signed.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rr := range unsigned.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			t.Fatal("response was signed for a client that did not ask for it")
+		}
+	}
+}
+
+// fakeResolver answers every A query with the address.
+func fakeResolver(t *testing.T, listen, address string) *dns.Server {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := &dns.Msg{}
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(address),
+		}}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	return srv
+}
+
+func TestForwarding(t *testing.T) {
+	public := fakeResolver(t, "127.0.0.1:5320", "192.0.2.1")
+	defer public.Shutdown()
+
+	corp := fakeResolver(t, "127.0.0.1:5321", "192.0.2.2")
+	defer corp.Shutdown()
+
+	c := config.Empty()
+	c.Forward = config.Forward{
+		// nothing listens on the first upstream.
+		Upstreams: []string{"127.0.0.1:5322", "127.0.0.1:5320"},
+		Zones: []*config.ForwardZone{
+			{Name: "corp.example.com", Upstreams: []string{"127.0.0.1:5321"}},
+			{Name: "lab.internal", Upstreams: []string{"127.0.0.1:5321"}},
+		},
+	}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "local", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	table := map[string]string{
+		"www.example.com.":       "192.0.2.1",
+		"host.corp.example.com.": "192.0.2.2",
+		"host.lab.internal.":     "192.0.2.2",
+		"local.internal.":        "10.0.0.1",
+	}
+
+	for i := 0; i < 3; i++ {
+		for name, address := range table {
+			reply, err := msgClient(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(reply.Answer) != 1 || !reply.Answer[0].(*dns.A).A.Equal(net.ParseIP(address)) {
+				t.Fatalf("Result for %q should be %s but was %v", name, address, reply.Answer)
+			}
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.RecursionDesired = false
+
+	reply, err := dns.Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Rcode != dns.RcodeRefused {
+		t.Fatalf("non-recursive query was answered with %s", dns.RcodeToString[reply.Rcode])
+	}
+
+	// with no upstream answering, clients get a failure.
+	public.Shutdown()
+
+	reply, err = msgClient("www.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("query with no upstream was answered with %s", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	slip := 2
+
+	c := config.Empty()
+	c.RateLimit = &config.RateLimit{
+		ResponsesPerSecond: 5,
+		NXDomainsPerSecond: 5,
+		ErrorsPerSecond:    5,
+		Slip:               &slip,
+		IPv4PrefixLength:   24,
+		IPv6PrefixLength:   56,
+	}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "busy", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var answered, truncated, dropped int
+
+	for i := 0; i < 15; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("busy.internal.", dns.TypeA)
+
+		reply, _, err := (&dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}).Exchange(m, defaultDNSListen)
+		switch {
+		case err != nil:
+			dropped++
+		case reply.Truncated:
+			if len(reply.Answer) != 0 {
+				t.Fatalf("slipped response has records: %v", reply.Answer)
+			}
+			truncated++
+		default:
+			answered++
+		}
+	}
+
+	// the bucket refills a little while queries time out.
+	if answered < 5 || truncated == 0 || dropped == 0 {
+		t.Fatalf("%d responses were answered, %d slipped and %d dropped", answered, truncated, dropped)
+	}
+
+	counters, err := client.RateLimitCounters(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counters.Dropped != uint64(dropped) || counters.Slipped != uint64(truncated) {
+		t.Fatalf("counters were %+v, not %d dropped and %d slipped", counters, dropped, truncated)
+	}
+
+	// TCP is never limited.
+	for i := 0; i < 10; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("busy.internal.", dns.TypeA)
+
+		reply, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, defaultDNSListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reply.Answer) != 1 {
+			t.Fatalf("tcp query was limited: %v", reply)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	c := config.Empty()
+	c.ACL = config.ACL{Deny: []string{"127.0.0.0/8"}, Action: config.ACLRefuse}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "guarded", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(network string) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion("guarded.internal.", dns.TypeA)
+
+		reply, _, err := (&dns.Client{Net: network, Timeout: 200 * time.Millisecond}).Exchange(m, defaultDNSListen)
+		return reply, err
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		reply, err := exchange(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Rcode != dns.RcodeRefused {
+			t.Fatalf("denied %s query was answered with %s", network, dns.RcodeToString[reply.Rcode])
+		}
+	}
+
+	table := map[string]struct {
+		acl    config.ACL
+		result string
+	}{
+		"dropped":         {acl: config.ACL{Deny: []string{"127.0.0.1"}, Action: config.ACLDrop}, result: "dropped"},
+		"not allowed":     {acl: config.ACL{Allow: []string{"10.0.0.0/8"}, Action: config.ACLRefuse}, result: "refused"},
+		"allowed":         {acl: config.ACL{Allow: []string{"127.0.0.1"}, Action: config.ACLRefuse}, result: "answered"},
+		"nothing listed":  {acl: config.ACL{Action: config.ACLDrop}, result: "answered"},
+		"denied in allow": {acl: config.ACL{Allow: []string{"127.0.0.0/8"}, Deny: []string{"127.0.0.1"}, Action: config.ACLRefuse}, result: "refused"},
+	}
+
+	for name, result := range table {
+		c := config.Empty()
+		c.ACL = result.acl
+
+		if err := srv.Reload(c); err != nil {
+			t.Fatal(err)
+		}
+
+		reply, err := exchange("udp")
+
+		var got string
+		switch {
+		case err != nil:
+			got = "dropped"
+		case reply.Rcode == dns.RcodeRefused:
+			got = "refused"
+		case len(reply.Answer) == 1:
+			got = "answered"
+		default:
+			got = fmt.Sprintf("%v", reply)
+		}
+
+		if got != result.result {
+			t.Fatalf("Result for %q should be %s but was %s", name, result.result, got)
+		}
+	}
+
+	c = config.Empty()
+	c.ACL = config.ACL{Deny: []string{"127.0.0.1"}, Action: config.ACLRefuse}
+	if err := srv.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+
+	c = config.Empty()
+	c.ACL = config.ACL{Deny: []string{"bogus"}}
+	if err := srv.Reload(c); err == nil {
+		t.Fatal("invalid acl was loaded")
+	}
+
+	// the last valid list is kept.
+	if reply, err := exchange("udp"); err != nil || reply.Rcode != dns.RcodeRefused {
+		t.Fatalf("acl was changed by an invalid reload: %v %v", reply, err)
+	}
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	const (
+		dhcpSecret  = "ZGhjcCBrZXkgZm9yIHRlc3Rpbmc="
+		adminSecret = "YWRtaW4ga2V5IGZvciB0ZXN0aW5n"
+	)
+
+	c := config.Empty()
+	c.UpdateKeys = []*config.UpdateKey{
+		{Name: "dhcp", Algorithm: "hmac-sha256", Secret: dhcpSecret, Names: []string{"*.dhcp"}},
+		{Name: "admin", Algorithm: "hmac-sha512", Secret: adminSecret},
+	}
+	c.Records = []*dnsdb.Record{{Host: "gateway", Address: "10.0.0.254"}}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	secrets := map[string]string{"dhcp.": dhcpSecret, "admin.": adminSecret}
+	algorithms := map[string]string{"dhcp.": dns.HmacSHA256, "admin.": dns.HmacSHA512}
+
+	update := func(key string, build func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("internal.")
+		build(m)
+
+		client := &dns.Client{Net: "tcp", TsigSecret: secrets}
+		algorithm := algorithms[key]
+		switch key {
+		case "forged.":
+			// signed for the admin key, with the wrong secret.
+			key = "admin."
+			algorithm = algorithms[key]
+			client.TsigSecret = map[string]string{key: dhcpSecret}
+		case "weak.":
+			// signed with the admin key, with an algorithm it is not used with.
+			key = "admin."
+			algorithm = dns.HmacSHA1
+		}
+
+		if key != "" {
+			m.SetTsig(key, algorithm, 300, time.Now().Unix())
+		}
+
+		reply, _, err := client.Exchange(m, defaultDNSListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return reply.Rcode
+	}
+
+	rr := func(s string) []dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []dns.RR{r}
+	}
+
+	lookup := func(name string) string {
+		reply, err := msgClient(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reply.Answer) != 1 {
+			return ""
+		}
+
+		return reply.Answer[0].(*dns.A).A.String()
+	}
+
+	table := []struct {
+		name   string
+		key    string
+		build  func(m *dns.Msg)
+		rcode  int
+		host   string
+		result string
+	}{
+		{
+			name:   "insert",
+			key:    "dhcp.",
+			build:  func(m *dns.Msg) { m.Insert(rr("laptop.dhcp.internal. 60 IN A 10.0.1.1")) },
+			host:   "laptop.dhcp.internal.",
+			result: "10.0.1.1",
+		},
+		{
+			name:  "unsigned",
+			build: func(m *dns.Msg) { m.Insert(rr("phone.dhcp.internal. 60 IN A 10.0.1.2")) },
+			rcode: dns.RcodeRefused,
+			host:  "phone.dhcp.internal.",
+		},
+		{
+			name:  "bad signature",
+			key:   "forged.",
+			build: func(m *dns.Msg) { m.Insert(rr("phone.dhcp.internal. 60 IN A 10.0.1.2")) },
+			rcode: dns.RcodeNotAuth,
+			host:  "phone.dhcp.internal.",
+		},
+		{
+			name:  "wrong algorithm",
+			key:   "weak.",
+			build: func(m *dns.Msg) { m.Insert(rr("phone.dhcp.internal. 60 IN A 10.0.1.2")) },
+			rcode: dns.RcodeNotAuth,
+			host:  "phone.dhcp.internal.",
+		},
+		{
+			name:  "outside the key's names",
+			key:   "dhcp.",
+			build: func(m *dns.Msg) { m.Insert(rr("printer.internal. 60 IN A 10.0.0.9")) },
+			rcode: dns.RcodeRefused,
+			host:  "printer.internal.",
+		},
+		{
+			name: "name not in use",
+			key:  "dhcp.",
+			build: func(m *dns.Msg) {
+				m.NameNotUsed(rr("laptop.dhcp.internal. 0 IN A 0.0.0.0"))
+				m.Insert(rr("laptop.dhcp.internal. 60 IN A 10.0.1.9"))
+			},
+			rcode:  dns.RcodeYXDomain,
+			host:   "laptop.dhcp.internal.",
+			result: "10.0.1.1",
+		},
+		{
+			name: "rrset with the wrong value",
+			key:  "dhcp.",
+			build: func(m *dns.Msg) {
+				m.Used(rr("laptop.dhcp.internal. 0 IN A 10.0.1.2"))
+				m.Insert(rr("laptop.dhcp.internal. 60 IN A 10.0.1.9"))
+			},
+			rcode:  dns.RcodeNXRrset,
+			host:   "laptop.dhcp.internal.",
+			result: "10.0.1.1",
+		},
+		{
+			name: "replace",
+			key:  "dhcp.",
+			build: func(m *dns.Msg) {
+				m.Used(rr("laptop.dhcp.internal. 0 IN A 10.0.1.1"))
+				m.RemoveRRset(rr("laptop.dhcp.internal. 0 IN A 0.0.0.0"))
+				m.Insert(rr("laptop.dhcp.internal. 60 IN A 10.0.1.3"))
+			},
+			host:   "laptop.dhcp.internal.",
+			result: "10.0.1.3",
+		},
+		{
+			name:  "static record",
+			key:   "admin.",
+			build: func(m *dns.Msg) { m.Insert(rr("gateway.internal. 60 IN A 10.0.0.1")) },
+			rcode: dns.RcodeRefused,
+			host:  "gateway.internal.", result: "10.0.0.254",
+		},
+		{
+			name:  "unsupported type",
+			key:   "admin.",
+			build: func(m *dns.Msg) { m.Insert(rr(`laptop.internal. 60 IN TXT "hello"`)) },
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "outside the zone",
+			key:   "admin.",
+			build: func(m *dns.Msg) { m.Insert(rr("www.example.com. 60 IN A 10.0.0.1")) },
+			rcode: dns.RcodeNotZone,
+		},
+		{
+			name:  "remove a wrong address",
+			key:   "admin.",
+			build: func(m *dns.Msg) { m.Remove(rr("laptop.dhcp.internal. 60 IN A 10.0.1.1")) },
+			host:  "laptop.dhcp.internal.", result: "10.0.1.3",
+		},
+		{
+			name:  "remove",
+			key:   "admin.",
+			build: func(m *dns.Msg) { m.Remove(rr("laptop.dhcp.internal. 60 IN A 10.0.1.3")) },
+			host:  "laptop.dhcp.internal.",
+		},
+		{
+			name: "name in use",
+			key:  "admin.",
+			build: func(m *dns.Msg) {
+				m.NameUsed(rr("laptop.dhcp.internal. 0 IN A 0.0.0.0"))
+				m.Insert(rr("laptop.dhcp.internal. 60 IN A 10.0.1.4"))
+			},
+			rcode: dns.RcodeNameError,
+			host:  "laptop.dhcp.internal.",
+		},
+	}
+
+	for _, result := range table {
+		if rcode := update(result.key, result.build); rcode != result.rcode {
+			t.Fatalf("Result for %q should be %s but was %s", result.name, dns.RcodeToString[result.rcode], dns.RcodeToString[rcode])
+		}
+
+		if result.host == "" {
+			continue
+		}
+
+		if address := lookup(result.host); address != result.result {
+			t.Fatalf("Result for %q: %s holds %q, not %q", result.name, result.host, address, result.result)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert(rr("www.example.com. 60 IN A 10.0.0.1"))
+	m.SetTsig("admin.", dns.HmacSHA512, 300, time.Now().Unix())
+
+	reply, _, err := (&dns.Client{Net: "tcp", TsigSecret: secrets}).Exchange(m, defaultDNSListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("update of another zone was answered with %s", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestDynamicUpdateAddresses(t *testing.T) {
+	const secret = "YWRtaW4ga2V5IGZvciB0ZXN0aW5n"
+
+	c := config.Empty()
+	c.UpdateKeys = []*config.UpdateKey{{Name: "admin", Algorithm: "hmac-sha256", Secret: secret}}
+	c.HealthInterval = 3600
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*proto.Record{
+		{Host: "pool", Address: "10.0.2.1,10.0.2.2", Check: "tcp:80"},
+		{Host: "canary", Address: "10.0.3.1,10.0.3.2", Policy: "weighted:90,10"},
+	} {
+		if _, err := client.SetA(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update := func(build func(m *dns.Msg)) int {
+		m := new(dns.Msg)
+		m.SetUpdate("internal.")
+		build(m)
+		m.SetTsig("admin.", dns.HmacSHA256, 300, time.Now().Unix())
+
+		reply, _, err := (&dns.Client{Net: "tcp", TsigSecret: map[string]string{"admin.": secret}}).Exchange(m, defaultDNSListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return reply.Rcode
+	}
+
+	rr := func(records ...string) []dns.RR {
+		rrs := []dns.RR{}
+		for _, s := range records {
+			r, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, r)
+		}
+		return rrs
+	}
+
+	record := func(host string) *proto.Record {
+		list, err := client.ListA(context.Background(), &empty.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range list.Records {
+			if r.Host == host {
+				return r
+			}
+		}
+
+		return nil
+	}
+
+	table := []struct {
+		name    string
+		build   func(m *dns.Msg)
+		rcode   int
+		host    string
+		address string
+		check   string
+		policy  string
+	}{
+		{
+			name:    "add an address",
+			build:   func(m *dns.Msg) { m.Insert(rr("pool.internal. 60 IN A 10.0.2.3")) },
+			host:    "pool",
+			address: "10.0.2.1,10.0.2.2,10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name:    "add an address it has",
+			build:   func(m *dns.Msg) { m.Insert(rr("pool.internal. 60 IN A 10.0.2.1")) },
+			host:    "pool",
+			address: "10.0.2.1,10.0.2.2,10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name:    "remove an address other than the first",
+			build:   func(m *dns.Msg) { m.Remove(rr("pool.internal. 60 IN A 10.0.2.2")) },
+			host:    "pool",
+			address: "10.0.2.1,10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name:    "remove an address it does not have",
+			build:   func(m *dns.Msg) { m.Remove(rr("pool.internal. 60 IN A 10.0.2.9")) },
+			host:    "pool",
+			address: "10.0.2.1,10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name: "rrset with only some of the addresses",
+			build: func(m *dns.Msg) {
+				m.Used(rr("pool.internal. 0 IN A 10.0.2.1"))
+				m.Remove(rr("pool.internal. 60 IN A 10.0.2.1"))
+			},
+			rcode:   dns.RcodeNXRrset,
+			host:    "pool",
+			address: "10.0.2.1,10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name: "rrset with every address",
+			build: func(m *dns.Msg) {
+				m.Used(rr("pool.internal. 0 IN A 10.0.2.3", "pool.internal. 0 IN A 10.0.2.1"))
+				m.Remove(rr("pool.internal. 60 IN A 10.0.2.1"))
+			},
+			host:    "pool",
+			address: "10.0.2.3",
+			check:   "tcp:80",
+		},
+		{
+			name:    "remove a weighted address",
+			build:   func(m *dns.Msg) { m.Remove(rr("canary.internal. 60 IN A 10.0.3.1")) },
+			host:    "canary",
+			address: "10.0.3.2",
+			policy:  "weighted:10",
+		},
+		{
+			name:    "add an address without a weight",
+			build:   func(m *dns.Msg) { m.Insert(rr("canary.internal. 60 IN A 10.0.3.3")) },
+			rcode:   dns.RcodeRefused,
+			host:    "canary",
+			address: "10.0.3.2",
+			policy:  "weighted:10",
+		},
+		{
+			name:  "remove the last address",
+			build: func(m *dns.Msg) { m.Remove(rr("pool.internal. 60 IN A 10.0.2.3")) },
+			host:  "pool",
+		},
+	}
+
+	for _, result := range table {
+		if rcode := update(result.build); rcode != result.rcode {
+			t.Fatalf("Result for %q should be %s but was %s", result.name, dns.RcodeToString[result.rcode], dns.RcodeToString[rcode])
+		}
+
+		r := record(result.host)
+		switch {
+		case result.address == "" && r != nil:
+			t.Fatalf("Result for %q should be no record but was %v", result.name, r)
+		case result.address == "":
+		case r == nil:
+			t.Fatalf("Result for %q should be a record but was none", result.name)
+		case r.Address != result.address || r.Check != result.check || r.Policy != result.policy:
+			t.Fatalf("Result for %q should be %s (%q, %q) but was %v", result.name, result.address, result.check, result.policy, r)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	c := config.Empty()
+	c.DBFile = "test.db"
+	c.DNSListen = config.Listeners{
+		{Address: defaultDNSListen},
+		{Address: "[::1]:5302", Protocol: config.ProtocolUDP, ACL: &config.ACL{Deny: []string{"::1"}, Action: config.ACLRefuse}},
+		{Address: "localhost:5303", Protocol: config.ProtocolTCP},
+	}
+
+	srv, err := service.New("test-ldnsd", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	go srv.Boot()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "everywhere", Address: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(network, addr string) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion("everywhere.internal.", dns.TypeA)
+
+		reply, _, err := (&dns.Client{Net: network, Timeout: 200 * time.Millisecond}).Exchange(m, addr)
+		return reply, err
+	}
+
+	table := map[string]struct {
+		network string
+		addr    string
+		result  string
+	}{
+		"udp on both":          {network: "udp", addr: defaultDNSListen, result: "answered"},
+		"tcp on both":          {network: "tcp", addr: defaultDNSListen, result: "answered"},
+		"udp with its own acl": {network: "udp", addr: "[::1]:5302", result: "refused"},
+		"tcp on udp listener":  {network: "tcp", addr: "[::1]:5302", result: "failed"},
+		"tcp on resolved name": {network: "tcp", addr: "127.0.0.1:5303", result: "answered"},
+		"udp on tcp listener":  {network: "udp", addr: "127.0.0.1:5303", result: "failed"},
+	}
+
+	for name, result := range table {
+		reply, err := exchange(result.network, result.addr)
+
+		var got string
+		switch {
+		case err != nil:
+			got = "failed"
+		case reply.Rcode == dns.RcodeRefused:
+			got = "refused"
+		case len(reply.Answer) == 1:
+			got = "answered"
+		default:
+			got = fmt.Sprintf("%v", reply)
+		}
+
+		if got != result.result {
+			t.Fatalf("Result for %q should be %s but was %s", name, result.result, got)
+		}
+	}
+
+	// without its own acl, the listener uses the top-level one.
+	reload := config.Empty()
+	reload.DNSListen = config.Listeners{{Address: "[::1]:5302", Protocol: config.ProtocolUDP}}
+	if err := srv.Reload(reload); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err := exchange("udp", "[::1]:5302"); err != nil || len(reply.Answer) != 1 {
+		t.Fatalf("listener acl was not reloaded: %v %v", reply, err)
+	}
+
+	// a listener that cannot bind stops the service from booting.
+	c = config.Empty()
+	c.DBFile = "test-conflict.db"
+	c.GRPCListen = "localhost:7848"
+	c.DNSListen = config.Listeners{{Address: "127.0.0.1:5304"}, {Address: defaultDNSListen, Protocol: config.ProtocolUDP}}
+
+	conflict, err := service.New("test-ldnsd-conflict", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test-conflict.db")
+	defer conflict.Shutdown()
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- conflict.Boot() }()
+
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatal("boot succeeded with an address in use")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("boot did not fail with an address in use")
+	}
+
+	if _, err := exchange("udp", "127.0.0.1:5304"); err == nil {
+		t.Fatal("listener was served though another failed to bind")
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	// 127.0.0.1 passes the check, and 127.0.0.2 refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.Empty()
+	c.HealthInterval = 1
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*proto.Record{
+		{Host: "checked", Address: "127.0.0.1,127.0.0.2", Check: "tcp:" + port},
+		{Host: "unchecked", Address: "127.0.0.1,127.0.0.2"},
+	}
+
+	for _, record := range records {
+		if _, err := client.SetA(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	answers := func(host string) string {
+		reply, err := msgClient(host + ".internal.")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ips := []string{}
+		for _, rr := range reply.Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		sort.Strings(ips)
+
+		return strings.Join(ips, ",")
+	}
+
+	down := func(host string) []string {
+		list, err := client.ListA(context.Background(), &empty.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, record := range list.Records {
+			if record.Host == host {
+				return record.Down
+			}
+		}
+
+		t.Fatalf("%q was not listed", host)
+		return nil
+	}
+
+	// the records were set after the first round of checks.
+	time.Sleep(1500 * time.Millisecond)
+
+	table := map[string]string{
+		"checked":   "127.0.0.1",
+		"unchecked": "127.0.0.1,127.0.0.2",
+	}
+
+	for host, result := range table {
+		if got := answers(host); got != result {
+			t.Fatalf("Result for %q should be %q but was %q", host, result, got)
+		}
+	}
+
+	if d := down("checked"); len(d) != 1 || d[0] != "127.0.0.2" {
+		t.Fatalf("127.0.0.2 should be listed as down, but %v was", d)
+	}
+
+	if d := down("unchecked"); len(d) != 0 {
+		t.Fatalf("unchecked record was listed as down: %v", d)
+	}
+
+	// with every address down, all of them are served.
+	l.Close()
+	time.Sleep(1500 * time.Millisecond)
+
+	if got := answers("checked"); got != "127.0.0.1,127.0.0.2" {
+		t.Fatalf("every address should be served when all are down, but %q was", got)
+	}
+
+	if d := down("checked"); len(d) != 2 {
+		t.Fatalf("both addresses should be listed as down, but %v were", d)
+	}
+}
+
+func TestRoutingPolicies(t *testing.T) {
+	// 127.0.0.1 passes the check, and 127.0.0.2 refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.Empty()
+	c.HealthInterval = 1
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+	defer srv.Shutdown()
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*proto.Record{
+		{Host: "canary", Address: "127.0.0.1,127.0.0.2"},
+		{Host: "dr", Address: "127.0.0.2,127.0.0.1", Check: "tcp:" + port, Policy: "failover"},
+	}
+
+	for _, record := range records {
+		if _, err := client.SetA(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// counts returns how many times each address was served over a number of
+	// queries.
+	counts := func(host string, queries int) map[string]int {
+		counts := map[string]int{}
+
+		for i := 0; i < queries; i++ {
+			reply, err := msgClient(host + ".internal.")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, rr := range reply.Answer {
+				counts[rr.(*dns.A).A.String()]++
+			}
+		}
+
+		return counts
+	}
+
+	if got := counts("canary", 10); got["127.0.0.1"] != 10 || got["127.0.0.2"] != 10 {
+		t.Fatalf("every address should be served without a policy, but %v were", got)
+	}
+
+	if _, err := client.SetPolicy(context.Background(), &proto.RoutingPolicy{Host: "canary", Policy: "weighted:90,10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := counts("canary", 500)
+	if got["127.0.0.1"]+got["127.0.0.2"] != 500 || got["127.0.0.2"] < 20 || got["127.0.0.2"] > 80 {
+		t.Fatalf("about 10%% of answers should be 127.0.0.2, but %v were served", got)
+	}
+
+	list, err := client.ListA(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range list.Records {
+		if record.Host == "canary" && record.Policy != "weighted:90,10" {
+			t.Fatalf("policy was not listed: %q", record.Policy)
+		}
+	}
+
+	if _, err := client.SetPolicy(context.Background(), &proto.RoutingPolicy{Host: "canary"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := counts("canary", 10); got["127.0.0.1"] != 10 || got["127.0.0.2"] != 10 {
+		t.Fatalf("every address should be served once the policy is cleared, but %v were", got)
+	}
+
+	// the primary is down, so the secondary is served.
+	time.Sleep(1500 * time.Millisecond)
+
+	if got := counts("dr", 10); got["127.0.0.1"] != 10 {
+		t.Fatalf("only the secondary should be served, but %v were", got)
+	}
+
+	table := map[string]struct {
+		policy *proto.RoutingPolicy
+		code   codes.Code
+	}{
+		"missing record":        {policy: &proto.RoutingPolicy{Host: "missing", Policy: "failover"}, code: codes.NotFound},
+		"too few weights":       {policy: &proto.RoutingPolicy{Host: "canary", Policy: "weighted:100"}, code: codes.Aborted},
+		"unknown policy":        {policy: &proto.RoutingPolicy{Host: "canary", Policy: "geo"}, code: codes.Aborted},
+		"unknown view":          {policy: &proto.RoutingPolicy{Host: "canary", View: "vpn", Policy: "failover"}, code: codes.FailedPrecondition},
+		"policy of dr is valid": {policy: &proto.RoutingPolicy{Host: "dr", Policy: "weighted:1,1"}, code: codes.OK},
+	}
+
+	for name, result := range table {
+		_, err := client.SetPolicy(context.Background(), result.policy)
+		if code := status.Code(err); code != result.code {
+			t.Fatalf("Result for %q should be %v but was %v", name, result.code, err)
+		}
+	}
+}
+
+// readDNSTap reads the dnstap messages written to a file.
+func readDNSTap(t *testing.T, file string) []*dnstap.Dnstap {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := framestream.NewReader(f, &framestream.ReaderOptions{ContentTypes: [][]byte{[]byte("protobuf:dnstap.Dnstap")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []*dnstap.Dnstap{}
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.ReadFrame(buf)
+		if err != nil {
+			return messages
+		}
+
+		d := &dnstap.Dnstap{}
+		if err := protobuf.Unmarshal(buf[:n], d); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = append(messages, d)
+	}
+}
+
+func TestDNSTap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ldnsd.dnstap")
+
+	c := config.Empty()
+	c.DNSTap = &config.DNSTap{File: file, Identity: "ns1", QueueSize: 100}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		srv.Shutdown()
+		t.Fatal(err)
+	}
+
+	if _, err := client.SetA(context.Background(), &proto.Record{Host: "tapped", Address: "10.0.0.1"}); err != nil {
+		srv.Shutdown()
+		t.Fatal(err)
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		m := new(dns.Msg)
+		m.SetQuestion("tapped.internal.", dns.TypeA)
+
+		if _, _, err := (&dns.Client{Net: network}).Exchange(m, defaultDNSListen); err != nil {
+			srv.Shutdown()
+			t.Fatal(err)
+		}
+	}
+
+	var counters *proto.DNSTapCounters
+	for i := 0; i < 50; i++ {
+		counters, err = client.DNSTapCounters(context.Background(), &empty.Empty{})
+		if err != nil {
+			srv.Shutdown()
+			t.Fatal(err)
+		}
+
+		if counters.Sent == 4 {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	srv.Shutdown()
+
+	if counters.Sent != 4 || counters.Dropped != 0 {
+		t.Fatalf("counters were %+v, not 4 sent and none dropped", counters)
+	}
+
+	logged := []string{}
+	for _, d := range readDNSTap(t, file) {
+		if string(d.Identity) != "ns1" {
+			t.Fatalf("message has identity %q", d.Identity)
+		}
+
+		logged = append(logged, d.Message.GetType().String()+"/"+d.Message.GetSocketProtocol().String())
+	}
+
+	expected := "CLIENT_QUERY/UDP,CLIENT_RESPONSE/UDP,CLIENT_QUERY/TCP,CLIENT_RESPONSE/TCP"
+	if strings.Join(logged, ",") != expected {
+		t.Fatalf("logged %v, not %v", logged, expected)
+	}
+}
+
+func TestDNSTapLimitedResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ldnsd.dnstap")
+	slip := 2
+
+	c := config.Empty()
+	c.DNSTap = &config.DNSTap{File: file, QueueSize: 100}
+	c.RateLimit = &config.RateLimit{
+		ResponsesPerSecond: 2,
+		NXDomainsPerSecond: 2,
+		ErrorsPerSecond:    2,
+		Slip:               &slip,
+		IPv4PrefixLength:   24,
+		IPv6PrefixLength:   56,
+	}
+
+	srv, err := startServiceWithConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("test.db")
+
+	client, err := proto.NewClient(config.DefaultGRPCListen, defaultCAFile, defaultCertFile, defaultKeyFile)
+	if err != nil {
+		srv.Shutdown()
+		t.Fatal(err)
+	}
+
+	// too many addresses for a 512 byte response.
+	addrs := []string{}
+	for i := 1; i <= 40; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.1.%d", i))
+	}
+
+	for _, r := range []*proto.Record{{Host: "big", Address: strings.Join(addrs, ",")}, {Host: "busy", Address: "10.0.0.1"}} {
+		if _, err := client.SetA(context.Background(), r); err != nil {
+			srv.Shutdown()
+			t.Fatal(err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("big.internal.", dns.TypeA)
+
+	reply, _, err := (&dns.Client{Net: "udp"}).Exchange(m, defaultDNSListen)
+	if err != nil {
+		srv.Shutdown()
+		t.Fatal(err)
+	}
+
+	if !reply.Truncated {
+		srv.Shutdown()
+		t.Fatalf("response was not truncated: %v", reply)
+	}
+
+	var answered, slipped, dropped int
+
+	for i := 0; i < 10; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("busy.internal.", dns.TypeA)
+
+		reply, _, err := (&dns.Client{Net: "udp", Timeout: 200 * time.Millisecond}).Exchange(m, defaultDNSListen)
+		switch {
+		case err != nil:
+			dropped++
+		case reply.Truncated:
+			slipped++
+		default:
+			answered++
+		}
+	}
+
+	if slipped == 0 || dropped == 0 {
+		srv.Shutdown()
+		t.Fatalf("%d responses were answered, %d slipped and %d dropped", answered, slipped, dropped)
+	}
+
+	// the queries, and the responses that were sent.
+	sent := uint64(11 + 1 + answered + slipped)
+
+	var counters *proto.DNSTapCounters
+	for i := 0; i < 50; i++ {
+		counters, err = client.DNSTapCounters(context.Background(), &empty.Empty{})
+		if err != nil {
+			srv.Shutdown()
+			t.Fatal(err)
+		}
+
+		if counters.Sent >= sent {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	srv.Shutdown()
+
+	if counters.Sent != sent || counters.Dropped != 0 {
+		t.Fatalf("counters were %+v, not %d sent and none dropped", counters, sent)
+	}
+
+	var loggedAnswered, loggedSlipped, loggedTruncated int
+
+	for _, d := range readDNSTap(t, file) {
+		if d.Message.GetType() != dnstap.Message_CLIENT_RESPONSE {
+			continue
+		}
+
+		res := &dns.Msg{}
+		if err := res.Unpack(d.Message.ResponseMessage); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case res.Question[0].Name == "big.internal.":
+			if !res.Truncated || len(d.Message.ResponseMessage) > dns.MinMsgSize {
+				t.Fatalf("response was logged as %d bytes, not as it was sent: %v", len(d.Message.ResponseMessage), res)
+			}
+			loggedTruncated++
+		case res.Truncated && len(res.Answer) == 0:
+			loggedSlipped++
+		case !res.Truncated && len(res.Answer) == 1:
+			loggedAnswered++
+		default:
+			t.Fatalf("response was logged as %v", res)
+		}
+	}
+
+	if loggedTruncated != 1 || loggedSlipped != slipped || loggedAnswered != answered {
+		t.Fatalf("%d truncated, %d slipped and %d answered responses were logged, not 1, %d and %d", loggedTruncated, loggedSlipped, loggedAnswered, slipped, answered)
+	}
+}
@@ -0,0 +1,194 @@
+// Package plan computes the changes needed to bring the record table in line
+// with a declarative list of records.
+package plan
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the on-disk format of a declarative record list.
+type File struct {
+	Records []*dnsdb.Record `yaml:"records"`
+}
+
+// Load reads and validates a declarative record list from r.
+func Load(r io.Reader) ([]*dnsdb.Record, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading records")
+	}
+
+	f := &File{}
+	if err := yaml.Unmarshal(content, f); err != nil {
+		return nil, errors.Wrap(err, "while parsing records")
+	}
+
+	seen := map[string]struct{}{}
+
+	for i, rec := range f.Records {
+		if rec == nil {
+			return nil, errors.Errorf("record %d is empty", i)
+		}
+
+		if err := rec.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "record %d (%q)", i, rec.Host)
+		}
+
+		if _, ok := seen[rec.Host]; ok {
+			return nil, errors.Errorf("record %d (%q) is a duplicate", i, rec.Host)
+		}
+
+		seen[rec.Host] = struct{}{}
+	}
+
+	return f.Records, nil
+}
+
+// Change is a modification of an existing record: its addresses, health
+// check or policy.
+type Change struct {
+	Host string
+	From *dnsdb.Record
+	To   *dnsdb.Record
+}
+
+// Plan is the set of operations that turns the current table into the desired
+// one.
+type Plan struct {
+	Add    []*dnsdb.Record
+	Change []*Change
+	Remove []*dnsdb.Record
+}
+
+// Diff computes the plan from current to desired. Records in current that are
+// not in desired are only removed if prune is true.
+func Diff(desired, current []*dnsdb.Record, prune bool) *Plan {
+	p := &Plan{}
+
+	currentMap := map[string]*dnsdb.Record{}
+	for _, rec := range current {
+		currentMap[rec.Host] = rec
+	}
+
+	desiredMap := map[string]*dnsdb.Record{}
+	for _, rec := range desired {
+		desiredMap[rec.Host] = rec
+
+		cur, ok := currentMap[rec.Host]
+		switch {
+		case !ok:
+			p.Add = append(p.Add, rec)
+		case !equal(cur, rec):
+			p.Change = append(p.Change, &Change{Host: rec.Host, From: cur, To: rec})
+		}
+	}
+
+	if prune {
+		for _, rec := range current {
+			if _, ok := desiredMap[rec.Host]; !ok {
+				p.Remove = append(p.Remove, rec)
+			}
+		}
+	}
+
+	sort.Slice(p.Add, func(i, j int) bool { return p.Add[i].Host < p.Add[j].Host })
+	sort.Slice(p.Change, func(i, j int) bool { return p.Change[i].Host < p.Change[j].Host })
+	sort.Slice(p.Remove, func(i, j int) bool { return p.Remove[i].Host < p.Remove[j].Host })
+
+	return p
+}
+
+// equal returns true if the records serve the same addresses the same way.
+func equal(a, b *dnsdb.Record) bool {
+	return a.Check == b.Check && canonical(a) == canonical(b)
+}
+
+// canonical returns the addresses of a record and its policy in a form that
+// does not depend on the order of the addresses, with weights kept with their
+// addresses. The order is kept for the failover policy, which depends on it.
+func canonical(rec *dnsdb.Record) string {
+	addrs := strings.Split(rec.Address, ",")
+
+	if rec.Policy == "" {
+		sort.Strings(addrs)
+		return strings.Join(addrs, ",")
+	}
+
+	p, err := dnsdb.ParsePolicy(rec.Policy)
+	if err != nil || p.Type != dnsdb.PolicyWeighted || len(p.Weights) != len(addrs) {
+		return rec.Address + " " + rec.Policy
+	}
+
+	weighted := []string{}
+	for i, addr := range addrs {
+		weighted = append(weighted, addr+"="+strconv.Itoa(p.Weights[i]))
+	}
+	sort.Strings(weighted)
+
+	return strings.Join(weighted, ",") + " " + p.Type
+}
+
+// Empty is true if the plan does nothing.
+func (p *Plan) Empty() bool {
+	return len(p.Add)+len(p.Change)+len(p.Remove) == 0
+}
+
+// Set returns the records that must be written to fulfill the plan.
+func (p *Plan) Set() []*dnsdb.Record {
+	set := append([]*dnsdb.Record{}, p.Add...)
+	for _, c := range p.Change {
+		set = append(set, c.To)
+	}
+
+	return set
+}
+
+// String renders the plan for humans.
+func (p *Plan) String() string {
+	if p.Empty() {
+		return "No changes.\n"
+	}
+
+	b := &strings.Builder{}
+
+	for _, rec := range p.Add {
+		fmt.Fprintf(b, "+ %s\t%s\n", rec.Host, describe(rec))
+	}
+
+	for _, c := range p.Change {
+		fmt.Fprintf(b, "~ %s\t%s -> %s\n", c.Host, describe(c.From), describe(c.To))
+	}
+
+	for _, rec := range p.Remove {
+		fmt.Fprintf(b, "- %s\t%s\n", rec.Host, describe(rec))
+	}
+
+	fmt.Fprintf(b, "%d to add, %d to change, %d to remove.\n", len(p.Add), len(p.Change), len(p.Remove))
+
+	return b.String()
+}
+
+// describe renders the addresses of a record, and its health check and policy
+// if it has them.
+func describe(rec *dnsdb.Record) string {
+	s := rec.Address
+
+	if rec.Check != "" {
+		s += " check=" + rec.Check
+	}
+
+	if rec.Policy != "" {
+		s += " policy=" + rec.Policy
+	}
+
+	return s
+}
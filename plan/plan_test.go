@@ -0,0 +1,158 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/erikh/ldnsd/dnsdb"
+)
+
+func TestLoad(t *testing.T) {
+	table := map[string]struct {
+		content string
+		count   int
+		success bool
+	}{
+		"basic": {
+			content: "records:\n  - host: foo\n    address: 1.2.3.4\n  - host: bar\n    address: 1.2.3.5\n",
+			count:   2,
+			success: true,
+		},
+		"empty": {
+			content: "records: []\n",
+			count:   0,
+			success: true,
+		},
+		"invalid address": {
+			content: "records:\n  - host: foo\n    address: fe80::1\n",
+			success: false,
+		},
+		"duplicate": {
+			content: "records:\n  - host: foo\n    address: 1.2.3.4\n  - host: foo\n    address: 1.2.3.5\n",
+			success: false,
+		},
+		"garbage": {
+			content: "records: [",
+			success: false,
+		},
+	}
+
+	for testName, result := range table {
+		records, err := Load(strings.NewReader(result.content))
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", testName, err)
+		}
+		if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", testName)
+		}
+		if result.success && len(records) != result.count {
+			t.Fatalf("Result for %q should have %d records but had %d", testName, result.count, len(records))
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	current := []*dnsdb.Record{
+		{Host: "same", Address: "1.1.1.1"},
+		{Host: "changed", Address: "2.2.2.2"},
+		{Host: "extra", Address: "3.3.3.3"},
+	}
+
+	desired := []*dnsdb.Record{
+		{Host: "same", Address: "1.1.1.1"},
+		{Host: "changed", Address: "2.2.2.3"},
+		{Host: "new", Address: "4.4.4.4"},
+	}
+
+	p := Diff(desired, current, false)
+	if len(p.Add) != 1 || p.Add[0].Host != "new" {
+		t.Fatalf("unexpected additions: %v", p.Add)
+	}
+
+	if len(p.Change) != 1 || p.Change[0].Host != "changed" || p.Change[0].From.Address != "2.2.2.2" || p.Change[0].To.Address != "2.2.2.3" {
+		t.Fatalf("unexpected changes: %v", p.Change)
+	}
+
+	if len(p.Remove) != 0 {
+		t.Fatalf("records were removed without pruning: %v", p.Remove)
+	}
+
+	if len(p.Set()) != 2 {
+		t.Fatalf("expected 2 records to set, got %d", len(p.Set()))
+	}
+
+	p = Diff(desired, current, true)
+	if len(p.Remove) != 1 || p.Remove[0].Host != "extra" {
+		t.Fatalf("unexpected removals: %v", p.Remove)
+	}
+
+	if !Diff(current, current, true).Empty() {
+		t.Fatal("diff against itself was not empty")
+	}
+}
+
+func TestDiffPolicy(t *testing.T) {
+	current := []*dnsdb.Record{
+		{Host: "web", Address: "1.1.1.1,1.1.1.2", Check: "tcp:80", Policy: "weighted:90,10"},
+		{Host: "db", Address: "2.2.2.1,2.2.2.2", Policy: "failover"},
+	}
+
+	// web gains an address, and a weight for it; db only changes policy.
+	desired := []*dnsdb.Record{
+		{Host: "web", Address: "1.1.1.1,1.1.1.2,1.1.1.3", Check: "tcp:80", Policy: "weighted:80,10,10"},
+		{Host: "db", Address: "2.2.2.1,2.2.2.2"},
+	}
+
+	p := Diff(desired, current, false)
+	if len(p.Change) != 2 {
+		t.Fatalf("unexpected changes: %v", p.Change)
+	}
+
+	for _, rec := range p.Set() {
+		if err := rec.Validate(); err != nil {
+			t.Fatalf("Result for %q should be success but was %v", rec.Host, err)
+		}
+
+		switch rec.Host {
+		case "web":
+			if rec.Check != "tcp:80" || rec.Policy != "weighted:80,10,10" {
+				t.Fatalf("health check or policy of %q was lost: %v", rec.Host, rec)
+			}
+		case "db":
+			if rec.Policy != "" {
+				t.Fatalf("policy of %q was not removed: %v", rec.Host, rec)
+			}
+		}
+	}
+
+	if out := p.String(); !strings.Contains(out, "~ web\t1.1.1.1,1.1.1.2 check=tcp:80 policy=weighted:90,10 -> 1.1.1.1,1.1.1.2,1.1.1.3 check=tcp:80 policy=weighted:80,10,10\n") {
+		t.Fatalf("unexpected plan: %s", out)
+	}
+
+	if !Diff(current, current, true).Empty() {
+		t.Fatal("diff against itself was not empty")
+	}
+}
+
+func TestDiffOrder(t *testing.T) {
+	current := []*dnsdb.Record{
+		{Host: "plain", Address: "2.2.2.2,1.1.1.1"},
+		{Host: "weighted", Address: "1.1.1.1,2.2.2.2", Policy: "weighted:90,10"},
+		{Host: "reweighted", Address: "1.1.1.1,2.2.2.2", Policy: "weighted:90,10"},
+		{Host: "failover", Address: "1.1.1.1,2.2.2.2", Policy: "failover"},
+	}
+
+	desired := []*dnsdb.Record{
+		{Host: "plain", Address: "1.1.1.1,2.2.2.2"},
+		{Host: "weighted", Address: "2.2.2.2,1.1.1.1", Policy: "weighted:10,90"},
+		// the weights stay in place while the addresses swap.
+		{Host: "reweighted", Address: "2.2.2.2,1.1.1.1", Policy: "weighted:90,10"},
+		// failover serves the first address that is up.
+		{Host: "failover", Address: "2.2.2.2,1.1.1.1", Policy: "failover"},
+	}
+
+	p := Diff(desired, current, false)
+	if len(p.Add) != 0 || len(p.Change) != 2 || p.Change[0].Host != "failover" || p.Change[1].Host != "reweighted" {
+		t.Fatalf("unexpected plan: %s", p)
+	}
+}
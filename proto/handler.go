@@ -4,8 +4,15 @@ import (
 	context "context"
 
 	"github.com/erikh/dnsserver"
+	dnsserverDB "github.com/erikh/dnsserver/db"
+	"github.com/erikh/ldnsd/cluster"
 	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/dnssec"
+	"github.com/erikh/ldnsd/dnstap"
+	"github.com/erikh/ldnsd/health"
+	"github.com/erikh/ldnsd/rrl"
 	empty "github.com/golang/protobuf/ptypes/empty"
+	"github.com/pkg/errors"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
@@ -13,12 +20,21 @@ import (
 
 // Handler is the control plane handler.
 type Handler struct {
-	srv *dnsserver.Server
+	srv     *dnsserver.Server
+	db      *dnsdb.DB
+	cluster *cluster.Node
+	signer  *dnssec.Signer
+	limiter *rrl.Limiter
+	checker *health.Checker
+	tap     *dnstap.Logger
 }
 
-// Boot boots the grpc service
-func Boot(srv *dnsserver.Server) *grpc.Server {
-	h := &Handler{srv: srv}
+// Boot boots the grpc service. node is nil unless the service is a member of a
+// cluster, signer is nil unless the domain is signed, and limiter is nil unless
+// responses are rate limited. checker reports the health of the records. tap
+// is nil unless queries are logged with dnstap.
+func Boot(srv *dnsserver.Server, db *dnsdb.DB, node *cluster.Node, signer *dnssec.Signer, limiter *rrl.Limiter, checker *health.Checker, tap *dnstap.Logger) *grpc.Server {
+	h := &Handler{srv: srv, db: db, cluster: node, signer: signer, limiter: limiter, checker: checker, tap: tap}
 
 	s := grpc.NewServer()
 	RegisterDNSControlServer(s, h)
@@ -26,19 +42,33 @@ func Boot(srv *dnsserver.Server) *grpc.Server {
 	return s
 }
 
+func toStatus(err error) error {
+	switch errors.Cause(err) {
+	case dnsdb.ErrStatic, dnsdb.ErrReadOnly, dnsdb.ErrUnknownView:
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	case cluster.ErrNoLeader:
+		return status.Errorf(codes.Unavailable, "%v", err)
+	case dnsserverDB.ErrNotFound:
+		return status.Errorf(codes.NotFound, "%v", err)
+	default:
+		return status.Errorf(codes.Aborted, "%v", err)
+	}
+}
+
 func fromGRPC(record *Record) *dnsdb.Record {
 	return &dnsdb.Record{
 		Host:    record.Host,
+		View:    record.View,
 		Address: record.Address,
+		Check:   record.Check,
+		Policy:  record.Policy,
 	}
 }
 
 // SetA sets a new A record.
 func (h *Handler) SetA(ctx context.Context, record *Record) (*empty.Empty, error) {
-	r := fromGRPC(record)
-
-	if err := h.srv.SetA(r.Host, r.IP()); err != nil {
-		return &empty.Empty{}, status.Errorf(codes.Aborted, "%v", err)
+	if err := h.db.SetRecord(fromGRPC(record)); err != nil {
+		return &empty.Empty{}, toStatus(err)
 	}
 
 	return &empty.Empty{}, nil
@@ -46,26 +76,228 @@ func (h *Handler) SetA(ctx context.Context, record *Record) (*empty.Empty, error
 
 // DeleteA removes an existing A record
 func (h *Handler) DeleteA(ctx context.Context, record *Record) (*empty.Empty, error) {
-	r := fromGRPC(record)
-
-	if err := h.srv.DeleteA(r.Host); err != nil {
-		return &empty.Empty{}, status.Errorf(codes.Aborted, "%v", err)
+	if err := h.db.DeleteRecord(fromGRPC(record)); err != nil {
+		return &empty.Empty{}, toStatus(err)
 	}
 
 	return &empty.Empty{}, nil
 }
 
-// ListA returns a list of DNS records that the database is currently holding.
+// ListA returns a list of DNS records that the database is currently
+// holding, in every view.
 func (h *Handler) ListA(ctx context.Context, empty *empty.Empty) (*Records, error) {
-	m, err := h.srv.ListA()
+	list, rev, err := h.db.Records()
 	if err != nil {
 		return nil, status.Errorf(codes.Aborted, "%v", err)
 	}
 
-	records := &Records{}
-	for name, ip := range m {
-		records.Records = append(records.Records, &Record{Host: name, Address: ip.String()})
+	records := &Records{Revision: rev}
+	for _, r := range list {
+		record := &Record{
+			Host:    r.Host,
+			View:    r.View,
+			Address: r.Address,
+			Static:  h.db.IsStatic(r.View, r.Host),
+			Check:   r.Check,
+			Policy:  r.Policy,
+		}
+
+		for _, ip := range h.checker.Down(r) {
+			record.Down = append(record.Down, ip.String())
+		}
+
+		records.Records = append(records.Records, record)
 	}
 
 	return records, nil
 }
+
+// Apply sets and deletes a batch of records atomically.
+func (h *Handler) Apply(ctx context.Context, changes *Changes) (*empty.Empty, error) {
+	set := []*dnsdb.Record{}
+	for _, record := range changes.Set {
+		set = append(set, fromGRPC(record))
+	}
+
+	del := []*dnsdb.Record{}
+	for _, record := range changes.Delete {
+		del = append(del, fromGRPC(record))
+	}
+
+	if err := h.db.Apply(set, del); err != nil {
+		return &empty.Empty{}, toStatus(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+func toEvent(e *dnsdb.Event) *Event {
+	ev := &Event{
+		Revision: e.Revision,
+		Type:     Event_SET,
+		Record:   &Record{Host: e.Host, View: e.View, Address: e.Address, Check: e.Check, Policy: e.Policy},
+	}
+
+	if e.Type == dnsdb.EventDelete {
+		ev.Type = Event_DELETE
+	}
+
+	return ev
+}
+
+// Watch streams record changes after the requested revision as they happen.
+func (h *Handler) Watch(req *WatchRequest, stream DNSControl_WatchServer) error {
+	// subscribe before reading the backlog so nothing is missed in between.
+	events, cancel := h.db.Subscribe()
+	defer cancel()
+
+	current, err := h.db.Revision()
+	if err != nil {
+		return status.Errorf(codes.Aborted, "%v", err)
+	}
+
+	last := req.Revision
+
+	switch {
+	case last == 0 && !req.Pinned:
+		last = current
+	case last > current:
+		return status.Errorf(codes.OutOfRange, "revision %d is newer than the current revision %d", last, current)
+	default:
+		backlog, err := h.db.Events(last)
+		if errors.Cause(err) == dnsdb.ErrCompacted {
+			return status.Errorf(codes.OutOfRange, "%v", err)
+		} else if err != nil {
+			return status.Errorf(codes.Aborted, "%v", err)
+		}
+
+		for _, e := range backlog {
+			if err := stream.Send(toEvent(e)); err != nil {
+				return err
+			}
+
+			last = e.Revision
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return status.Errorf(codes.Unavailable, "watch interrupted; resume from revision %d", last)
+			}
+
+			if e.Revision <= last {
+				continue
+			}
+
+			if err := stream.Send(toEvent(e)); err != nil {
+				return err
+			}
+
+			last = e.Revision
+		}
+	}
+}
+
+func (h *Handler) checkCluster() error {
+	if h.cluster == nil {
+		return status.Errorf(codes.FailedPrecondition, "this server is not a member of a cluster")
+	}
+
+	return nil
+}
+
+// ClusterStatus describes the node and the members of its cluster.
+func (h *Handler) ClusterStatus(ctx context.Context, empty *empty.Empty) (*ClusterStatus, error) {
+	if err := h.checkCluster(); err != nil {
+		return nil, err
+	}
+
+	s, err := h.cluster.Status()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	ret := &ClusterStatus{
+		Id:           s.ID,
+		State:        s.State,
+		Leader:       s.Leader,
+		Term:         s.Term,
+		LastIndex:    s.LastIndex,
+		AppliedIndex: s.AppliedIndex,
+	}
+
+	for _, p := range s.Peers {
+		ret.Peers = append(ret.Peers, &Peer{Id: p.ID, Address: p.Address, Voter: p.Voter, Leader: p.Leader})
+	}
+
+	return ret, nil
+}
+
+// ClusterJoin adds a node to the cluster.
+func (h *Handler) ClusterJoin(ctx context.Context, peer *Peer) (*empty.Empty, error) {
+	if err := h.checkCluster(); err != nil {
+		return &empty.Empty{}, err
+	}
+
+	if err := h.cluster.Join(peer.Id, peer.Address); err != nil {
+		return &empty.Empty{}, toStatus(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// ClusterLeave removes a node from the cluster.
+func (h *Handler) ClusterLeave(ctx context.Context, peer *Peer) (*empty.Empty, error) {
+	if err := h.checkCluster(); err != nil {
+		return &empty.Empty{}, err
+	}
+
+	if err := h.cluster.Leave(peer.Id); err != nil {
+		return &empty.Empty{}, toStatus(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// DNSSECKey returns the key the domain is signed with, and its DS record.
+func (h *Handler) DNSSECKey(ctx context.Context, empty *empty.Empty) (*DNSSECKey, error) {
+	if h.signer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "dnssec is not enabled on this server")
+	}
+
+	return &DNSSECKey{Dnskey: h.signer.DNSKEY().String(), Ds: h.signer.DS().String()}, nil
+}
+
+// RateLimitCounters returns the number of responses the rate limiter held
+// back.
+func (h *Handler) RateLimitCounters(ctx context.Context, empty *empty.Empty) (*RateLimitCounters, error) {
+	if h.limiter == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "rate limiting is not enabled on this server")
+	}
+
+	counters := h.limiter.Counters()
+	return &RateLimitCounters{Dropped: counters.Dropped, Slipped: counters.Slipped}, nil
+}
+
+// DNSTapCounters returns the number of dnstap messages sent and dropped.
+func (h *Handler) DNSTapCounters(ctx context.Context, empty *empty.Empty) (*DNSTapCounters, error) {
+	if h.tap == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "dnstap is not enabled on this server")
+	}
+
+	counters := h.tap.Counters()
+	return &DNSTapCounters{Sent: counters.Sent, Dropped: counters.Dropped}, nil
+}
+
+// SetPolicy sets the routing policy of a record.
+func (h *Handler) SetPolicy(ctx context.Context, policy *RoutingPolicy) (*empty.Empty, error) {
+	if err := h.db.SetPolicy(policy.View, policy.Host, policy.Policy); err != nil {
+		return &empty.Empty{}, toStatus(err)
+	}
+
+	return &empty.Empty{}, nil
+}
@@ -0,0 +1,163 @@
+// Package replica keeps a secondary ldnsd's database in sync with a primary.
+package replica
+
+import (
+	"context"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Follower follows a primary: it takes a snapshot of the primary's records,
+// then streams the primary's changes into the local database.
+type Follower struct {
+	db     *dnsdb.DB
+	client proto.DNSControlClient
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a follower that copies records from the client's server into db.
+func New(db *dnsdb.DB, client proto.DNSControlClient) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{db: db, client: client, ctx: ctx, cancel: cancel}
+}
+
+// Close stops the follower.
+func (f *Follower) Close() {
+	f.cancel()
+}
+
+// Run follows the primary until the follower is closed. Connection problems
+// are retried with backoff; after an interruption the follower resumes from
+// the last revision it applied, and takes a new snapshot if the primary can
+// no longer resume from it.
+func (f *Follower) Run() {
+	ctx := f.ctx
+
+	var (
+		revision uint64
+		synced   bool
+		backoff  = minBackoff
+	)
+
+	for {
+		var err error
+
+		if !synced {
+			revision, err = f.snapshot(ctx)
+			if err == nil {
+				synced = true
+				backoff = minBackoff
+			}
+		}
+
+		if err == nil {
+			var applied bool
+			revision, applied, err = f.follow(ctx, revision)
+			if applied {
+				backoff = minBackoff
+			}
+
+			switch status.Code(errors.Cause(err)) {
+			case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded:
+			default:
+				// we cannot trust our position any longer; start over.
+				synced = false
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		logrus.Errorf("Replication from primary interrupted, retrying in %v: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (f *Follower) snapshot(ctx context.Context) (uint64, error) {
+	list, err := f.client.ListA(ctx, &empty.Empty{})
+	if err != nil {
+		return 0, errors.Wrap(err, "while taking snapshot of primary")
+	}
+
+	records := []*dnsdb.Record{}
+	for _, record := range list.Records {
+		// static records come from the primary's configuration, not its table.
+		if record.Static {
+			continue
+		}
+
+		records = append(records, &dnsdb.Record{Host: record.Host, View: record.View, Address: record.Address, Check: record.Check, Policy: record.Policy})
+	}
+
+	if err := f.db.Sync(records); err != nil {
+		return 0, errors.Wrap(err, "while applying snapshot of primary")
+	}
+
+	logrus.Infof("Synchronized %d records from primary at revision %d", len(records), list.Revision)
+
+	return list.Revision, nil
+}
+
+// follow applies events after the revision until the stream fails, returning
+// the last revision applied and whether anything was applied at all.
+func (f *Follower) follow(ctx context.Context, revision uint64) (uint64, bool, error) {
+	stream, err := f.client.Watch(ctx, &proto.WatchRequest{Revision: revision, Pinned: true})
+	if err != nil {
+		return revision, false, errors.Wrap(err, "while watching primary")
+	}
+
+	var applied bool
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return revision, applied, errors.Wrap(err, "while watching primary")
+		}
+
+		if event.Record == nil {
+			return revision, applied, errors.Errorf("event at revision %d has no record", event.Revision)
+		}
+
+		switch event.Type {
+		case proto.Event_SET:
+			err = f.db.Replicate([]*dnsdb.Record{{Host: event.Record.Host, View: event.Record.View, Address: event.Record.Address, Check: event.Record.Check, Policy: event.Record.Policy}}, nil)
+		case proto.Event_DELETE:
+			err = f.db.Replicate(nil, []*dnsdb.Record{{Host: event.Record.Host, View: event.Record.View}})
+		default:
+			err = errors.Errorf("unknown event type %v", event.Type)
+		}
+
+		if err != nil {
+			return revision, applied, errors.Wrapf(err, "while applying revision %d", event.Revision)
+		}
+
+		revision = event.Revision
+		applied = true
+	}
+}
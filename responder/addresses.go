@@ -0,0 +1,119 @@
+package responder
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/health"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// SetHealth makes the responder leave the addresses the checker finds down out
+// of its answers.
+func (r *Responder) SetHealth(checker *health.Checker) {
+	r.checker = checker
+}
+
+// serveAddresses answers A queries for records with several addresses, a
+// health check or a routing policy, which the dnsserver would answer with the
+// first address alone. It returns false if the query is not for such a
+// record.
+func (r *Responder) serveAddresses(w dns.ResponseWriter, req *dns.Msg, view string) bool {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeA {
+		return false
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+	if name == r.domain || !dns.IsSubDomain(r.domain, name) {
+		return false
+	}
+
+	record, err := r.db.LookupRecord(view, strings.TrimSuffix(name, "."+r.domain))
+	if err != nil || (record.Check == "" && record.Policy == "" && !strings.Contains(record.Address, ",")) {
+		return false
+	}
+
+	ips := record.IPs()
+	if r.checker != nil {
+		ips = r.checker.Filter(record)
+	}
+
+	ips = choose(record, ips)
+
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Authoritative = true
+
+	for _, ip := range ips {
+		a := r.a(record.Host, ip)
+		a.Hdr.Name = req.Question[0].Name
+		m.Answer = append(m.Answer, a)
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing response: %v", err)
+	}
+
+	return true
+}
+
+// choose applies the routing policy of the record to the addresses that may be
+// served, which are in the order of the record. Without a policy, all of them
+// are served in random order, so clients spread across them.
+func choose(record *dnsdb.Record, ips []net.IP) []net.IP {
+	var policy *dnsdb.Policy
+	if record.Policy != "" {
+		// records are validated when they are written.
+		policy, _ = dnsdb.ParsePolicy(record.Policy)
+	}
+
+	if len(ips) == 0 || policy == nil {
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+		return ips
+	}
+
+	switch policy.Type {
+	case dnsdb.PolicyFailover:
+		return ips[:1]
+	case dnsdb.PolicyWeighted:
+		return []net.IP{weighted(record, policy.Weights, ips)}
+	}
+
+	return ips
+}
+
+// weighted picks one of the addresses in proportion to its weight. If the
+// addresses left all weigh nothing, one is picked evenly instead.
+func weighted(record *dnsdb.Record, weights []int, ips []net.IP) net.IP {
+	all := record.IPs()
+
+	var total int
+	picked := make([]int, len(ips))
+
+	for i, ip := range ips {
+		for j, addr := range all {
+			if ip.Equal(addr) {
+				picked[i] = weights[j]
+				total += weights[j]
+				break
+			}
+		}
+	}
+
+	if total == 0 {
+		return ips[rand.Intn(len(ips))]
+	}
+
+	n := rand.Intn(total)
+	for i, weight := range picked {
+		if n < weight {
+			return ips[i]
+		}
+		n -= weight
+	}
+
+	return ips[len(ips)-1]
+}
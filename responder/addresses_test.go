@@ -0,0 +1,87 @@
+package responder
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	"github.com/erikh/ldnsd/dnsdb"
+)
+
+func TestChoose(t *testing.T) {
+	const draws = 10000
+
+	blue, green, spare := net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.0.2").To4(), net.ParseIP("10.0.0.3").To4()
+
+	table := map[string]struct {
+		record *dnsdb.Record
+		// the addresses left after health checks.
+		ips []net.IP
+		// the share of answers each address should get.
+		shares map[string]float64
+		// the number of addresses in each answer.
+		count int
+	}{
+		"round robin": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2"},
+			ips:    []net.IP{blue, green},
+			shares: map[string]float64{"10.0.0.1": 1, "10.0.0.2": 1},
+			count:  2,
+		},
+		"weighted": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2", Policy: "weighted:90,10"},
+			ips:    []net.IP{blue, green},
+			shares: map[string]float64{"10.0.0.1": 0.9, "10.0.0.2": 0.1},
+			count:  1,
+		},
+		"weighted without the heaviest": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2,10.0.0.3", Policy: "weighted:80,15,5"},
+			ips:    []net.IP{green, spare},
+			shares: map[string]float64{"10.0.0.2": 0.75, "10.0.0.3": 0.25},
+			count:  1,
+		},
+		"weighted with only drained addresses": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2,10.0.0.3", Policy: "weighted:10,0,0"},
+			ips:    []net.IP{green, spare},
+			shares: map[string]float64{"10.0.0.2": 0.5, "10.0.0.3": 0.5},
+			count:  1,
+		},
+		"failover": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2", Policy: "failover"},
+			ips:    []net.IP{blue, green},
+			shares: map[string]float64{"10.0.0.1": 1},
+			count:  1,
+		},
+		"failover without the primary": {
+			record: &dnsdb.Record{Address: "10.0.0.1,10.0.0.2,10.0.0.3", Policy: "failover"},
+			ips:    []net.IP{green, spare},
+			shares: map[string]float64{"10.0.0.2": 1},
+			count:  1,
+		},
+	}
+
+	for name, result := range table {
+		counts := map[string]int{}
+
+		for i := 0; i < draws; i++ {
+			ips := choose(result.record, append([]net.IP{}, result.ips...))
+			if len(ips) != result.count {
+				t.Fatalf("Result for %q should be %d addresses but was %v", name, result.count, ips)
+			}
+
+			for _, ip := range ips {
+				counts[ip.String()]++
+			}
+		}
+
+		for addr, count := range counts {
+			if _, ok := result.shares[addr]; !ok {
+				t.Fatalf("Result for %q should not include %s but did", name, addr)
+			}
+
+			if share := float64(count) / draws; math.Abs(share-result.shares[addr]) > 0.03 {
+				t.Fatalf("Result for %q should be a share of %.2f for %s but was %.2f", name, result.shares[addr], addr, share)
+			}
+		}
+	}
+}
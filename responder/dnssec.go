@@ -0,0 +1,121 @@
+package responder
+
+import (
+	"strings"
+
+	"github.com/erikh/ldnsd/dnssec"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// SetSigner makes the responder sign its answers for the domain, for clients
+// that ask for DNSSEC records, and serve the DNSKEY at the apex.
+func (r *Responder) SetSigner(signer *dnssec.Signer) {
+	r.signer = signer
+}
+
+// signs returns true if the answer to the query should be signed.
+func (r *Responder) signs(req *dns.Msg) bool {
+	if r.signer == nil || len(req.Question) != 1 {
+		return false
+	}
+
+	if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+		return false
+	}
+
+	q := req.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return false
+	}
+
+	return dns.IsSubDomain(r.domain, strings.ToLower(q.Name))
+}
+
+// types returns the types of the records at name, as served in the view.
+func (r *Responder) types(name, view string) []uint16 {
+	if name == r.domain {
+		types := []uint16{dns.TypeSOA, dns.TypeDNSKEY}
+		if r.signer.NSEC3PARAM() != nil {
+			types = append(types, dns.TypeNSEC3PARAM)
+		}
+		return types
+	}
+
+	if _, err := r.db.Lookup(view, strings.TrimSuffix(name, "."+r.domain)); err == nil {
+		return []uint16{dns.TypeA}
+	}
+
+	return nil
+}
+
+// serveKeys answers DNSKEY and NSEC3PARAM queries at the apex.
+func (r *Responder) serveKeys(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Authoritative = true
+
+	switch req.Question[0].Qtype {
+	case dns.TypeDNSKEY:
+		m.Answer = []dns.RR{r.signer.DNSKEY()}
+	case dns.TypeNSEC3PARAM:
+		if param := r.signer.NSEC3PARAM(); param != nil {
+			m.Answer = []dns.RR{param}
+		}
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing DNSKEY response: %v", err)
+	}
+}
+
+// signingWriter signs responses. Names that do not exist are answered with
+// no records and a proof that the name has none, instead of NXDOMAIN, so the
+// proof can be generated for the name alone.
+type signingWriter struct {
+	dns.ResponseWriter
+	r    *Responder
+	req  *dns.Msg
+	view string
+}
+
+// WriteMsg implements dns.ResponseWriter.
+func (w *signingWriter) WriteMsg(m *dns.Msg) error {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		soa, err := w.r.soa()
+		if err != nil {
+			logrus.Errorf("Error building SOA for %q: %v", w.r.domain, err)
+			m.SetRcode(w.req, dns.RcodeServerFailure)
+			return w.ResponseWriter.WriteMsg(m)
+		}
+
+		name := strings.ToLower(w.req.Question[0].Name)
+
+		m.Rcode = dns.RcodeSuccess
+		m.Authoritative = true
+		m.Ns = append(m.Ns, soa, w.r.signer.Deny(name, w.r.types(name, w.view), soa.Minttl))
+	}
+
+	var err error
+	if m.Answer, err = w.r.signer.Sign(m.Answer); err == nil {
+		m.Ns, err = w.r.signer.Sign(m.Ns)
+	}
+
+	if err != nil {
+		logrus.Errorf("Error signing response: %v", err)
+		m.SetRcode(w.req, dns.RcodeServerFailure)
+		m.Answer, m.Ns = nil, nil
+	}
+
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(UDPBufferSize, true)
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
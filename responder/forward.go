@@ -0,0 +1,63 @@
+package responder
+
+import (
+	"strings"
+
+	"github.com/erikh/ldnsd/forward"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// SetForwarder makes the responder forward queries for its zones, and for
+// names outside the domain, to upstream resolvers.
+func (r *Responder) SetForwarder(f *forward.Forwarder) {
+	r.forwarder = f
+}
+
+// upstreams returns the upstreams the query should be forwarded to, or nil if
+// it is answered here. Conditional forwarders take precedence over the domain.
+func (r *Responder) upstreams(req *dns.Msg) *forward.Group {
+	if r.forwarder == nil || len(req.Question) != 1 {
+		return nil
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+
+	if g := r.forwarder.Zone(name); g != nil {
+		return g
+	}
+
+	if dns.IsSubDomain(r.domain, name) {
+		return nil
+	}
+
+	return r.forwarder.Default()
+}
+
+// forward answers the query with the response of an upstream. Only recursive
+// queries are forwarded.
+func (r *Responder) forward(w dns.ResponseWriter, req *dns.Msg, g *forward.Group) {
+	if !req.RecursionDesired {
+		refuse(w, req)
+		return
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		refuse(w, req)
+		return
+	}
+
+	reply, err := g.Exchange(req)
+	if err != nil {
+		logrus.Errorf("Error forwarding %q: %v", req.Question[0].Name, err)
+		reply = &dns.Msg{}
+		reply.SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	reply.RecursionAvailable = true
+
+	if err := w.WriteMsg(reply); err != nil {
+		logrus.Errorf("Error writing forwarded response: %v", err)
+	}
+}
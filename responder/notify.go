@@ -0,0 +1,120 @@
+package responder
+
+import (
+	"context"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// changes within this window are announced with a single NOTIFY.
+	notifyDelay   = time.Second
+	notifyRetries = 3
+	notifyTimeout = 2 * time.Second
+)
+
+// Notifier sends DNS NOTIFY messages to secondaries when the zone changes.
+type Notifier struct {
+	r       *Responder
+	targets []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewNotifier creates a notifier for the responder's zone that notifies each
+// of the targets, which are host:port pairs.
+func (r *Responder) NewNotifier(targets []string) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Notifier{r: r, targets: targets, ctx: ctx, cancel: cancel}
+}
+
+// Close stops the notifier.
+func (n *Notifier) Close() {
+	n.cancel()
+}
+
+// Run watches the database and notifies secondaries of changes until the
+// notifier is closed. Bursts of changes are coalesced into one NOTIFY.
+func (n *Notifier) Run() {
+	for {
+		events, cancel := n.r.db.Subscribe()
+		n.watch(events)
+		cancel()
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-time.After(notifyDelay):
+		}
+
+		// we lost our subscription and may have missed changes; secondaries
+		// will check the serial and skip the transfer if nothing changed.
+		n.notify()
+	}
+}
+
+// watch notifies after changes until the subscription is closed.
+func (n *Notifier) watch(events <-chan *dnsdb.Event) {
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if timer == nil {
+				timer = time.After(notifyDelay)
+			}
+		case <-timer:
+			timer = nil
+			n.notify()
+		}
+	}
+}
+
+func (n *Notifier) notify() {
+	soa, err := n.r.soa()
+	if err != nil {
+		logrus.Errorf("Could not build SOA for NOTIFY: %v", err)
+		return
+	}
+
+	m := &dns.Msg{}
+	m.SetNotify(n.r.domain)
+	m.Answer = []dns.RR{soa}
+
+	for _, target := range n.targets {
+		go n.send(target, m.Copy())
+	}
+}
+
+func (n *Notifier) send(target string, m *dns.Msg) {
+	c := &dns.Client{Net: "udp", Timeout: notifyTimeout}
+
+	var err error
+	for i := 0; i < notifyRetries; i++ {
+		var reply *dns.Msg
+		reply, _, err = c.Exchange(m, target)
+		if err == nil {
+			if reply.Rcode != dns.RcodeSuccess {
+				logrus.Warnf("Secondary %v answered NOTIFY with %v", target, dns.RcodeToString[reply.Rcode])
+			}
+			return
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		default:
+		}
+	}
+
+	logrus.Errorf("Could not NOTIFY secondary %v: %v", target, err)
+}
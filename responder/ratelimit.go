@@ -0,0 +1,74 @@
+package responder
+
+import (
+	"github.com/erikh/ldnsd/rrl"
+	"github.com/miekg/dns"
+)
+
+// SetRateLimiter limits the rate of the responses sent over UDP. TCP clients
+// cannot spoof their address, so they are never limited.
+func (r *Responder) SetRateLimiter(l *rrl.Limiter) {
+	r.limiter = l
+}
+
+// limitWriter drops or slips the responses the rate limiter holds back.
+type limitWriter struct {
+	dns.ResponseWriter
+	limiter *rrl.Limiter
+	req     *dns.Msg
+}
+
+// WriteMsg implements dns.ResponseWriter.
+func (w *limitWriter) WriteMsg(m *dns.Msg) error {
+	kind, name, qtype := classify(m)
+
+	switch w.limiter.Check(ClientIP(w), kind, name, qtype) {
+	case rrl.Drop:
+		return nil
+	case rrl.Slip:
+		slip := &dns.Msg{}
+		slip.SetRcode(w.req, m.Rcode)
+		slip.Truncated = true
+		return w.ResponseWriter.WriteMsg(slip)
+	default:
+		return w.ResponseWriter.WriteMsg(m)
+	}
+}
+
+// classify returns the kind of the response and the name and type it is
+// accounted to. Responses without records are accounted to the zone named by
+// the SOA in their authority section, like BIND does, so asking for random
+// names does not escape the limit; NXDOMAIN responses without one are all
+// accounted together.
+func classify(m *dns.Msg) (rrl.Kind, string, uint16) {
+	var name string
+	var qtype uint16
+	if len(m.Question) > 0 {
+		name, qtype = m.Question[0].Name, m.Question[0].Qtype
+	}
+
+	switch m.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return rrl.Error, "", 0
+	}
+
+	if m.Rcode == dns.RcodeNameError {
+		name = ""
+	}
+
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				name = soa.Hdr.Name
+				break
+			}
+		}
+	}
+
+	if m.Rcode == dns.RcodeNameError {
+		return rrl.NXDomain, name, 0
+	}
+
+	return rrl.Response, name, qtype
+}
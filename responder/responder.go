@@ -0,0 +1,239 @@
+// Package responder answers DNS queries for the zone ldnsd manages.
+package responder
+
+import (
+	"net"
+	"strings"
+
+	"github.com/erikh/dnsserver"
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/dnssec"
+	"github.com/erikh/ldnsd/forward"
+	"github.com/erikh/ldnsd/health"
+	"github.com/erikh/ldnsd/rrl"
+	"github.com/erikh/ldnsd/secondary"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Responder is a dns.Handler. It answers queries about the zone itself, like
+// SOA and zone transfers, hands record lookups to the dnsserver, and forwards
+// queries for other names to upstream resolvers.
+type Responder struct {
+	domain        string // always fully qualified
+	srv           *dnsserver.Server
+	db            *dnsdb.DB
+	transferAllow []*net.IPNet
+	zones         *secondary.Manager
+	views         []*view
+	signer        *dnssec.Signer
+	forwarder     *forward.Forwarder
+	limiter       *rrl.Limiter
+	updateKeys    map[string]UpdateKey
+	checker       *health.Checker
+}
+
+// New constructs a responder for the domain. Zone transfers are only
+// permitted to clients in transferAllow.
+func New(domain string, srv *dnsserver.Server, db *dnsdb.DB, transferAllow []*net.IPNet) *Responder {
+	return &Responder{
+		domain:        dns.Fqdn(strings.ToLower(domain)),
+		srv:           srv,
+		db:            db,
+		transferAllow: transferAllow,
+	}
+}
+
+// SetZones makes the responder serve the zones transferred from external
+// primaries, and accept NOTIFY messages for them.
+func (r *Responder) SetZones(zones *secondary.Manager) {
+	r.zones = zones
+}
+
+// ServeDNS implements dns.Handler.
+func (r *Responder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if isUDP(w) {
+		w = &udpWriter{ResponseWriter: w, req: req}
+		if r.limiter != nil {
+			w = &limitWriter{ResponseWriter: w, limiter: r.limiter, req: req}
+		}
+	}
+
+	if req.Opcode == dns.OpcodeUpdate {
+		if r.updateKeys == nil {
+			refuse(w, req)
+			return
+		}
+
+		r.serveUpdate(w, req)
+		return
+	}
+
+	if r.zones != nil && len(req.Question) == 1 {
+		if req.Opcode == dns.OpcodeNotify {
+			r.serveNotify(w, req)
+			return
+		}
+
+		if z := r.zones.Zone(req.Question[0].Name); z != nil {
+			r.serveZone(w, req, z)
+			return
+		}
+	}
+
+	if g := r.upstreams(req); g != nil {
+		r.forward(w, req, g)
+		return
+	}
+
+	apex := len(req.Question) == 1 && strings.ToLower(req.Question[0].Name) == r.domain
+
+	if apex {
+		switch req.Question[0].Qtype {
+		case dns.TypeAXFR:
+			r.transfer(w, req)
+			return
+		case dns.TypeIXFR:
+			r.incrementalTransfer(w, req)
+			return
+		}
+	}
+
+	v, subnet := r.view(w, req)
+	if subnet != nil {
+		w = &subnetWriter{ResponseWriter: w, subnet: subnet}
+	}
+
+	if r.signs(req) {
+		sw := &signingWriter{ResponseWriter: w, r: r, req: req}
+		if v != nil {
+			sw.view = v.Name
+		}
+		w = sw
+	}
+
+	if apex {
+		switch req.Question[0].Qtype {
+		case dns.TypeSOA:
+			r.serveSOA(w, req)
+			return
+		case dns.TypeDNSKEY, dns.TypeNSEC3PARAM:
+			if r.signer != nil {
+				r.serveKeys(w, req)
+				return
+			}
+		}
+	}
+
+	var viewName string
+	if v != nil {
+		viewName = v.Name
+	}
+
+	if r.serveAddresses(w, req, viewName) {
+		return
+	}
+
+	if v != nil {
+		v.srv.ServeDNS(w, req)
+		return
+	}
+
+	r.srv.ServeDNS(w, req)
+}
+
+func (r *Responder) serveSOA(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Authoritative = true
+
+	soa, err := r.soa()
+	if err != nil {
+		logrus.Errorf("Error building SOA for %q: %v", r.domain, err)
+		m.SetRcode(req, dns.RcodeServerFailure)
+	} else {
+		m.Answer = []dns.RR{soa}
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing SOA response: %v", err)
+	}
+}
+
+func refuse(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetRcode(req, dns.RcodeRefused)
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing refusal: %v", err)
+	}
+}
+
+// ClientIP returns the IP address of the client at the other end of w.
+func ClientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveNotify schedules a refresh of a transferred zone when its primary
+// tells us it has changed.
+func (r *Responder) serveNotify(w dns.ResponseWriter, req *dns.Msg) {
+	if !r.zones.Notify(req.Question[0].Name, ClientIP(w)) {
+		logrus.Warnf("Refused NOTIFY for %q from %v", req.Question[0].Name, w.RemoteAddr())
+		refuse(w, req)
+		return
+	}
+
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.Authoritative = true
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing NOTIFY response: %v", err)
+	}
+}
+
+// serveZone answers a query from a transferred zone.
+func (r *Responder) serveZone(w dns.ResponseWriter, req *dns.Msg, z *secondary.Zone) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+
+	switch req.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		// we do not pass transferred zones on.
+		refuse(w, req)
+		return
+	}
+
+	answer, ns, rcode, ok := z.Lookup(req.Question[0].Name, req.Question[0].Qtype)
+	m.Authoritative = ok
+	m.Answer = answer
+	m.Ns = ns
+	m.Rcode = rcode
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing response: %v", err)
+	}
+}
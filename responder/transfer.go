@@ -0,0 +1,295 @@
+package responder
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// zone timers advertised in the SOA, in seconds.
+	soaRefresh = 3600
+	soaRetry   = 600
+	soaExpire  = 86400
+	// records are served with a 1 second TTL, so negative answers are too.
+	soaMinTTL = 1
+
+	// maximum size of the records in one transfer message; messages over TCP
+	// are limited to 64k.
+	transferChunk = 32 * 1024
+)
+
+// soa returns the SOA record of the zone. The serial is the revision of the
+// database, so it increases with every change.
+func (r *Responder) soa() (*dns.SOA, error) {
+	rev, err := r.db.Revision()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   r.domain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    soaMinTTL,
+		},
+		Ns:      "ns." + r.domain,
+		Mbox:    "hostmaster." + r.domain,
+		Serial:  uint32(rev),
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  soaMinTTL,
+	}, nil
+}
+
+// zone returns every record in the zone, bracketed by the SOA, in transfer
+// order.
+func (r *Responder) zone() ([]dns.RR, error) {
+	records, rev, err := r.db.Records()
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading records")
+	}
+
+	soa, err := r.soa()
+	if err != nil {
+		return nil, errors.Wrap(err, "while building SOA")
+	}
+	// use the revision the records were read at, not whatever it is now.
+	soa.Serial = uint32(rev)
+
+	// transfers carry the default view only.
+	addresses := map[string]string{}
+	hosts := []string{}
+	for _, record := range records {
+		if record.View == "" {
+			addresses[record.Host] = record.Address
+			hosts = append(hosts, record.Host)
+		}
+	}
+	sort.Strings(hosts)
+
+	rrs := []dns.RR{soa}
+	for _, host := range hosts {
+		rrs = append(rrs, r.as(host, addresses[host])...)
+	}
+
+	return append(rrs, soa), nil
+}
+
+func (r *Responder) a(host string, ip net.IP) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   host + "." + r.domain,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    1,
+		},
+		A: ip,
+	}
+}
+
+// as returns the A records of the host for an address of a dnsdb.Record, which
+// may hold several.
+func (r *Responder) as(host, address string) []dns.RR {
+	rrs := []dns.RR{}
+	for _, addr := range strings.Split(address, ",") {
+		rrs = append(rrs, r.a(host, net.ParseIP(addr).To4()))
+	}
+
+	return rrs
+}
+
+// transfer answers an AXFR request.
+func (r *Responder) transfer(w dns.ResponseWriter, req *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		// zone transfers are only done over TCP.
+		refuse(w, req)
+		return
+	}
+
+	if !contains(r.transferAllow, ClientIP(w)) {
+		logrus.Warnf("Refused zone transfer to %v", w.RemoteAddr())
+		refuse(w, req)
+		return
+	}
+
+	rrs, err := r.zone()
+	if err != nil {
+		logrus.Errorf("Error during zone transfer: %v", err)
+		m := &dns.Msg{}
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	if err := r.send(w, req, rrs); err != nil {
+		logrus.Errorf("Error during zone transfer to %v: %v", w.RemoteAddr(), err)
+	}
+}
+
+// send writes the records to w in as many messages as needed.
+func (r *Responder) send(w dns.ResponseWriter, req *dns.Msg, rrs []dns.RR) error {
+	ch := make(chan *dns.Envelope)
+	errChan := make(chan error, 1)
+
+	go func() {
+		tr := &dns.Transfer{}
+		err := tr.Out(w, req, ch)
+		// drain so the sender never blocks if the transfer failed.
+		for range ch {
+		}
+		errChan <- err
+	}()
+
+	var (
+		chunk []dns.RR
+		size  int
+	)
+
+	for _, rr := range rrs {
+		if size+dns.Len(rr) > transferChunk && len(chunk) > 0 {
+			ch <- &dns.Envelope{RR: chunk}
+			chunk, size = nil, 0
+		}
+
+		chunk = append(chunk, rr)
+		size += dns.Len(rr)
+	}
+
+	if len(chunk) > 0 {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+
+	close(ch)
+
+	return <-errChan
+}
+
+// incremental returns the IXFR answer for a client at serial. If the
+// difference cannot be computed from the journal, ok is false and a full
+// transfer should be sent instead.
+func (r *Responder) incremental(serial uint32) (rrs []dns.RR, ok bool, err error) {
+	soa, err := r.soa()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "while building SOA")
+	}
+
+	if serial == soa.Serial {
+		// the client is up to date.
+		return []dns.RR{soa}, true, nil
+	}
+
+	if serial > soa.Serial {
+		return nil, false, nil
+	}
+
+	events, err := r.db.Events(uint64(serial))
+	if errors.Cause(err) == dnsdb.ErrCompacted {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Wrap(err, "while reading journal")
+	}
+
+	// condense the journal into a single difference: the state of every
+	// changed host at the client's serial, and at ours.
+	before := map[string]string{}
+	after := map[string]string{}
+
+	for _, e := range events {
+		if e.Revision > uint64(soa.Serial) {
+			break
+		}
+
+		// transfers carry the default view only.
+		if e.View != "" {
+			continue
+		}
+
+		if _, ok := before[e.Host]; !ok {
+			before[e.Host] = e.Previous
+		}
+
+		after[e.Host] = e.Address
+	}
+
+	hosts := []string{}
+	for host := range after {
+		// static records shadow the database, so changes to it were never served.
+		if !r.db.IsStatic("", host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	old := dns.Copy(soa).(*dns.SOA)
+	old.Serial = serial
+
+	rrs = []dns.RR{soa, old}
+	for _, host := range hosts {
+		if before[host] != "" && before[host] != after[host] {
+			rrs = append(rrs, r.as(host, before[host])...)
+		}
+	}
+
+	rrs = append(rrs, soa)
+	for _, host := range hosts {
+		if after[host] != "" && before[host] != after[host] {
+			rrs = append(rrs, r.as(host, after[host])...)
+		}
+	}
+
+	return append(rrs, soa), true, nil
+}
+
+// incrementalTransfer answers an IXFR request, falling back to a full
+// transfer when the journal cannot satisfy it.
+func (r *Responder) incrementalTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	if !contains(r.transferAllow, ClientIP(w)) {
+		logrus.Warnf("Refused zone transfer to %v", w.RemoteAddr())
+		refuse(w, req)
+		return
+	}
+
+	var soa *dns.SOA
+	if len(req.Ns) == 1 {
+		soa, _ = req.Ns[0].(*dns.SOA)
+	}
+
+	if soa == nil {
+		m := &dns.Msg{}
+		m.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		// over UDP, only say what the current serial is; the client will come
+		// back over TCP if it needs the difference.
+		r.serveSOA(w, req)
+		return
+	}
+
+	rrs, ok, err := r.incremental(soa.Serial)
+	if err == nil && !ok {
+		rrs, err = r.zone()
+	}
+
+	if err != nil {
+		logrus.Errorf("Error during zone transfer: %v", err)
+		m := &dns.Msg{}
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	if err := r.send(w, req, rrs); err != nil {
+		logrus.Errorf("Error during zone transfer to %v: %v", w.RemoteAddr(), err)
+	}
+}
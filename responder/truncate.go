@@ -0,0 +1,45 @@
+package responder
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// UDPBufferSize is the largest UDP message the responder accepts, and
+// advertises to EDNS0 clients. dns.Servers serving it over UDP should read
+// requests with this size.
+const UDPBufferSize = dns.DefaultMsgSize
+
+// udpWriter fits responses into the buffer size the client can receive: 512
+// bytes, or what it advertised with EDNS0. Responses that do not fit are cut
+// short with the TC bit set, so the client retries over TCP.
+type udpWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// WriteMsg implements dns.ResponseWriter.
+func (w *udpWriter) WriteMsg(m *dns.Msg) error {
+	size := dns.MinMsgSize
+
+	if opt := w.req.IsEdns0(); opt != nil {
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+
+		// EDNS0 clients are answered with EDNS0.
+		if m.IsEdns0() == nil {
+			m.SetEdns0(UDPBufferSize, false)
+		}
+	}
+
+	m.Truncate(size)
+
+	return w.ResponseWriter.WriteMsg(m)
+}
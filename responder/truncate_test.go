@@ -0,0 +1,80 @@
+package responder
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+}
+
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestTruncation(t *testing.T) {
+	table := map[string]struct {
+		records   int
+		edns      uint16
+		truncated bool
+		max       int
+	}{
+		"small":               {records: 1, truncated: false, max: dns.MinMsgSize},
+		"oversized":           {records: 100, truncated: true, max: dns.MinMsgSize},
+		"edns large buffer":   {records: 100, edns: 4096, truncated: false, max: 4096},
+		"edns small buffer":   {records: 100, edns: 1232, truncated: true, max: 1232},
+		"edns below minimum":  {records: 100, edns: 100, truncated: true, max: dns.MinMsgSize},
+		"edns small response": {records: 1, edns: 1232, truncated: false, max: 1232},
+	}
+
+	for testName, result := range table {
+		req := &dns.Msg{}
+		req.SetQuestion("many.internal.", dns.TypeA)
+		if result.edns != 0 {
+			req.SetEdns0(result.edns, false)
+		}
+
+		m := &dns.Msg{}
+		m.SetReply(req)
+		for i := 0; i < result.records; i++ {
+			rr, err := dns.NewRR(fmt.Sprintf("many.internal. 0 IN A 10.0.%d.%d", i/256, i%256))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+
+		fw := &fakeWriter{}
+		w := &udpWriter{ResponseWriter: fw, req: req}
+		if err := w.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := fw.msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fw.msg.Truncated != result.truncated {
+			t.Fatalf("Result for %q: truncated was %v", testName, fw.msg.Truncated)
+		}
+
+		if len(buf) > result.max {
+			t.Fatalf("Result for %q: response was %d bytes, more than %d", testName, len(buf), result.max)
+		}
+
+		if (result.edns != 0) != (fw.msg.IsEdns0() != nil) {
+			t.Fatalf("Result for %q: EDNS0 was not mirrored", testName)
+		}
+	}
+}
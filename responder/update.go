@@ -0,0 +1,401 @@
+package responder
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	dnsserverDB "github.com/erikh/dnsserver/db"
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// tsigFudge is the clock skew allowed for signed responses.
+const tsigFudge = 300
+
+// UpdateKey is a TSIG key allowed to change records with DNS UPDATE.
+type UpdateKey struct {
+	// Name is the name of the key, which its secret is given to the dns.Server
+	// under.
+	Name string
+	// Algorithm is the only algorithm updates signed with the key may use,
+	// such as dns.HmacSHA256.
+	Algorithm string
+	// Names are the hosts the key may change, relative to the domain. "*.sub"
+	// matches every host under sub, and "*" every host. If empty, the key may
+	// change any host.
+	Names []string
+}
+
+// SetUpdateKeys makes the responder accept UPDATE messages (RFC 2136) signed
+// with the keys. The dns.Servers must verify TSIG with the secrets of the same
+// keys; UPDATE messages are refused if no key is set.
+func (r *Responder) SetUpdateKeys(keys []UpdateKey) {
+	r.updateKeys = map[string]UpdateKey{}
+	for _, key := range keys {
+		r.updateKeys[dns.Fqdn(strings.ToLower(key.Name))] = key
+	}
+}
+
+// AcceptMsg is a dns.MsgAcceptFunc that accepts UPDATE messages, whose
+// sections can hold any number of records, as well as everything
+// dns.DefaultMsgAcceptFunc does. dns.Servers must use it for UPDATE messages to
+// reach the responder.
+func AcceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// updateError is a failed update, and the rcode to answer it with.
+type updateError struct {
+	rcode int
+	err   error
+}
+
+func (e *updateError) Error() string {
+	return e.err.Error()
+}
+
+func updateErrorf(rcode int, format string, args ...interface{}) error {
+	return &updateError{rcode: rcode, err: errors.Errorf(format, args...)}
+}
+
+// serveUpdate checks the prerequisites of an UPDATE message and applies its
+// changes to the default view, in one transaction.
+func (r *Responder) serveUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+
+	keyName, err := r.verifyUpdate(w, req)
+	if err == nil {
+		err = r.update(req, r.updateKeys[keyName].Names)
+	}
+
+	cause := errors.Cause(err)
+	switch e := cause.(type) {
+	case nil:
+		m.SetRcode(req, dns.RcodeSuccess)
+	case *updateError:
+		logrus.Warnf("Refused UPDATE from %v: %v", w.RemoteAddr(), e)
+		m.SetRcode(req, e.rcode)
+	default:
+		if cause == dnsdb.ErrStatic || cause == dnsdb.ErrReadOnly {
+			logrus.Warnf("Refused UPDATE from %v: %v", w.RemoteAddr(), err)
+			m.SetRcode(req, dns.RcodeRefused)
+		} else {
+			logrus.Errorf("Error applying UPDATE from %v: %v", w.RemoteAddr(), err)
+			m.SetRcode(req, dns.RcodeServerFailure)
+		}
+	}
+
+	if keyName != "" {
+		t := req.IsTsig()
+		m.SetTsig(t.Hdr.Name, t.Algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("Error writing UPDATE response: %v", err)
+	}
+}
+
+// verifyUpdate checks the update is for the domain and signed with one of the
+// keys, and returns the name of the key.
+func (r *Responder) verifyUpdate(w dns.ResponseWriter, req *dns.Msg) (string, error) {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return "", updateErrorf(dns.RcodeFormatError, "the zone section must hold one SOA")
+	}
+
+	if strings.ToLower(req.Question[0].Name) != r.domain {
+		return "", updateErrorf(dns.RcodeNotAuth, "not authoritative for %q", req.Question[0].Name)
+	}
+
+	t := req.IsTsig()
+	if t == nil {
+		return "", updateErrorf(dns.RcodeRefused, "update is not signed")
+	}
+
+	name := strings.ToLower(t.Hdr.Name)
+	key, ok := r.updateKeys[name]
+	if !ok {
+		return "", updateErrorf(dns.RcodeNotAuth, "unknown key %q", t.Hdr.Name)
+	}
+
+	// the dns.Server verifies with whichever algorithm the signature names.
+	if !strings.EqualFold(t.Algorithm, dns.Fqdn(key.Algorithm)) {
+		return "", updateErrorf(dns.RcodeNotAuth, "key %q is not used with %s", t.Hdr.Name, t.Algorithm)
+	}
+
+	if err := w.TsigStatus(); err != nil {
+		return "", updateErrorf(dns.RcodeNotAuth, "signature with key %q did not verify: %v", t.Hdr.Name, err)
+	}
+
+	return name, nil
+}
+
+// pending is a record as an update changes it.
+type pending struct {
+	// original is the record before the update, or nil if there was none.
+	original *dnsdb.Record
+	// record is the record after the changes so far, or nil if there is none.
+	record *dnsdb.Record
+}
+
+// update checks the prerequisites and applies the changes, which may only be
+// to the hosts the key may change. Changes are made to the address list of a
+// record, keeping its health check and policy.
+func (r *Responder) update(req *dns.Msg, names []string) error {
+	if err := r.prerequisites(req.Answer); err != nil {
+		return err
+	}
+
+	// the whole update is checked before anything is changed.
+	records := map[string]*pending{}
+	order := []string{}
+
+	load := func(host string) (*pending, error) {
+		if p, ok := records[host]; ok {
+			return p, nil
+		}
+
+		p := &pending{}
+
+		original, err := r.db.LookupRecord("", host)
+		switch {
+		case err == nil:
+			record := *original
+			p.original, p.record = original, &record
+		case errors.Cause(err) != dnsserverDB.ErrNotFound:
+			return nil, err
+		}
+
+		records[host] = p
+		order = append(order, host)
+		return p, nil
+	}
+
+	for _, rr := range req.Ns {
+		h := rr.Header()
+
+		host, err := r.host(h.Name)
+		if err != nil {
+			return err
+		}
+
+		if host == "" {
+			return updateErrorf(dns.RcodeRefused, "the apex cannot be updated")
+		}
+
+		if !permitted(names, host) {
+			return updateErrorf(dns.RcodeRefused, "the key may not update %q", h.Name)
+		}
+
+		switch h.Class {
+		case dns.ClassINET:
+			a, ok := rr.(*dns.A)
+			if !ok {
+				return updateErrorf(dns.RcodeRefused, "only A records can be added, not %s", dns.TypeToString[h.Rrtype])
+			}
+
+			p, err := load(host)
+			if err != nil {
+				return err
+			}
+
+			if p.record == nil {
+				p.record = &dnsdb.Record{Host: host}
+			}
+			p.record.AddAddress(a.A)
+		case dns.ClassANY:
+			if h.Rrtype != dns.TypeANY && h.Rrtype != dns.TypeA {
+				continue
+			}
+
+			p, err := load(host)
+			if err != nil {
+				return err
+			}
+			p.record = nil
+		case dns.ClassNONE:
+			a, ok := rr.(*dns.A)
+			if !ok {
+				// there are no records of other types to delete.
+				continue
+			}
+
+			p, err := load(host)
+			if err != nil {
+				return err
+			}
+
+			if p.record != nil && p.record.RemoveAddress(a.A) && p.record.Address == "" {
+				p.record = nil
+			}
+		default:
+			return updateErrorf(dns.RcodeFormatError, "invalid class %d for %q", h.Class, h.Name)
+		}
+	}
+
+	set := []*dnsdb.Record{}
+	del := []*dnsdb.Record{}
+
+	for _, host := range order {
+		p := records[host]
+
+		switch {
+		case p.record == nil && p.original != nil:
+			del = append(del, &dnsdb.Record{Host: host})
+		case p.record != nil && (p.original == nil || *p.record != *p.original):
+			if err := p.record.Validate(); err != nil {
+				return updateErrorf(dns.RcodeRefused, "%q cannot be changed: %v", host, err)
+			}
+			set = append(set, p.record)
+		}
+	}
+
+	if len(set) == 0 && len(del) == 0 {
+		return nil
+	}
+
+	return r.db.Apply(set, del)
+}
+
+// prerequisites checks the prerequisites of an update (RFC 2136 section 2.4).
+// The A records a name must hold are gathered first, as they have to match
+// the addresses of its record exactly.
+func (r *Responder) prerequisites(rrs []dns.RR) error {
+	values := map[string]map[string]struct{}{}
+	order := []string{}
+
+	for _, rr := range rrs {
+		h := rr.Header()
+
+		if h.Class != dns.ClassINET {
+			if err := r.prerequisite(rr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		a, ok := rr.(*dns.A)
+		if !ok {
+			return updateErrorf(dns.RcodeNXRrset, "%q has no %s records", h.Name, dns.TypeToString[h.Rrtype])
+		}
+
+		host, err := r.host(h.Name)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := values[host]; !ok {
+			values[host] = map[string]struct{}{}
+			order = append(order, host)
+		}
+		values[host][a.A.String()] = struct{}{}
+	}
+
+	for _, host := range order {
+		have := map[string]struct{}{}
+
+		if host != "" {
+			if record, err := r.db.LookupRecord("", host); err == nil {
+				for _, ip := range record.IPs() {
+					have[ip.String()] = struct{}{}
+				}
+			}
+		}
+
+		if !reflect.DeepEqual(have, values[host]) {
+			return updateErrorf(dns.RcodeNXRrset, "the addresses of %q are not the ones given", host)
+		}
+	}
+
+	return nil
+}
+
+// prerequisite checks a prerequisite that does not depend on the addresses a
+// name holds.
+func (r *Responder) prerequisite(rr dns.RR) error {
+	h := rr.Header()
+
+	host, err := r.host(h.Name)
+	if err != nil {
+		return err
+	}
+
+	types := map[uint16]bool{}
+
+	if host == "" {
+		types[dns.TypeSOA] = true
+	} else if _, err := r.db.LookupRecord("", host); err == nil {
+		types[dns.TypeA] = true
+	}
+
+	switch {
+	case h.Class == dns.ClassANY && h.Rrtype == dns.TypeANY:
+		if len(types) == 0 {
+			return updateErrorf(dns.RcodeNameError, "%q is not in use", h.Name)
+		}
+	case h.Class == dns.ClassANY:
+		if !types[h.Rrtype] {
+			return updateErrorf(dns.RcodeNXRrset, "%q has no %s records", h.Name, dns.TypeToString[h.Rrtype])
+		}
+	case h.Class == dns.ClassNONE && h.Rrtype == dns.TypeANY:
+		if len(types) != 0 {
+			return updateErrorf(dns.RcodeYXDomain, "%q is in use", h.Name)
+		}
+	case h.Class == dns.ClassNONE:
+		if types[h.Rrtype] {
+			return updateErrorf(dns.RcodeYXRrset, "%q has %s records", h.Name, dns.TypeToString[h.Rrtype])
+		}
+	default:
+		return updateErrorf(dns.RcodeFormatError, "invalid class %d for %q", h.Class, h.Name)
+	}
+
+	return nil
+}
+
+// host returns the host a name in the domain is for; the apex is "".
+func (r *Responder) host(name string) (string, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	if name == r.domain {
+		return "", nil
+	}
+
+	if !dns.IsSubDomain(r.domain, name) {
+		return "", updateErrorf(dns.RcodeNotZone, "%q is not in %s", name, r.domain)
+	}
+
+	return strings.TrimSuffix(name, "."+r.domain), nil
+}
+
+// permitted returns true if the host matches one of the names, or if there are
+// no names.
+func permitted(names []string, host string) bool {
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+
+		switch {
+		case name == "*", name == host:
+			return true
+		case strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]):
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package responder
+
+import "testing"
+
+func TestPermitted(t *testing.T) {
+	table := map[string]struct {
+		names   []string
+		host    string
+		success bool
+	}{
+		"no names":          {host: "laptop", success: true},
+		"everything":        {names: []string{"*"}, host: "a.b.c", success: true},
+		"exact":             {names: []string{"laptop"}, host: "laptop", success: true},
+		"exact mismatch":    {names: []string{"laptop"}, host: "desktop"},
+		"under sub":         {names: []string{"*.dhcp"}, host: "host.dhcp", success: true},
+		"deep under sub":    {names: []string{"*.dhcp"}, host: "a.host.dhcp", success: true},
+		"sub itself":        {names: []string{"*.dhcp"}, host: "dhcp"},
+		"suffix is not sub": {names: []string{"*.dhcp"}, host: "nodhcp"},
+		"case":              {names: []string{"*.DHCP"}, host: "host.dhcp", success: true},
+		"second name":       {names: []string{"laptop", "*.dhcp"}, host: "host.dhcp", success: true},
+	}
+
+	for name, result := range table {
+		if permitted(result.names, result.host) != result.success {
+			if result.success {
+				t.Fatalf("Result for %q should be success but was not", name)
+			}
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package responder
+
+import (
+	"net"
+	"strings"
+
+	"github.com/erikh/dnsserver"
+	"github.com/miekg/dns"
+)
+
+// View serves the records of a view to the clients in its networks.
+type View struct {
+	Name     string
+	Networks []*net.IPNet
+}
+
+type view struct {
+	View
+	srv *dnsserver.Server
+}
+
+// SetViews makes the responder answer record lookups from the first view
+// whose networks contain the client, falling back to the default view.
+func (r *Responder) SetViews(views []View) {
+	r.views = nil
+	for _, v := range views {
+		r.views = append(r.views, &view{View: v, srv: dnsserver.NewWithDB(strings.TrimSuffix(r.domain, "."), r.db.View(v.Name))})
+	}
+}
+
+// view returns the view the query is answered from, and the client subnet
+// option it was matched on, if any. nil is returned for the default view.
+func (r *Responder) view(w dns.ResponseWriter, req *dns.Msg) (*view, *dns.EDNS0_SUBNET) {
+	if len(r.views) == 0 {
+		return nil, nil
+	}
+
+	ip := ClientIP(w)
+
+	subnet := clientSubnet(req)
+	if subnet != nil {
+		ip = subnet.Address
+	}
+
+	for _, v := range r.views {
+		if contains(v.Networks, ip) {
+			return v, subnet
+		}
+	}
+
+	return nil, subnet
+}
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of the query.
+func clientSubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// subnetWriter echoes the client subnet option in responses, with a scope as
+// wide as the subnet the client sent, so resolvers only reuse the answer for
+// clients in that subnet.
+type subnetWriter struct {
+	dns.ResponseWriter
+	subnet *dns.EDNS0_SUBNET
+}
+
+// WriteMsg implements dns.ResponseWriter.
+func (w *subnetWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(UDPBufferSize, false)
+		opt = m.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        w.subnet.Family,
+		SourceNetmask: w.subnet.SourceNetmask,
+		SourceScope:   w.subnet.SourceNetmask,
+		Address:       w.subnet.Address,
+	})
+
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,205 @@
+// Package rrl limits the rate of responses sent to each client network, in
+// the style of BIND and Knot, so the server cannot be used to flood a spoofed
+// address with answers. Responses are accounted in token buckets per client
+// prefix, kind of response, and name; once a bucket is empty, responses are
+// dropped, except for every few, which are "slipped": sent back empty and
+// truncated, so a real client retries over TCP, which cannot be spoofed.
+package rrl
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often buckets that have filled up again are forgotten.
+const sweepInterval = 10 * time.Second
+
+// Kind is the kind of a response.
+type Kind uint8
+
+const (
+	// Response is a response with records, or with none for a name that
+	// exists.
+	Response Kind = iota
+	// NXDomain is a response for a name that does not exist.
+	NXDomain
+	// Error is any other error response.
+	Error
+)
+
+// Action is what to do with a response.
+type Action uint8
+
+const (
+	// Send the response.
+	Send Action = iota
+	// Drop the response.
+	Drop
+	// Slip sends an empty, truncated response instead.
+	Slip
+)
+
+// Config configures a Limiter.
+type Config struct {
+	// ResponsesPerSecond, NXDomainsPerSecond and ErrorsPerSecond are the
+	// rates of each kind of response each client prefix may receive for a
+	// name. A bucket holds one second's worth. Rates of 0 or less leave
+	// the kind unlimited.
+	ResponsesPerSecond int
+	NXDomainsPerSecond int
+	ErrorsPerSecond    int
+	// Slip makes every Slip-th limited response be sent truncated, and the
+	// others dropped; 0 drops all of them.
+	Slip int
+	// IPv4PrefixLength and IPv6PrefixLength are the sizes of the client
+	// prefixes responses are accounted to.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+	// Exempt clients are never limited.
+	Exempt []*net.IPNet
+}
+
+// Counters count the responses that were limited.
+type Counters struct {
+	Dropped uint64
+	Slipped uint64
+}
+
+type key struct {
+	prefix string
+	kind   Kind
+	name   string
+	qtype  uint16
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// limited counts the responses held back, to slip every few.
+	limited int
+}
+
+// Limiter accounts responses and decides which are sent.
+type Limiter struct {
+	config Config
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+
+	mutex     sync.Mutex
+	buckets   map[key]*bucket
+	lastSweep time.Time
+
+	dropped uint64
+	slipped uint64
+}
+
+// New creates a limiter.
+func New(c Config) *Limiter {
+	return &Limiter{
+		config:    c,
+		v4Mask:    net.CIDRMask(c.IPv4PrefixLength, 8*net.IPv4len),
+		v6Mask:    net.CIDRMask(c.IPv6PrefixLength, 8*net.IPv6len),
+		buckets:   map[key]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *Limiter) rate(kind Kind) int {
+	switch kind {
+	case NXDomain:
+		return l.config.NXDomainsPerSecond
+	case Error:
+		return l.config.ErrorsPerSecond
+	default:
+		return l.config.ResponsesPerSecond
+	}
+}
+
+func (l *Limiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.v4Mask).String()
+	}
+
+	return ip.Mask(l.v6Mask).String()
+}
+
+// Check accounts a response of the kind to the client, and returns what to do
+// with it. Responses are accounted per name and type, except errors, which are
+// accounted per client prefix alone.
+func (l *Limiter) Check(client net.IP, kind Kind, name string, qtype uint16) Action {
+	rate := l.rate(kind)
+	if rate <= 0 || client == nil {
+		return Send
+	}
+
+	for _, network := range l.config.Exempt {
+		if network.Contains(client) {
+			return Send
+		}
+	}
+
+	k := key{prefix: l.prefix(client), kind: kind}
+	if kind != Error {
+		k.name = strings.ToLower(name)
+		k.qtype = qtype
+	}
+
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: float64(rate), last: now}
+		l.buckets[k] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return Send
+	}
+
+	b.limited++
+
+	if l.config.Slip > 0 && b.limited%l.config.Slip == 0 {
+		atomic.AddUint64(&l.slipped, 1)
+		return Slip
+	}
+
+	atomic.AddUint64(&l.dropped, 1)
+	return Drop
+}
+
+// sweep forgets the buckets that would be full by now, every sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(l.rate(k.kind)) >= float64(l.rate(k.kind)) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Counters returns the number of responses dropped and slipped so far.
+func (l *Limiter) Counters() Counters {
+	return Counters{
+		Dropped: atomic.LoadUint64(&l.dropped),
+		Slipped: atomic.LoadUint64(&l.slipped),
+	}
+}
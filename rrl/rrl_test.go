@@ -0,0 +1,113 @@
+package rrl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheck(t *testing.T) {
+	_, exempt, _ := net.ParseCIDR("10.1.0.0/16")
+
+	l := New(Config{
+		ResponsesPerSecond: 5,
+		NXDomainsPerSecond: 2,
+		ErrorsPerSecond:    -1,
+		Slip:               2,
+		IPv4PrefixLength:   24,
+		IPv6PrefixLength:   56,
+		Exempt:             []*net.IPNet{exempt},
+	})
+
+	client := net.ParseIP("10.0.0.1")
+	neighbor := net.ParseIP("10.0.0.2")
+
+	for i := 0; i < 5; i++ {
+		if action := l.Check(client, Response, "host.internal.", dns.TypeA); action != Send {
+			t.Fatalf("response %d within the rate was not sent: %v", i, action)
+		}
+	}
+
+	// the neighbor is in the same prefix.
+	actions := []Action{}
+	for i := 0; i < 4; i++ {
+		actions = append(actions, l.Check(neighbor, Response, "HOST.internal.", dns.TypeA))
+	}
+
+	if expected := []Action{Drop, Slip, Drop, Slip}; !equal(actions, expected) {
+		t.Fatalf("limited responses were %v, not %v", actions, expected)
+	}
+
+	if c := l.Counters(); c.Dropped != 2 || c.Slipped != 2 {
+		t.Fatalf("unexpected counters: %+v", c)
+	}
+
+	table := map[string]struct {
+		client net.IP
+		kind   Kind
+		name   string
+		qtype  uint16
+	}{
+		"other type":   {client: client, kind: Response, name: "host.internal.", qtype: dns.TypeAAAA},
+		"other name":   {client: client, kind: Response, name: "other.internal.", qtype: dns.TypeA},
+		"other prefix": {client: net.ParseIP("10.0.1.1"), kind: Response, name: "host.internal.", qtype: dns.TypeA},
+		"other kind":   {client: client, kind: NXDomain, name: "host.internal."},
+		"exempt":       {client: net.ParseIP("10.1.0.1"), kind: Response, name: "host.internal.", qtype: dns.TypeA},
+		"unlimited":    {client: client, kind: Error},
+	}
+
+	for name, result := range table {
+		if action := l.Check(result.client, result.kind, result.name, result.qtype); action != Send {
+			t.Fatalf("Result for %q should be %v but was %v", name, Send, action)
+		}
+	}
+
+	if action := l.Check(net.ParseIP("fd00::1"), NXDomain, "internal.", 0); action != Send {
+		t.Fatalf("first ipv6 response was not sent: %v", action)
+	}
+
+	l.Check(net.ParseIP("fd00::2"), NXDomain, "internal.", 0)
+
+	if action := l.Check(net.ParseIP("fd00:0:0:ff::1"), NXDomain, "internal.", 0); action == Send {
+		t.Fatal("ipv6 client in the same prefix was not limited")
+	}
+
+	// the bucket refills over time.
+	time.Sleep(time.Second / 5)
+
+	if action := l.Check(client, Response, "host.internal.", dns.TypeA); action != Send {
+		t.Fatalf("response was not sent after the bucket refilled: %v", action)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New(Config{ResponsesPerSecond: 100, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+
+	l.Check(net.ParseIP("10.0.0.1"), Response, "host.internal.", dns.TypeA)
+	l.Check(net.ParseIP("10.0.1.1"), Response, "host.internal.", dns.TypeA)
+
+	l.mutex.Lock()
+	l.sweep(time.Now().Add(sweepInterval))
+	count := len(l.buckets)
+	l.mutex.Unlock()
+
+	if count != 0 {
+		t.Fatalf("%d full buckets were kept", count)
+	}
+}
+
+func equal(a, b []Action) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
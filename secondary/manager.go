@@ -0,0 +1,267 @@
+package secondary
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// how long to wait before retrying a zone that has never been loaded.
+	initialRetry = 10 * time.Second
+	// timers from the SOA are never honored below this.
+	minInterval = time.Second
+
+	queryTimeout = 5 * time.Second
+)
+
+// Manager keeps a set of zones refreshed from their primaries, honoring the
+// refresh, retry and expire timers in each zone's SOA.
+type Manager struct {
+	zones  []*Zone
+	notify map[*Zone]chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates an empty manager.
+func New() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		notify: map[*Zone]chan struct{}{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add adds a zone transferred from the primaries, which are host:port pairs
+// tried in order. Zones must be added before Run is called.
+func (m *Manager) Add(name string, primaries []string) *Zone {
+	z := newZone(name, primaries)
+	m.zones = append(m.zones, z)
+	m.notify[z] = make(chan struct{}, 1)
+	return z
+}
+
+// Zones returns all the zones.
+func (m *Manager) Zones() []*Zone {
+	return m.zones
+}
+
+// Zone returns the most specific zone that contains name, or nil if no zone
+// does.
+func (m *Manager) Zone(name string) *Zone {
+	var found *Zone
+
+	for _, z := range m.zones {
+		if dns.IsSubDomain(z.name, dns.Fqdn(strings.ToLower(name))) && (found == nil || dns.CountLabel(z.name) > dns.CountLabel(found.name)) {
+			found = z
+		}
+	}
+
+	return found
+}
+
+// Notify schedules an immediate refresh of the zone if from is one of its
+// primaries. The primaries are resolved when the zone is refreshed, not here,
+// so answering a NOTIFY never waits on a lookup. It returns false if the
+// NOTIFY should be refused.
+func (m *Manager) Notify(name string, from net.IP) bool {
+	for _, z := range m.zones {
+		if z.name != dns.Fqdn(strings.ToLower(name)) || !z.isPrimary(from) {
+			continue
+		}
+
+		select {
+		case m.notify[z] <- struct{}{}:
+		default:
+			// a refresh is already pending.
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Run refreshes every zone until the manager is closed.
+func (m *Manager) Run() {
+	for _, z := range m.zones {
+		go m.run(z)
+	}
+
+	<-m.ctx.Done()
+}
+
+// Close stops refreshing zones.
+func (m *Manager) Close() {
+	m.cancel()
+}
+
+func (m *Manager) run(z *Zone) {
+	for {
+		wait := m.refresh(z)
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.notify[z]:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refresh brings the zone up to date and returns how long to wait before the
+// next refresh.
+func (m *Manager) refresh(z *Zone) time.Duration {
+	z.resolve(true)
+
+	err := m.transfer(z)
+
+	z.mutex.RLock()
+	soa := z.soa
+	z.mutex.RUnlock()
+
+	if err == nil {
+		return interval(soa.Refresh)
+	}
+
+	if z.expire() {
+		logrus.Errorf("Zone %q has expired and will not be served: %v", z.name, err)
+	} else {
+		logrus.Errorf("Could not refresh zone %q: %v", z.name, err)
+	}
+
+	if soa == nil {
+		return initialRetry
+	}
+
+	return interval(soa.Retry)
+}
+
+func interval(seconds uint32) time.Duration {
+	d := time.Duration(seconds) * time.Second
+	if d < minInterval {
+		return minInterval
+	}
+
+	return d
+}
+
+// transfer tries each primary in turn until one of them brings the zone up to
+// date.
+func (m *Manager) transfer(z *Zone) error {
+	err := errors.New("no primaries")
+
+	for _, primary := range z.primaries {
+		if err = m.transferFrom(z, primary); err == nil {
+			return nil
+		}
+
+		err = errors.Wrapf(err, "primary %v", primary)
+	}
+
+	return err
+}
+
+func (m *Manager) transferFrom(z *Zone, primary string) error {
+	z.mutex.RLock()
+	soa := z.soa
+	z.mutex.RUnlock()
+
+	if soa != nil {
+		serial, err := querySerial(z.name, primary)
+		if err != nil {
+			return err
+		}
+
+		if !newer(serial, soa.Serial) {
+			z.touch()
+			return nil
+		}
+
+		q := &dns.Msg{}
+		q.SetIxfr(z.name, soa.Serial, soa.Ns, soa.Mbox)
+
+		rrs, err := xfr(q, primary)
+		if err == nil {
+			if err = z.apply(rrs); err == nil {
+				logrus.Infof("Refreshed zone %q from %v incrementally to serial %d", z.name, primary, serial)
+				return nil
+			}
+		}
+
+		logrus.Warnf("Incremental transfer of %q from %v failed, trying a full transfer: %v", z.name, primary, err)
+	}
+
+	q := &dns.Msg{}
+	q.SetAxfr(z.name)
+
+	rrs, err := xfr(q, primary)
+	if err != nil {
+		return err
+	}
+
+	if err := z.load(rrs); err != nil {
+		return err
+	}
+
+	serial, _ := z.Serial()
+	logrus.Infof("Transferred zone %q from %v at serial %d", z.name, primary, serial)
+
+	return nil
+}
+
+// newer compares serials with RFC 1982 arithmetic.
+func newer(a, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+func querySerial(zone, primary string) (uint32, error) {
+	q := &dns.Msg{}
+	q.SetQuestion(zone, dns.TypeSOA)
+
+	c := &dns.Client{Timeout: queryTimeout}
+	reply, _, err := c.Exchange(q, primary)
+	if err != nil {
+		return 0, errors.Wrap(err, "while querying SOA")
+	}
+
+	for _, rr := range reply.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, errors.Errorf("SOA query was answered with %v and no SOA", dns.RcodeToString[reply.Rcode])
+}
+
+func xfr(q *dns.Msg, primary string) ([]dns.RR, error) {
+	tr := &dns.Transfer{DialTimeout: queryTimeout, ReadTimeout: queryTimeout}
+
+	envelopes, err := tr.In(q, primary)
+	if err != nil {
+		return nil, errors.Wrap(err, "while starting transfer")
+	}
+
+	rrs := []dns.RR{}
+	for env := range envelopes {
+		if env.Error != nil {
+			err = env.Error
+			continue
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "during transfer")
+	}
+
+	return rrs, nil
+}
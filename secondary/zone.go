@@ -0,0 +1,277 @@
+// Package secondary transfers zones from external primaries, like BIND, and
+// keeps them fresh so ldnsd can serve them next to its own records.
+package secondary
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Zone is a zone transferred from a primary. Its records are kept in memory.
+type Zone struct {
+	name      string // always fully qualified and lower case
+	primaries []string
+
+	mutex     sync.RWMutex
+	soa       *dns.SOA
+	records   []dns.RR // everything but the SOA
+	refreshed time.Time
+	expired   bool
+	// the addresses of each primary, which NOTIFY messages are accepted from.
+	addrs map[string][]net.IP
+}
+
+func newZone(name string, primaries []string) *Zone {
+	z := &Zone{name: dns.Fqdn(strings.ToLower(name)), primaries: primaries, addrs: map[string][]net.IP{}}
+	z.resolve(false)
+	return z
+}
+
+// resolve finds the addresses of the primaries. Names are only looked up if
+// lookup is true; a name that cannot be resolved keeps its previous
+// addresses.
+func (z *Zone) resolve(lookup bool) {
+	for _, primary := range z.primaries {
+		host, _, err := net.SplitHostPort(primary)
+		if err != nil {
+			continue
+		}
+
+		addrs := []net.IP{net.ParseIP(host)}
+		if addrs[0] == nil {
+			if !lookup {
+				continue
+			}
+
+			if addrs, err = net.LookupIP(host); err != nil {
+				continue
+			}
+		}
+
+		z.mutex.Lock()
+		z.addrs[primary] = addrs
+		z.mutex.Unlock()
+	}
+}
+
+// isPrimary returns true if ip is an address of one of the primaries, as of
+// the last time they were resolved.
+func (z *Zone) isPrimary(ip net.IP) bool {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	for _, addrs := range z.addrs {
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Name returns the fully qualified name of the zone.
+func (z *Zone) Name() string {
+	return z.name
+}
+
+// Primaries returns the primaries the zone is transferred from.
+func (z *Zone) Primaries() []string {
+	return z.primaries
+}
+
+// Serial returns the serial of the zone and whether the zone has been loaded.
+func (z *Zone) Serial() (uint32, bool) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	if z.soa == nil {
+		return 0, false
+	}
+
+	return z.soa.Serial, true
+}
+
+// Lookup answers a question from the zone. ok is false if the zone cannot be
+// served, because it has not been loaded yet or has expired.
+func (z *Zone) Lookup(name string, qtype uint16) (answer, ns []dns.RR, rcode int, ok bool) {
+	z.mutex.RLock()
+	defer z.mutex.RUnlock()
+
+	if z.soa == nil || z.expired {
+		return nil, nil, dns.RcodeServerFailure, false
+	}
+
+	name = strings.ToLower(name)
+
+	if name == z.name && (qtype == dns.TypeSOA || qtype == dns.TypeANY) {
+		answer = append(answer, dns.Copy(z.soa))
+	}
+
+	var exists bool
+	for _, rr := range z.records {
+		if strings.ToLower(rr.Header().Name) != name {
+			continue
+		}
+
+		exists = true
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			answer = append(answer, dns.Copy(rr))
+		}
+	}
+
+	if len(answer) > 0 {
+		return answer, nil, dns.RcodeSuccess, true
+	}
+
+	// negative answers carry the SOA so resolvers know how long to cache them.
+	ns = []dns.RR{dns.Copy(z.soa)}
+
+	if exists || name == z.name {
+		return nil, ns, dns.RcodeSuccess, true
+	}
+
+	return nil, ns, dns.RcodeNameError, true
+}
+
+// load replaces the contents of the zone with the result of a full transfer.
+func (z *Zone) load(rrs []dns.RR) error {
+	soa, records, err := splitTransfer(rrs)
+	if err != nil {
+		return err
+	}
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	z.soa = soa
+	z.records = records
+	z.refreshed = time.Now()
+	z.expired = false
+
+	return nil
+}
+
+// touch marks the zone as refreshed without changing its contents.
+func (z *Zone) touch() {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	z.refreshed = time.Now()
+	z.expired = false
+}
+
+// expire stops the zone from being served if it has not been refreshed within
+// the expire time of its SOA. It returns true if the zone is expired.
+func (z *Zone) expire() bool {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if z.soa != nil && time.Since(z.refreshed) > time.Duration(z.soa.Expire)*time.Second {
+		z.expired = true
+	}
+
+	return z.expired
+}
+
+// apply applies the result of an IXFR request. The reply may also be a full
+// transfer, or a single SOA when the zone is up to date.
+func (z *Zone) apply(rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		return errors.New("empty transfer")
+	}
+
+	newSOA, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return errors.New("transfer did not start with an SOA")
+	}
+
+	if len(rrs) == 1 {
+		z.touch()
+		return nil
+	}
+
+	if _, ok := rrs[1].(*dns.SOA); !ok {
+		// not incremental; this is a full transfer.
+		return z.load(rrs)
+	}
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if z.soa == nil {
+		return errors.New("incremental transfer for a zone that was never loaded")
+	}
+
+	records := make([]dns.RR, len(z.records))
+	copy(records, z.records)
+
+	// the body is a series of differences: the old SOA, records to delete, the
+	// new SOA, records to add; then the final SOA.
+	var (
+		serial   = z.soa.Serial
+		deleting bool
+	)
+
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if !deleting {
+				if soa.Serial != serial {
+					return errors.Errorf("difference starts at serial %d, but the zone is at %d", soa.Serial, serial)
+				}
+				deleting = true
+			} else {
+				serial = soa.Serial
+				deleting = false
+			}
+			continue
+		}
+
+		if deleting {
+			for i, existing := range records {
+				if dns.IsDuplicate(existing, rr) {
+					records = append(records[:i], records[i+1:]...)
+					break
+				}
+			}
+		} else {
+			records = append(records, rr)
+		}
+	}
+
+	if serial != newSOA.Serial {
+		return errors.Errorf("differences ended at serial %d instead of %d", serial, newSOA.Serial)
+	}
+
+	z.soa = newSOA
+	z.records = records
+	z.refreshed = time.Now()
+	z.expired = false
+
+	return nil
+}
+
+// splitTransfer validates a full transfer and separates the SOA from the
+// other records.
+func splitTransfer(rrs []dns.RR) (*dns.SOA, []dns.RR, error) {
+	if len(rrs) < 2 {
+		return nil, nil, errors.New("transfer is too short")
+	}
+
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, nil, errors.New("transfer did not start with an SOA")
+	}
+
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		return nil, nil, errors.New("transfer did not end with an SOA")
+	}
+
+	return soa, rrs[1 : len(rrs)-1], nil
+}
@@ -0,0 +1,151 @@
+package secondary
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func rrs(t *testing.T, records ...string) []dns.RR {
+	ret := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, rr)
+	}
+
+	return ret
+}
+
+func soa(serial string) string {
+	return "example.com. 60 IN SOA ns.example.com. hostmaster.example.com. " + serial + " 3600 600 86400 60"
+}
+
+func TestApply(t *testing.T) {
+	table := map[string]struct {
+		transfer []string
+		serial   uint32
+		hosts    map[string]string
+		success  bool
+	}{
+		"up to date": {
+			transfer: []string{soa("1")},
+			serial:   1,
+			hosts:    map[string]string{"a.example.com.": "10.0.0.1", "b.example.com.": "10.0.0.2"},
+			success:  true,
+		},
+		"incremental": {
+			transfer: []string{
+				soa("3"),
+				soa("1"), "a.example.com. 60 IN A 10.0.0.1", soa("2"), "a.example.com. 60 IN A 10.0.0.3",
+				soa("2"), "b.example.com. 60 IN A 10.0.0.2", soa("3"), "c.example.com. 60 IN A 10.0.0.4",
+				soa("3"),
+			},
+			serial:  3,
+			hosts:   map[string]string{"a.example.com.": "10.0.0.3", "b.example.com.": "", "c.example.com.": "10.0.0.4"},
+			success: true,
+		},
+		"full": {
+			transfer: []string{soa("5"), "d.example.com. 60 IN A 10.0.0.5", soa("5")},
+			serial:   5,
+			hosts:    map[string]string{"a.example.com.": "", "d.example.com.": "10.0.0.5"},
+			success:  true,
+		},
+		"gap": {
+			transfer: []string{soa("3"), soa("2"), soa("3"), soa("3")},
+			success:  false,
+		},
+		"no soa": {
+			transfer: []string{"a.example.com. 60 IN A 10.0.0.1"},
+			success:  false,
+		},
+	}
+
+	for testName, result := range table {
+		z := newZone("Example.com", []string{"127.0.0.1:53"})
+		if err := z.load(rrs(t, soa("1"), "a.example.com. 60 IN A 10.0.0.1", "b.example.com. 60 IN A 10.0.0.2", soa("1"))); err != nil {
+			t.Fatal(err)
+		}
+
+		err := z.apply(rrs(t, result.transfer...))
+		if (err == nil) != result.success {
+			t.Fatalf("Result for %q should be success (%v) but was %v", testName, result.success, err)
+		}
+
+		if !result.success {
+			continue
+		}
+
+		if serial, _ := z.Serial(); serial != result.serial {
+			t.Fatalf("Result for %q: serial was %d, not %d", testName, serial, result.serial)
+		}
+
+		for host, addr := range result.hosts {
+			answer, _, rcode, ok := z.Lookup(host, dns.TypeA)
+			if !ok {
+				t.Fatalf("Result for %q: zone could not be served", testName)
+			}
+
+			switch {
+			case addr == "" && rcode != dns.RcodeNameError:
+				t.Fatalf("Result for %q: %q should not exist but was %v", testName, host, answer)
+			case addr != "" && (len(answer) != 1 || answer[0].(*dns.A).A.String() != addr):
+				t.Fatalf("Result for %q: %q should be %s but was %v", testName, host, addr, answer)
+			}
+		}
+	}
+}
+
+func TestNewer(t *testing.T) {
+	table := map[string]struct {
+		a, b   uint32
+		result bool
+	}{
+		"greater":   {a: 2, b: 1, result: true},
+		"equal":     {a: 1, b: 1, result: false},
+		"smaller":   {a: 1, b: 2, result: false},
+		"wrapped":   {a: 1, b: 0xfffffff0, result: true},
+		"unwrapped": {a: 0xfffffff0, b: 1, result: false},
+	}
+
+	for testName, result := range table {
+		if newer(result.a, result.b) != result.result {
+			t.Fatalf("Result for %q should be %v", testName, result.result)
+		}
+	}
+}
+
+func TestIsPrimary(t *testing.T) {
+	z := newZone("example.com", []string{"10.0.0.1:53", "localhost:5300"})
+
+	table := map[string]struct {
+		ip       string
+		resolved bool
+		primary  bool
+	}{
+		"address":                 {ip: "10.0.0.1", primary: true},
+		"name before resolving":   {ip: "127.0.0.1", primary: false},
+		"name after resolving":    {ip: "127.0.0.1", resolved: true, primary: true},
+		"address after resolving": {ip: "10.0.0.1", resolved: true, primary: true},
+		"other":                   {ip: "10.0.0.2", resolved: true, primary: false},
+	}
+
+	for _, resolved := range []bool{false, true} {
+		if resolved {
+			z.resolve(true)
+		}
+
+		for testName, result := range table {
+			if result.resolved != resolved {
+				continue
+			}
+
+			if z.isPrimary(net.ParseIP(result.ip)) != result.primary {
+				t.Fatalf("Result for %q should be %v", testName, result.primary)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/erikh/ldnsd/acl"
+	"github.com/erikh/ldnsd/config"
+	"github.com/erikh/ldnsd/dnstap"
+	"github.com/erikh/ldnsd/responder"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// listener is a configured listener, and the servers for every address and
+// protocol it serves.
+type listener struct {
+	address  string
+	protocol string
+	acl      *acl.Handler
+	servers  []*dns.Server
+	// resolved is true if the address is a host name.
+	resolved bool
+}
+
+// newListener creates the servers for the listener. Its ACL, if it has none
+// of its own, is the top-level one. The queries are logged to tap, if there is
+// one, before they are checked against the ACL.
+func newListener(c *config.Listener, handler dns.Handler, list *acl.List, tsigSecrets map[string]string, tap *dnstap.Logger) (*listener, error) {
+	if c.ACL != nil {
+		var err error
+		if list, err = newACL(*c.ACL); err != nil {
+			return nil, errors.Wrap(err, "invalid acl configuration")
+		}
+	}
+
+	addrs, resolved, err := resolve(c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{address: c.Address, protocol: c.Protocol, acl: acl.NewHandler(handler, list), resolved: resolved}
+
+	for _, protocol := range c.Protocols() {
+		tapProtocol := dnstap.SocketProtocol_UDP
+		if protocol == config.ProtocolTCP {
+			tapProtocol = dnstap.SocketProtocol_TCP
+		}
+
+		for _, addr := range addrs {
+			srv := &dns.Server{
+				Addr:          addr,
+				Net:           protocol,
+				Handler:       tap.Handler(l.acl, tapProtocol),
+				TsigSecret:    tsigSecrets,
+				MsgAcceptFunc: responder.AcceptMsg,
+			}
+
+			if protocol == config.ProtocolUDP {
+				srv.UDPSize = responder.UDPBufferSize
+			}
+
+			l.servers = append(l.servers, srv)
+		}
+	}
+
+	return l, nil
+}
+
+// resolve returns the addresses to listen on for the host:port. A host name
+// is resolved to all of its addresses, and resolved is true.
+func resolve(hostport string) (addrs []string, resolved bool, err error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "invalid address %q", hostport)
+	}
+
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{hostport}, false, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "while resolving %q", host)
+	}
+
+	seen := map[string]struct{}{}
+
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, true, nil
+}
+
+// bindAll binds the servers of the listener. An address a host name resolved
+// to is skipped if it is not available on this host, like ::1 for localhost
+// where there is no IPv6, as long as every protocol is bound to another
+// address; the listener is left with the servers that were bound.
+func (l *listener) bindAll() error {
+	bound := []*dns.Server{}
+	protocols := map[string]struct{}{}
+
+	for _, srv := range l.servers {
+		if err := bind(srv); err != nil {
+			if l.resolved && unavailable(err) {
+				logrus.Warnf("Not serving DNS on %s/%s for %q: %v", srv.Net, srv.Addr, l.address, err)
+				continue
+			}
+
+			for _, srv := range bound {
+				unbind(srv)
+			}
+			return err
+		}
+
+		bound = append(bound, srv)
+		protocols[srv.Net] = struct{}{}
+	}
+
+	for _, srv := range l.servers {
+		if _, ok := protocols[srv.Net]; !ok {
+			for _, srv := range bound {
+				unbind(srv)
+			}
+			return errors.Errorf("no address of %q could be bound for %s", l.address, srv.Net)
+		}
+	}
+
+	l.servers = bound
+	return nil
+}
+
+// unavailable returns true if the error is for an address that does not
+// exist on this host, rather than one that is in use.
+func unavailable(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+// bind opens the socket of the server, so it can be served with
+// ActivateAndServe.
+func bind(srv *dns.Server) error {
+	var err error
+
+	switch srv.Net {
+	case config.ProtocolUDP:
+		srv.PacketConn, err = net.ListenPacket(srv.Net, srv.Addr)
+	default:
+		srv.Listener, err = net.Listen(srv.Net, srv.Addr)
+	}
+
+	return errors.Wrapf(err, "while listening on %s/%s", srv.Net, srv.Addr)
+}
+
+// unbind closes the socket of a server that may never have been served.
+func unbind(srv *dns.Server) {
+	if srv.PacketConn != nil {
+		srv.PacketConn.Close()
+	}
+
+	if srv.Listener != nil {
+		srv.Listener.Close()
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/erikh/ldnsd/config"
+	"github.com/miekg/dns"
+)
+
+func TestBindAll(t *testing.T) {
+	// 192.0.2.1 is a documentation address that no host has.
+	servers := func() []*dns.Server {
+		return []*dns.Server{
+			{Addr: "127.0.0.1:0", Net: config.ProtocolUDP},
+			{Addr: "192.0.2.1:0", Net: config.ProtocolUDP},
+			{Addr: "127.0.0.1:0", Net: config.ProtocolTCP},
+		}
+	}
+
+	table := map[string]struct {
+		listener *listener
+		servers  int
+		success  bool
+	}{
+		"resolved skips what is missing": {listener: &listener{address: "ldnsd:0", resolved: true, servers: servers()}, servers: 2, success: true},
+		"addresses must all bind":        {listener: &listener{address: "192.0.2.1:0", servers: servers()}},
+		"resolved needs every protocol": {listener: &listener{address: "ldnsd:0", resolved: true, servers: []*dns.Server{
+			{Addr: "127.0.0.1:0", Net: config.ProtocolUDP},
+			{Addr: "192.0.2.1:0", Net: config.ProtocolTCP},
+		}}},
+	}
+
+	for name, result := range table {
+		err := result.listener.bindAll()
+		if result.success && err != nil {
+			t.Fatalf("Result for %q should be success but was %v", name, err)
+		} else if !result.success && err == nil {
+			t.Fatalf("Result for %q should NOT be success but was.", name)
+		}
+
+		if !result.success {
+			continue
+		}
+
+		if len(result.listener.servers) != result.servers {
+			t.Fatalf("Result for %q should be %d servers but was %d", name, result.servers, len(result.listener.servers))
+		}
+
+		for _, srv := range result.listener.servers {
+			unbind(srv)
+		}
+	}
+}
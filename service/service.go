@@ -2,15 +2,33 @@ package service
 
 import (
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/erikh/dnsserver"
 	"github.com/erikh/go-transport"
+	"github.com/erikh/ldnsd/acl"
+	"github.com/erikh/ldnsd/cluster"
 	"github.com/erikh/ldnsd/config"
 	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/erikh/ldnsd/dnssec"
+	"github.com/erikh/ldnsd/dnstap"
+	"github.com/erikh/ldnsd/doh"
+	"github.com/erikh/ldnsd/doq"
+	"github.com/erikh/ldnsd/forward"
+	"github.com/erikh/ldnsd/health"
 	"github.com/erikh/ldnsd/proto"
+	"github.com/erikh/ldnsd/replica"
+	"github.com/erikh/ldnsd/responder"
+	"github.com/erikh/ldnsd/rrl"
+	"github.com/erikh/ldnsd/secondary"
+	"github.com/erikh/ldnsd/version"
+	"github.com/erikh/ldnsd/webhook"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -22,65 +40,523 @@ type Service struct {
 	appName string
 	grpcS   *grpc.Server
 	l       net.Listener
-	handler *dnsserver.Server
+	db      *dnsdb.DB
+	dns     []*listener
+	dot     *dns.Server
+	doh     *http.Server
+	doq     *doq.Server
+	acl     *acl.Handler
+
+	follower *replica.Follower
+	notifier *responder.Notifier
+	zones    *secondary.Manager
+	node     *cluster.Node
+	webhooks *webhook.Dispatcher
+	checker  *health.Checker
+	tap      *dnstap.Logger
 }
 
 // InstallSignalHandler installs a signal handler that allows it to trap exit
-// conditions to react to them, like gracefully shutting down.
-func (s *Service) InstallSignalHandler() {
+// conditions to react to them, like gracefully shutting down. SIGHUP reloads
+// the configuration from configFile.
+func (s *Service) InstallSignalHandler(configFile string) {
 	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for {
 			switch <-sigChan {
-			// FIXME add config reload as SIGUSR1 or SIGHUP
+			case syscall.SIGHUP:
+				c, err := config.Parse(configFile)
+				if err == nil {
+					err = s.Reload(c)
+				}
+
+				if err != nil {
+					logrus.Errorf("Could not reload configuration: %v", err)
+				} else {
+					logrus.Infof("Reloaded configuration from %v", configFile)
+				}
 			case syscall.SIGTERM, syscall.SIGINT:
 				s.Shutdown()
 				os.Exit(0)
 			}
 		}
 	}()
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+}
+
+// Reload applies the parts of the configuration that can change while the
+// service runs: the ACLs. The ACL of a listener is taken from the listener
+// with the same address and protocol in c. Everything else, including which
+// listeners there are, takes a restart.
+func (s *Service) Reload(c *config.Config) error {
+	list, err := newACL(c.ACL)
+	if err != nil {
+		return errors.Wrap(err, "invalid acl configuration")
+	}
+
+	lists := make([]*acl.List, len(s.dns))
+	for i, l := range s.dns {
+		lists[i] = list
+
+		for _, lc := range c.DNSListen {
+			if lc.Address != l.address || lc.Protocol != l.protocol || lc.ACL == nil {
+				continue
+			}
+
+			lists[i], err = newACL(*lc.ACL)
+			if err != nil {
+				return errors.Wrapf(err, "invalid acl configuration for listener %q", lc.Address)
+			}
+		}
+	}
+
+	// nothing is changed unless every list is valid.
+	for i, l := range s.dns {
+		l.acl.Set(lists[i])
+	}
+	s.acl.Set(list)
+
+	return nil
+}
+
+func newACL(c config.ACL) (*acl.List, error) {
+	allow, err := c.AllowNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := c.DenyNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	return acl.New(allow, deny, c.Drop()), nil
 }
 
 // New constructs a new service from a config.Config
-func New(name string, c *config.Config) (*Service, error) {
+func New(name string, c *config.Config) (_ *Service, err error) {
 	db, err := dnsdb.New(c.DBFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not open database")
 	}
 
+	var (
+		tap      *dnstap.Logger
+		node     *cluster.Node
+		l        net.Listener
+		webhooks *webhook.Dispatcher
+	)
+
+	// what was opened is closed again if the service cannot be created.
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if webhooks != nil {
+			webhooks.Close()
+		}
+		if l != nil {
+			l.Close()
+		}
+		if node != nil {
+			node.Close()
+		}
+		if tap != nil {
+			tap.Close()
+		}
+		db.Close()
+	}()
+
+	if err := db.SetStatic(c.Records); err != nil {
+		return nil, errors.Wrap(err, "could not load static records")
+	}
+
+	db.SetJournalSize(*c.JournalSize)
+
 	cert, err := c.Certificate.NewCert()
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid certificate configuration")
 	}
 
+	transferAllow, err := c.Transfer.Networks()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid transfer configuration")
+	}
+
+	notifyTargets, err := c.Transfer.NotifyTargets()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid transfer configuration")
+	}
+
+	var zones *secondary.Manager
+	if len(c.Zones) > 0 {
+		zones = secondary.New()
+		names := []string{}
+
+		for _, z := range c.Zones {
+			primaries, err := z.PrimaryAddrs()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid configuration for zone %q", z.Name)
+			}
+
+			names = append(names, zones.Add(z.Name, primaries).Name())
+		}
+
+		db.SetTransferred(c.Domain, names)
+	}
+
+	views := []responder.View{}
+	viewNames := []string{}
+	for _, v := range c.Views {
+		networks, err := v.IPNets()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid configuration for view %q", v.Name)
+		}
+
+		views = append(views, responder.View{Name: v.Name, Networks: networks})
+		viewNames = append(viewNames, v.Name)
+	}
+
+	db.SetViews(viewNames)
+
 	srv := dnsserver.NewWithDB(c.Domain, db)
-	grpcS := proto.Boot(srv)
-	l, err := transport.Listen(cert, "tcp", c.GRPCListen)
+	resp := responder.New(c.Domain, srv, db, transferAllow)
+	if zones != nil {
+		resp.SetZones(zones)
+	}
+
+	if len(views) > 0 {
+		resp.SetViews(views)
+	}
+
+	checker := health.New(db, time.Duration(c.HealthInterval)*time.Second)
+	resp.SetHealth(checker)
+
+	if len(c.Forward.Upstreams) > 0 || len(c.Forward.Zones) > 0 {
+		upstreams, err := c.Forward.UpstreamAddrs()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid forward configuration")
+		}
+
+		forwarder := forward.New(upstreams)
+		for _, z := range c.Forward.Zones {
+			upstreams, err := z.UpstreamAddrs()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid configuration for forwarded zone %q", z.Name)
+			}
+
+			forwarder.AddZone(z.Name, upstreams)
+		}
+
+		resp.SetForwarder(forwarder)
+	}
+
+	var signer *dnssec.Signer
+	if c.DNSSEC != nil {
+		alg, err := c.DNSSEC.AlgorithmNumber()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dnssec configuration")
+		}
+
+		signer, err = dnssec.Load(dnssec.Config{
+			Zone:           c.Domain,
+			KeyFile:        c.DNSSEC.KeyFile,
+			PrivateKeyFile: c.DNSSEC.PrivateKeyFile,
+			Algorithm:      alg,
+			NSEC3:          c.DNSSEC.NSEC3,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading dnssec key")
+		}
+
+		resp.SetSigner(signer)
+	}
+
+	// the servers verify TSIG, and the responder decides what each key may do.
+	var tsigSecrets map[string]string
+	if len(c.UpdateKeys) > 0 {
+		tsigSecrets = map[string]string{}
+		keys := []responder.UpdateKey{}
+
+		for _, k := range c.UpdateKeys {
+			tsigSecrets[dns.Fqdn(strings.ToLower(k.Name))] = k.Secret
+			keys = append(keys, responder.UpdateKey{Name: k.Name, Algorithm: k.Algorithm, Names: k.Names})
+		}
+
+		resp.SetUpdateKeys(keys)
+	}
+
+	var limiter *rrl.Limiter
+	if c.RateLimit != nil {
+		exempt, err := c.RateLimit.ExemptNetworks()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid rate_limit configuration")
+		}
+
+		limiter = rrl.New(rrl.Config{
+			ResponsesPerSecond: c.RateLimit.ResponsesPerSecond,
+			NXDomainsPerSecond: c.RateLimit.NXDomainsPerSecond,
+			ErrorsPerSecond:    c.RateLimit.ErrorsPerSecond,
+			Slip:               *c.RateLimit.Slip,
+			IPv4PrefixLength:   c.RateLimit.IPv4PrefixLength,
+			IPv6PrefixLength:   c.RateLimit.IPv6PrefixLength,
+			Exempt:             exempt,
+		})
+
+		resp.SetRateLimiter(limiter)
+	}
+
+	list, err := newACL(c.ACL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid acl configuration")
+	}
+
+	// the ACL is checked first, so denied clients cost nothing else.
+	handler := acl.NewHandler(resp, list)
+
+	if c.DNSTap != nil {
+		tap, err = dnstap.New(dnstap.Config{
+			Socket:    c.DNSTap.Socket,
+			File:      c.DNSTap.File,
+			Identity:  c.DNSTap.Identity,
+			Version:   name + " " + version.Version,
+			QueueSize: c.DNSTap.QueueSize,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dnstap configuration")
+		}
+	}
+
+	if c.Cluster != nil {
+		node, err = newNode(db, cert, c.Cluster)
+		if err != nil {
+			return nil, errors.Wrap(err, "while joining cluster")
+		}
+
+		db.SetProposer(node)
+	}
+
+	grpcS := proto.Boot(srv, db, node, signer, limiter, checker, tap)
+	l, err = transport.Listen(cert, "tcp", c.GRPCListen)
 	if err != nil {
 		return nil, errors.Wrap(err, "while configuring grpc listener")
 	}
 
-	return &Service{
+	s := &Service{
 		l:       l,
 		grpcS:   grpcS,
-		handler: srv,
+		db:      db,
+		acl:     handler,
 		appName: name,
 		config:  c,
-	}, nil
+		zones:   zones,
+		node:    node,
+		checker: checker,
+		tap:     tap,
+	}
+
+	for _, lc := range c.DNSListen {
+		dl, err := newListener(lc, resp, list, tsigSecrets, tap)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid configuration for listener %q", lc.Address)
+		}
+
+		s.dns = append(s.dns, dl)
+	}
+
+	if c.DoTListen != "" {
+		dotCert := c.DoTCertificate
+		if dotCert == nil {
+			dotCert = &c.Certificate
+		}
+
+		tlsConfig, err := dotCert.TLSConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dns-over-tls configuration")
+		}
+
+		s.dot = &dns.Server{Addr: c.DoTListen, Net: "tcp-tls", Handler: tap.Handler(handler, dnstap.SocketProtocol_DOT), TLSConfig: tlsConfig, TsigSecret: tsigSecrets, MsgAcceptFunc: responder.AcceptMsg}
+	}
+
+	if c.DoHListen != "" {
+		dohCert := c.DoHCertificate
+		if dohCert == nil {
+			dohCert = &c.Certificate
+		}
+
+		tlsConfig, err := dohCert.TLSConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dns-over-https configuration")
+		}
+
+		s.doh = &http.Server{Addr: c.DoHListen, Handler: doh.New(tap.Handler(handler, dnstap.SocketProtocol_DOH)).Mux(), TLSConfig: tlsConfig}
+	}
+
+	if c.DoQListen != "" {
+		doqCert := c.DoQCertificate
+		if doqCert == nil {
+			doqCert = &c.Certificate
+		}
+
+		tlsConfig, err := doqCert.TLSConfig()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid dns-over-quic configuration")
+		}
+
+		s.doq = &doq.Server{Addr: c.DoQListen, Handler: tap.Handler(handler, dnstap.SocketProtocol_DOQ), TLSConfig: tlsConfig}
+	}
+
+	if len(notifyTargets) > 0 {
+		s.notifier = resp.NewNotifier(notifyTargets)
+	}
+
+	if len(c.Webhooks) > 0 {
+		hooks := []webhook.Hook{}
+		for _, w := range c.Webhooks {
+			hooks = append(hooks, webhook.Hook{URL: w.URL, Secret: w.Secret})
+		}
+
+		webhooks, err = webhook.New(db, c.Domain, hooks, c.WebhookQueue, c.WebhookQueueSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "while configuring webhooks")
+		}
+		s.webhooks = webhooks
+	}
+
+	if c.Primary != nil {
+		pc := c.Primary.Certificate
+		client, err := proto.NewClient(c.Primary.Host, pc.CAFile, pc.CertFile, pc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "while configuring primary client")
+		}
+
+		db.SetReadOnly(c.Primary.Host)
+		s.follower = replica.New(db, client)
+	}
+
+	return s, nil
+}
+
+func newNode(db *dnsdb.DB, cert *transport.Cert, c *config.Cluster) (*cluster.Node, error) {
+	peers := []cluster.Peer{}
+	for _, p := range c.Peers {
+		peers = append(peers, cluster.Peer{ID: p.ID, Address: p.Address})
+	}
+
+	return cluster.New(db, cluster.Config{
+		ID:     c.ID,
+		Listen: c.Listen,
+		Dir:    c.Dir,
+		Peers:  peers,
+		Cert:   cert,
+	})
 }
 
 // Shutdown the service.
 func (s *Service) Shutdown() {
 	logrus.Infof("Stopping %v...", s.appName)
+	if s.follower != nil {
+		s.follower.Close()
+	}
+	if s.notifier != nil {
+		s.notifier.Close()
+	}
+	if s.zones != nil {
+		s.zones.Close()
+	}
+	if s.webhooks != nil {
+		s.webhooks.Close()
+	}
+	s.checker.Close()
+	// watches never end on their own; end them so the graceful stop can finish.
+	s.db.CloseWatchers()
 	s.grpcS.GracefulStop()
 	s.l.Close()
-	s.handler.Close()
+	if s.node != nil {
+		s.node.Close()
+	}
+	for _, l := range s.dns {
+		for _, srv := range l.servers {
+			srv.Shutdown()
+			unbind(srv)
+		}
+	}
+	if s.dot != nil {
+		s.dot.Shutdown()
+	}
+	if s.doh != nil {
+		s.doh.Close()
+	}
+	if s.doq != nil {
+		s.doq.Shutdown()
+	}
+	// the servers are stopped, so nothing more is logged.
+	if s.tap != nil {
+		s.tap.Close()
+	}
+	s.db.Close()
 	logrus.Infof("Done.")
 }
 
 // Boot the service
 func (s *Service) Boot() error {
+	// every DNS listener is bound before anything is served, so a bad address
+	// stops the service right away.
+	servers := []*dns.Server{}
+	for _, l := range s.dns {
+		if err := l.bindAll(); err != nil {
+			for _, srv := range servers {
+				unbind(srv)
+			}
+			return err
+		}
+
+		servers = append(servers, l.servers...)
+	}
+
+	if s.follower != nil {
+		go s.follower.Run()
+	}
+
+	if s.notifier != nil {
+		go s.notifier.Run()
+	}
+
+	if s.zones != nil {
+		go s.zones.Run()
+	}
+
+	if s.webhooks != nil {
+		go s.webhooks.Run()
+	}
+
+	go s.checker.Run()
+
+	if s.tap != nil {
+		go s.tap.Run()
+	}
+
 	go s.grpcS.Serve(s.l)
-	return s.handler.Listen(s.config.DNSListen)
+
+	errChan := make(chan error, len(servers)+3)
+	for _, srv := range servers {
+		logrus.Infof("Serving DNS on %s/%s", srv.Net, srv.Addr)
+		go func(srv *dns.Server) { errChan <- srv.ActivateAndServe() }(srv)
+	}
+
+	if s.dot != nil {
+		go func() { errChan <- s.dot.ListenAndServe() }()
+	}
+
+	if s.doh != nil {
+		// the certificate is already in TLSConfig.
+		go func() { errChan <- s.doh.ListenAndServeTLS("", "") }()
+	}
+
+	if s.doq != nil {
+		go func() { errChan <- s.doq.ListenAndServe() }()
+	}
+
+	return <-errChan
 }
@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // import sqlite3
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// delivery is an event waiting to be posted to a URL.
+type delivery struct {
+	ID        uint64 `gorm:"primary_key"`
+	URL       string `gorm:"index"`
+	Type      string
+	Body      []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// queueState remembers the revision of the last event queued, so events
+// committed while ldnsd was down are queued when it starts.
+type queueState struct {
+	ID       uint `gorm:"primary_key"`
+	Revision uint64
+}
+
+const queueStateID = 1
+
+// queue is the on-disk queue of deliveries. It never holds more than size
+// deliveries; the oldest are dropped to make room.
+type queue struct {
+	db   *gorm.DB
+	size int
+}
+
+func newQueue(filename string, size int) (*queue, error) {
+	db, err := gorm.Open("sqlite3", filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open webhook queue")
+	}
+
+	if err := db.AutoMigrate(&delivery{}, &queueState{}).Error; err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "while migrating webhook queue")
+	}
+
+	return &queue{db: db, size: size}, nil
+}
+
+func (q *queue) Close() error {
+	return q.db.Close()
+}
+
+// revision returns the revision of the last event queued, and false if no
+// event was ever queued.
+func (q *queue) revision() (uint64, bool, error) {
+	state := &queueState{}
+	err := q.db.First(state, queueStateID).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, errors.Wrap(err, "while reading webhook queue")
+	}
+
+	return state.Revision, true, nil
+}
+
+func (q *queue) setRevision(revision uint64) error {
+	if err := q.db.Save(&queueState{ID: queueStateID, Revision: revision}).Error; err != nil {
+		return errors.Wrap(err, "while writing webhook queue")
+	}
+
+	return nil
+}
+
+// push queues deliveries for an event and records its revision, in one
+// transaction.
+func (q *queue) push(revision uint64, deliveries []*delivery) error {
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		for _, d := range deliveries {
+			if err := tx.Create(d).Error; err != nil {
+				return errors.Wrap(err, "while queueing webhook")
+			}
+		}
+
+		if err := tx.Save(&queueState{ID: queueStateID, Revision: revision}).Error; err != nil {
+			return errors.Wrap(err, "while writing webhook queue")
+		}
+
+		return q.trim(tx)
+	})
+}
+
+// trim drops the oldest deliveries that do not fit in the queue.
+func (q *queue) trim(tx *gorm.DB) error {
+	var count int
+	if err := tx.Model(&delivery{}).Count(&count).Error; err != nil {
+		return errors.Wrap(err, "while counting webhook queue")
+	}
+
+	if count <= q.size {
+		return nil
+	}
+
+	dropped := []*delivery{}
+	if err := tx.Order("id asc").Limit(count - q.size).Find(&dropped).Error; err != nil {
+		return errors.Wrap(err, "while trimming webhook queue")
+	}
+
+	for _, d := range dropped {
+		if err := tx.Delete(d).Error; err != nil {
+			return errors.Wrap(err, "while trimming webhook queue")
+		}
+	}
+
+	logrus.Warnf("Webhook queue is full; dropped %d undelivered events", len(dropped))
+	return nil
+}
+
+// next returns the oldest delivery for url, or nil if there is none.
+func (q *queue) next(url string) (*delivery, error) {
+	d := &delivery{}
+	err := q.db.Order("id asc").First(d, "url = ?", url).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "while reading webhook queue")
+	}
+
+	return d, nil
+}
+
+func (q *queue) remove(d *delivery) error {
+	if err := q.db.Delete(d).Error; err != nil {
+		return errors.Wrap(err, "while removing delivered webhook")
+	}
+
+	return nil
+}
+
+func (q *queue) failed(d *delivery) error {
+	d.Attempts++
+	if err := q.db.Model(d).Update("attempts", d.Attempts).Error; err != nil {
+		return errors.Wrap(err, "while updating webhook queue")
+	}
+
+	return nil
+}
+
+// purge removes deliveries for URLs that are no longer configured.
+func (q *queue) purge(urls []string) error {
+	tx := q.db
+	if len(urls) > 0 {
+		tx = tx.Where("url NOT IN (?)", urls)
+	}
+
+	res := tx.Delete(&delivery{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "while purging webhook queue")
+	}
+
+	if res.RowsAffected > 0 {
+		logrus.Warnf("Dropped %d undelivered events for webhooks that are no longer configured", res.RowsAffected)
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+// Package webhook posts record changes to HTTP endpoints. Events are queued on
+// disk before they are sent, and retried with backoff until the endpoint
+// accepts them.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, as
+	// "sha256=<hex>", when the hook has a secret.
+	SignatureHeader = "X-Ldnsd-Signature"
+	// EventHeader carries the type of the event.
+	EventHeader = "X-Ldnsd-Event"
+	// DeliveryHeader carries an ID that is the same for every attempt to
+	// deliver an event.
+	DeliveryHeader = "X-Ldnsd-Delivery"
+
+	minBackoff     = time.Second
+	maxBackoff     = 5 * time.Minute
+	requestTimeout = 10 * time.Second
+)
+
+// Hook is an endpoint events are posted to.
+type Hook struct {
+	URL string
+	// Secret, if set, is used to sign the body.
+	Secret string
+}
+
+// Event is the JSON body posted for every change.
+type Event struct {
+	Revision uint64    `json:"revision"`
+	Type     string    `json:"type"`
+	Host     string    `json:"host"`
+	View     string    `json:"view,omitempty"`
+	Domain   string    `json:"domain"`
+	Address  string    `json:"address,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Dispatcher queues the database's events for every hook and delivers them.
+type Dispatcher struct {
+	db     *dnsdb.DB
+	domain string
+	hooks  []Hook
+	queue  *queue
+	client *http.Client
+	notify map[string]chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	running bool
+	done    chan struct{}
+}
+
+// New creates a dispatcher for the hooks, queueing events in queueFile. At
+// most queueSize events are kept; the oldest are dropped when it is full.
+func New(db *dnsdb.DB, domain string, hooks []Hook, queueFile string, queueSize int) (*Dispatcher, error) {
+	q, err := newQueue(queueFile, queueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := []string{}
+	notify := map[string]chan struct{}{}
+	for _, h := range hooks {
+		urls = append(urls, h.URL)
+		notify[h.URL] = make(chan struct{}, 1)
+	}
+
+	if err := q.purge(urls); err != nil {
+		q.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Dispatcher{
+		db:     db,
+		domain: domain,
+		hooks:  hooks,
+		queue:  q,
+		client: &http.Client{Timeout: requestTimeout},
+		notify: notify,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Close stops the dispatcher, and returns once the deliveries in flight have
+// finished and the queue is closed. Undelivered events stay in the queue.
+func (d *Dispatcher) Close() {
+	d.cancel()
+
+	d.mutex.Lock()
+	running := d.running
+	d.mutex.Unlock()
+
+	if running {
+		<-d.done
+	} else {
+		d.queue.Close()
+	}
+}
+
+// Run queues and delivers events until the dispatcher is closed.
+func (d *Dispatcher) Run() {
+	d.mutex.Lock()
+	if d.ctx.Err() != nil {
+		// closed before it ran; Close closes the queue.
+		d.mutex.Unlock()
+		return
+	}
+	d.running = true
+	d.mutex.Unlock()
+
+	defer close(d.done)
+	defer d.queue.Close()
+	defer d.wg.Wait()
+
+	for _, h := range d.hooks {
+		d.wg.Add(1)
+		go func(h Hook) {
+			defer d.wg.Done()
+			d.deliver(h)
+		}(h)
+	}
+
+	backoff := minBackoff
+
+	for {
+		err := d.follow()
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if err != nil {
+			logrus.Errorf("Error queueing webhooks: %v", err)
+			backoff = next(backoff)
+		} else {
+			backoff = minBackoff
+		}
+	}
+}
+
+// follow queues every event after the last one queued, until the subscription
+// ends.
+func (d *Dispatcher) follow() error {
+	events, cancel := d.db.Subscribe()
+	defer cancel()
+
+	last, ok, err := d.queue.revision()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		// the first time around, only changes from now on are sent.
+		if last, err = d.db.Revision(); err != nil {
+			return err
+		}
+
+		if err := d.queue.setRevision(last); err != nil {
+			return err
+		}
+	}
+
+	backlog, err := d.db.Events(last)
+	if errors.Cause(err) == dnsdb.ErrCompacted {
+		logrus.Warnf("Changes after revision %d were compacted out of the journal before they could be sent to webhooks: %v", last, err)
+
+		if last, err = d.db.Revision(); err != nil {
+			return err
+		}
+
+		if err := d.queue.setRevision(last); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range backlog {
+		if err := d.push(e); err != nil {
+			return err
+		}
+		last = e.Revision
+	}
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			if e.Revision <= last {
+				continue
+			}
+
+			if err := d.push(e); err != nil {
+				return err
+			}
+			last = e.Revision
+		}
+	}
+}
+
+func (d *Dispatcher) push(e *dnsdb.Event) error {
+	body, err := json.Marshal(&Event{
+		Revision: e.Revision,
+		Type:     e.Type,
+		Host:     e.Host,
+		View:     e.View,
+		Domain:   d.domain,
+		Address:  e.Address,
+		Previous: e.Previous,
+		Time:     e.CreatedAt,
+	})
+	if err != nil {
+		return errors.Wrap(err, "while encoding event")
+	}
+
+	deliveries := []*delivery{}
+	for _, h := range d.hooks {
+		deliveries = append(deliveries, &delivery{URL: h.URL, Type: e.Type, Body: body})
+	}
+
+	if err := d.queue.push(e.Revision, deliveries); err != nil {
+		return err
+	}
+
+	for _, ch := range d.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// deliver posts the hook's queued events in order. An event that cannot be
+// delivered is retried with backoff, and holds up the events after it.
+func (d *Dispatcher) deliver(h Hook) {
+	backoff := minBackoff
+
+	for {
+		wait := backoff
+
+		item, err := d.queue.next(h.URL)
+		switch {
+		case err != nil:
+			logrus.Errorf("Error reading webhook queue: %v", err)
+		case item == nil:
+			wait = 0
+		default:
+			if err := d.post(h, item); err != nil {
+				logrus.Warnf("Could not deliver event %d to %s (attempt %d): %v", item.ID, h.URL, item.Attempts+1, err)
+				if err := d.queue.failed(item); err != nil {
+					logrus.Errorf("Error updating webhook queue: %v", err)
+				}
+				backoff = next(backoff)
+			} else {
+				if err := d.queue.remove(item); err != nil {
+					logrus.Errorf("Error updating webhook queue: %v", err)
+				}
+				backoff = minBackoff
+				continue
+			}
+		}
+
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-timer:
+		case <-d.notify[h.URL]:
+			if wait > 0 {
+				// new events do not cut a backoff short.
+				select {
+				case <-d.ctx.Done():
+					return
+				case <-timer:
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) post(h Hook, item *delivery) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(item.Body))
+	if err != nil {
+		return err
+	}
+
+	// a post in flight is not cut off when the dispatcher closes, since it
+	// would be delivered again on the next start; requestTimeout bounds it.
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, item.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(item.ID, 10))
+
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, item.Body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the signature header value for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func next(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldnsd/dnsdb"
+)
+
+type receiver struct {
+	mutex      sync.Mutex
+	fail       int
+	events     []*Event
+	errors     []string
+	deliveries map[string]struct{}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(SignatureHeader) != Sign("secret", body) {
+		r.errors = append(r.errors, "bad signature")
+	}
+
+	e := &Event{}
+	if err := json.Unmarshal(body, e); err != nil {
+		r.errors = append(r.errors, err.Error())
+	}
+
+	if req.Header.Get(EventHeader) != e.Type {
+		r.errors = append(r.errors, "event header does not match the body")
+	}
+
+	// retries of a delivery that was received are ignored.
+	if r.deliveries == nil {
+		r.deliveries = map[string]struct{}{}
+	}
+
+	if _, ok := r.deliveries[req.Header.Get(DeliveryHeader)]; ok {
+		return
+	}
+	r.deliveries[req.Header.Get(DeliveryHeader)] = struct{}{}
+
+	r.events = append(r.events, e)
+}
+
+func (r *receiver) wait(t *testing.T, count int) []*Event {
+	for i := 0; i < 100; i++ {
+		r.mutex.Lock()
+		events, errs := r.events, r.errors
+		r.mutex.Unlock()
+
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		if len(events) >= count {
+			return events
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("%d events were not delivered", count)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := dnsdb.New(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// changes made before the first start are not sent.
+	if err := db.SetA("old", net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{fail: 1}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	queueFile := filepath.Join(dir, "queue.db")
+	hooks := []Hook{{URL: srv.URL, Secret: "secret"}}
+
+	d, err := New(db, "internal", hooks, queueFile, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := db.SetA("foo", net.ParseIP("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteA("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first attempt fails and is retried; order is kept.
+	events := r.wait(t, 2)
+	if events[0].Type != dnsdb.EventSet || events[0].Host != "foo" || events[0].Address != "10.0.0.2" || events[0].Domain != "internal" {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+
+	if events[1].Type != dnsdb.EventDelete || events[1].Previous != "10.0.0.2" || events[1].Revision != events[0].Revision+1 {
+		t.Fatalf("unexpected event: %+v", events[1])
+	}
+
+	// changes made while stopped are sent on the next start.
+	d.Close()
+
+	if err := db.SetA("bar", net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = New(db, "internal", hooks, queueFile, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	defer d.Close()
+
+	events = r.wait(t, 3)
+	if events[2].Host != "bar" {
+		t.Fatalf("unexpected event: %+v", events[2])
+	}
+}
+
+func TestQueueBound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ldnsd-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newQueue(filepath.Join(dir, "queue.db"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := uint64(1); i <= 3; i++ {
+		if err := q.push(i, []*delivery{{URL: "http://example.com", Body: []byte{byte(i)}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := q.next("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d == nil || d.Body[0] != 2 {
+		t.Fatalf("oldest delivery was not dropped: %+v", d)
+	}
+
+	rev, ok, err := q.revision()
+	if err != nil || !ok || rev != 3 {
+		t.Fatalf("unexpected revision %d (%v): %v", rev, ok, err)
+	}
+}